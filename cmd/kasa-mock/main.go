@@ -0,0 +1,276 @@
+// Command kasa-mock runs a fake TP-Link cloud and fake LAN devices described
+// by a fixture file, so the tray can be run and demoed without hardware.
+//
+// Point the tray at it by setting "cloud_url" in config.json to the printed
+// address and log in with the fixture's username and password. Device
+// state can be changed while running through the /admin/ endpoints:
+//
+//	GET  /admin/devices
+//	POST /admin/devices/{id}/on|off|toggle|online|offline
+//	POST /admin/devices/{id}/brightness?value=50
+//	POST /admin/expire-tokens
+//	POST /admin/latency?ms=500
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+type fixture struct {
+	Username string           `mapstructure:"username"`
+	Password string           `mapstructure:"password"`
+	MFACode  string           `mapstructure:"mfacode"`
+	Devices  []*deviceFixture `mapstructure:"devices"`
+}
+
+type deviceFixture struct {
+	Id      string `mapstructure:"id"`
+	Kind    string `mapstructure:"kind"`
+	Alias   string `mapstructure:"alias"`
+	Model   string `mapstructure:"model"`
+	Outlets int    `mapstructure:"outlets"`
+	// Powered is not called "on", YAML reads that key as a boolean.
+	Powered    bool `mapstructure:"powered"`
+	Brightness int  `mapstructure:"brightness"`
+	Offline    bool `mapstructure:"offline"`
+	Shared     bool `mapstructure:"shared"`
+	// Local is the address to answer the LAN protocol on, e.g.
+	// 127.0.0.1:9999. Empty means the device is only reachable through
+	// the cloud.
+	Local string `mapstructure:"local"`
+}
+
+type deviceState struct {
+	Id      string `json:"id"`
+	Alias   string `json:"alias"`
+	Model   string `json:"model"`
+	On      bool   `json:"on"`
+	Offline bool   `json:"offline"`
+	Local   string `json:"local,omitempty"`
+}
+
+type mock struct {
+	cloud  *kasatest.Cloud
+	locals map[string]*kasatest.LocalServer
+}
+
+func main() {
+	fixturePath := flag.String("fixture", "devices.yaml", "device fixture (json or yaml)")
+	listen := flag.String("listen", "127.0.0.1:8080", "address of the fake cloud and admin endpoints")
+	flag.Parse()
+
+	f, err := readFixture(*fixturePath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	m, err := newMock(f)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/", m.adminHandler)
+	mux.Handle("/", m.cloud)
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("Fake cloud listening on http://%s (login %s / %s)\n", listener.Addr(), f.Username, f.Password)
+	log.Fatalln(http.Serve(listener, mux))
+}
+
+func readFixture(path string) (*fixture, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	f := &fixture{}
+	if err := v.Unmarshal(f); err != nil {
+		return nil, err
+	}
+	if f.Username == "" {
+		f.Username = "demo@example.com"
+	}
+	if f.Password == "" {
+		f.Password = "demo"
+	}
+	return f, nil
+}
+
+func newMock(f *fixture) (*mock, error) {
+	m := &mock{
+		cloud:  kasatest.NewCloud(f.Username, f.Password),
+		locals: map[string]*kasatest.LocalServer{},
+	}
+	m.cloud.OnRequest = func(method string, params map[string]interface{}) {
+		if requestData, ok := params["requestData"].(string); ok {
+			log.Printf("cloud %s %v %s\n", method, params["deviceId"], requestData)
+			return
+		}
+		log.Printf("cloud %s\n", method)
+	}
+	if f.MFACode != "" {
+		m.cloud.RequireMFA(f.MFACode)
+	}
+	for _, def := range f.Devices {
+		device, err := newDevice(def)
+		if err != nil {
+			return nil, err
+		}
+		m.cloud.AddDevice(device)
+		m.cloud.SetOffline(def.Id, def.Offline)
+		if def.Local == "" {
+			continue
+		}
+		local, err := kasatest.ServeLocal(device, def.Local)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", def.Alias, err)
+		}
+		local.OnRequest = func(device kasatest.Device, command map[string]interface{}) {
+			data, _ := json.Marshal(command)
+			log.Printf("local %s %s\n", device.ID(), data)
+		}
+		m.locals[def.Id] = local
+		log.Printf("%s answering on %s\n", def.Alias, local.Addr())
+	}
+	return m, nil
+}
+
+func newDevice(def *deviceFixture) (kasatest.Switch, error) {
+	if def.Id == "" {
+		return nil, fmt.Errorf("device %q has no id", def.Alias)
+	}
+	var device kasatest.Switch
+	switch strings.ToLower(def.Kind) {
+	case "bulb", "":
+		bulb := kasatest.NewBulb(def.Id, def.Alias, modelOr(def.Model, "KL130"))
+		if def.Brightness > 0 {
+			bulb.SetBrightness(def.Brightness)
+		}
+		if def.Shared {
+			bulb.SetRole(kasa.RoleShared)
+		}
+		device = bulb
+	case "plug":
+		plug := kasatest.NewPlug(def.Id, def.Alias, modelOr(def.Model, "HS110"))
+		if def.Shared {
+			plug.SetRole(kasa.RoleShared)
+		}
+		device = plug
+	case "strip":
+		outlets := def.Outlets
+		if outlets == 0 {
+			outlets = 3
+		}
+		strip := kasatest.NewStrip(def.Id, def.Alias, modelOr(def.Model, "HS300"), outlets)
+		if def.Shared {
+			strip.SetRole(kasa.RoleShared)
+		}
+		device = strip
+	default:
+		return nil, fmt.Errorf("device %s: unknown kind %q", def.Id, def.Kind)
+	}
+	device.SetOn(def.Powered)
+	return device, nil
+}
+
+func modelOr(model string, fallback string) string {
+	if model == "" {
+		return fallback
+	}
+	return model
+}
+
+func (m *mock) adminHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "devices" && r.Method == http.MethodGet:
+		m.writeDevices(w)
+	case path == "expire-tokens" && r.Method == http.MethodPost:
+		m.cloud.ExpireTokens()
+		log.Println("admin: expired all tokens")
+		w.WriteHeader(http.StatusNoContent)
+	case path == "latency" && r.Method == http.MethodPost:
+		ms, err := strconv.Atoi(r.URL.Query().Get("ms"))
+		if err != nil {
+			http.Error(w, "ms must be a number", http.StatusBadRequest)
+			return
+		}
+		m.cloud.SetLatency(time.Duration(ms) * time.Millisecond)
+		log.Printf("admin: latency set to %dms\n", ms)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[0] == "devices" && r.Method == http.MethodPost:
+		m.deviceAction(w, r, parts[1], parts[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *mock) deviceAction(w http.ResponseWriter, r *http.Request, id string, action string) {
+	device, ok := m.cloud.Device(id).(kasatest.Switch)
+	if !ok {
+		http.Error(w, "no such device", http.StatusNotFound)
+		return
+	}
+	switch action {
+	case "on":
+		device.SetOn(true)
+	case "off":
+		device.SetOn(false)
+	case "toggle":
+		device.SetOn(!device.IsOn())
+	case "online":
+		m.cloud.SetOffline(id, false)
+	case "offline":
+		m.cloud.SetOffline(id, true)
+	case "brightness":
+		bulb, ok := device.(*kasatest.Bulb)
+		value, err := strconv.Atoi(r.URL.Query().Get("value"))
+		if !ok || err != nil {
+			http.Error(w, "brightness needs a bulb and a numeric value", http.StatusBadRequest)
+			return
+		}
+		bulb.SetBrightness(value)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("admin: %s %s\n", id, action)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *mock) writeDevices(w http.ResponseWriter) {
+	states := []*deviceState{}
+	for _, device := range m.cloud.Devices() {
+		info := device.Info()
+		state := &deviceState{
+			Id:      device.ID(),
+			Alias:   info.Alias,
+			Model:   info.DeviceModel,
+			Offline: m.cloud.IsOffline(device.ID()),
+		}
+		if s, ok := device.(kasatest.Switch); ok {
+			state.On = s.IsOn()
+		}
+		if local, ok := m.locals[device.ID()]; ok {
+			state.Local = local.Addr()
+		}
+		states = append(states, state)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/mqtt"
+)
+
+const rawTimeout = 30 * time.Second
+
+func powerText(s *kasa.DeviceState) string {
+	switch {
+	case !s.Online:
+		return "offline"
+	case s.On:
+		return "on"
+	}
+	return "off"
+}
+
+func brightnessText(s *kasa.DeviceState) string {
+	if s.Brightness == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d%%", *s.Brightness)
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	encoder := json.NewEncoder(c.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func (c *cli) needArgs(args []string, n int) error {
+	if len(args) != n {
+		return failWith(exitUsage, "usage: kasa %s", c.usage)
+	}
+	return nil
+}
+
+func (c *cli) login(args []string) error {
+	if err := c.needArgs(args, 0); err != nil {
+		return err
+	}
+	if err := c.connect(); err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(map[string]interface{}{"devices": len(c.devices)})
+	}
+	fmt.Fprintf(c.out, "Logged in, found %d device(s)\n", len(c.devices))
+	return nil
+}
+
+func (c *cli) list(args []string) error {
+	if err := c.needArgs(args, 0); err != nil {
+		return err
+	}
+	if err := c.connect(); err != nil {
+		return err
+	}
+	states := []*kasa.DeviceState{}
+	for _, device := range c.devices {
+		states = append(states, kasa.StateOf(device))
+	}
+	if c.json {
+		return c.printJSON(states)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ALIAS\tMODEL\tSTATE\tBRIGHTNESS\tID")
+	for _, s := range states {
+		alias := s.Alias
+		if s.Shared {
+			alias += " (shared)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", alias, s.Model, powerText(s), brightnessText(s), s.Id)
+	}
+	return w.Flush()
+}
+
+func (c *cli) info(args []string) error {
+	if err := c.needArgs(args, 1); err != nil {
+		return err
+	}
+	device, err := c.findDevice(args[0])
+	if err != nil {
+		return err
+	}
+	state := kasa.StateOf(device)
+	sysInfo := device.LastSysInfo()
+	if c.json {
+		out := map[string]interface{}{
+			"device":       state,
+			"firmware":     device.FirmwareVersion(),
+			"mac":          device.Mac(),
+			"capabilities": device.Capabilities().Names(),
+		}
+		if sysInfo != nil {
+			out["sysinfo"] = sysInfo.Raw
+		}
+		return c.printJSON(out)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Alias:\t%s\n", state.Alias)
+	fmt.Fprintf(w, "Id:\t%s\n", state.Id)
+	fmt.Fprintf(w, "Model:\t%s (%s)\n", state.Model, state.Type)
+	fmt.Fprintf(w, "Firmware:\t%s\n", device.FirmwareVersion())
+	fmt.Fprintf(w, "MAC:\t%s\n", device.Mac())
+	fmt.Fprintf(w, "State:\t%s\n", powerText(state))
+	if state.Brightness != nil {
+		fmt.Fprintf(w, "Brightness:\t%s\n", brightnessText(state))
+	}
+	if state.Mode != "" {
+		fmt.Fprintf(w, "Mode:\t%s\n", state.Mode)
+	}
+	if state.Shared {
+		fmt.Fprintf(w, "Shared:\tyes\n")
+	}
+	fmt.Fprintf(w, "Supports:\t%s\n", strings.Join(device.Capabilities().Names(), ", "))
+	for _, preset := range device.PreferredStates() {
+		label := c.config.PresetLabel(device.Id(), preset.Index)
+		if label == "" {
+			label = fmt.Sprintf("Preset %d", preset.Index+1)
+		}
+		fmt.Fprintf(w, "%s:\t%s\n", label, preset.Summary())
+	}
+	if sysInfo != nil {
+		unknown := sysInfo.UnknownFields()
+		keys := make([]string, 0, len(unknown))
+		for key := range unknown {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value, _ := json.Marshal(unknown[key])
+			fmt.Fprintf(w, "%s:\t%s\n", key, value)
+		}
+	}
+	return w.Flush()
+}
+
+func (c *cli) on(args []string) error {
+	return c.switchPower(args, kasa.Device.TurnOn)
+}
+
+func (c *cli) off(args []string) error {
+	return c.switchPower(args, kasa.Device.TurnOff)
+}
+
+func (c *cli) switchPower(args []string, fn func(kasa.Device) error) error {
+	if err := c.needArgs(args, 1); err != nil {
+		return err
+	}
+	device, err := c.onlineDevice(args[0])
+	if err != nil {
+		return err
+	}
+	if err = fn(device); err != nil {
+		return err
+	}
+	return c.printState(device)
+}
+
+func (c *cli) brightness(args []string) error {
+	if err := c.needArgs(args, 2); err != nil {
+		return err
+	}
+	pct, err := strconv.Atoi(strings.TrimSuffix(args[1], "%"))
+	if err != nil {
+		return failWith(exitUsage, "brightness %q is not a number", args[1])
+	}
+	device, err := c.onlineDevice(args[0])
+	if err != nil {
+		return err
+	}
+	if err = device.SetBrightness(pct); err != nil {
+		return err
+	}
+	return c.printState(device)
+}
+
+func (c *cli) preset(args []string) error {
+	if err := c.needArgs(args, 2); err != nil {
+		return err
+	}
+	device, err := c.onlineDevice(args[0])
+	if err != nil {
+		return err
+	}
+	idx := -1
+	for _, preset := range device.PreferredStates() {
+		label := c.config.PresetLabel(device.Id(), preset.Index)
+		if strconv.Itoa(preset.Index+1) == args[1] || (label != "" && strings.EqualFold(label, args[1])) {
+			idx = preset.Index
+			break
+		}
+	}
+	if idx < 0 {
+		return failWith(exitNotFound, "%s has no preset %q", device.Alias(), args[1])
+	}
+	if err = device.SetPreferredState(idx); err != nil {
+		return err
+	}
+	return c.printState(device)
+}
+
+// raw sends a request in the device protocol and pretty prints the
+// answer.
+func (c *cli) raw(args []string) error {
+	if err := c.needArgs(args, 2); err != nil {
+		return err
+	}
+	if !json.Valid([]byte(args[1])) {
+		return failWith(exitUsage, "request is not valid JSON")
+	}
+	device, err := c.onlineDevice(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, rawTimeout)
+	defer cancel()
+	response, err := device.Raw(ctx, json.RawMessage(args[1]))
+	if err != nil {
+		return err
+	}
+	pretty := &bytes.Buffer{}
+	if err = json.Indent(pretty, response, "", "  "); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(c.out, pretty.String())
+	return err
+}
+
+// watch polls the devices and prints a line, or a JSON object per line,
+// whenever one changes.
+func (c *cli) watch(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := flags.Duration("interval", 30*time.Second, "time between polls")
+	if err := flags.Parse(args); err != nil {
+		return &cliError{exitUsage, err}
+	}
+	if err := c.connect(); err != nil {
+		return err
+	}
+	devices := c.devices
+	if flags.NArg() > 0 {
+		devices = nil
+		for _, name := range flags.Args() {
+			device, err := c.findDevice(name)
+			if err != nil {
+				return err
+			}
+			devices = append(devices, device)
+		}
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	last := map[string]*kasa.DeviceState{}
+	for {
+		for _, device := range devices {
+			state := kasa.StateOf(device)
+			if state.Equal(last[state.Id]) {
+				continue
+			}
+			last[state.Id] = state
+			if err := c.printEvent(state); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-interrupt:
+			return nil
+		case <-ticker.C:
+		}
+		for _, device := range devices {
+			device.Sync()
+		}
+	}
+}
+
+// mqtt runs the MQTT bridge of the tray headless, polling the devices for
+// changes made elsewhere.
+func (c *cli) mqtt(args []string) error {
+	flags := flag.NewFlagSet("mqtt", flag.ContinueOnError)
+	interval := flags.Duration("interval", 30*time.Second, "time between polls")
+	if err := flags.Parse(args); err != nil {
+		return &cliError{exitUsage, err}
+	}
+	if flags.NArg() > 0 {
+		return failWith(exitUsage, "usage: kasa %s", c.usage)
+	}
+	if c.config.MQTTBroker == "" {
+		return failWith(exitUsage, "no mqtt_broker in config.json")
+	}
+	if err := c.connect(); err != nil {
+		return err
+	}
+	registry := kasa.NewRegistry()
+	devices := []kasa.Device{}
+	for _, device := range c.devices {
+		if kasa.CanControl(device) {
+			devices = append(devices, device)
+		}
+	}
+	registry.Set(devices)
+	password, err := c.config.ReadMQTTPassword()
+	if err != nil {
+		return &cliError{exitAuth, err}
+	}
+	hub := kasa.NewHub(registry)
+	bridge := mqtt.NewBridge(hub, &mqtt.Options{
+		Broker:   c.config.MQTTBroker,
+		Username: c.config.MQTTUsername,
+		Password: password,
+	})
+	if c.config.MQTTPrefix != "" {
+		bridge.Prefix = c.config.MQTTPrefix
+	}
+	if c.config.MQTTDiscoveryPrefix != "" {
+		bridge.DiscoveryPrefix = c.config.MQTTDiscoveryPrefix
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	done := make(chan error, 1)
+	go func() { done <- bridge.Run(ctx) }()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		case <-ticker.C:
+		}
+		for _, device := range devices {
+			err := device.Sync()
+			hub.Publish(device)
+			if err != nil || !device.Capabilities().Emeter {
+				continue
+			}
+			if reading, err := kasa.ReadEnergy(ctx, device); err == nil {
+				hub.PublishEnergy(device, reading)
+			}
+		}
+	}
+}
+
+func (c *cli) printEvent(state *kasa.DeviceState) error {
+	if c.json {
+		data, _ := json.Marshal(map[string]interface{}{
+			"time":   time.Now().Format(time.RFC3339),
+			"device": state,
+		})
+		_, err := fmt.Fprintln(c.out, string(data))
+		return err
+	}
+	_, err := fmt.Fprintf(c.out, "%s  %s  %s %s\n", time.Now().Format("15:04:05"), state.Alias, powerText(state), brightnessText(state))
+	return err
+}
+
+func (c *cli) printState(device kasa.Device) error {
+	state := kasa.StateOf(device)
+	if c.json {
+		return c.printJSON(state)
+	}
+	fmt.Fprintf(c.out, "%s is %s", state.Alias, powerText(state))
+	if state.On && state.Brightness != nil {
+		fmt.Fprintf(c.out, " at %s", brightnessText(state))
+	}
+	fmt.Fprintln(c.out)
+	return nil
+}
+
+// provision joins a device that is in setup mode to a Wi-Fi network. The
+// computer has to be connected to the access point of the device and
+// switch back to the network on its own, discovery keeps trying until the
+// timeout.
+func (c *cli) provision(args []string) error {
+	flags := flag.NewFlagSet("provision", flag.ContinueOnError)
+	host := flags.String("host", kasa.DefaultSetupHost, "address of the device in setup mode")
+	bind := flags.Bool("bind", false, "bind the device to the configured cloud account")
+	timeout := flags.Duration("timeout", 2*time.Minute, "time to wait for the device to join")
+	if err := flags.Parse(args); err != nil {
+		return &cliError{exitUsage, err}
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return failWith(exitUsage, "usage: kasa %s", c.usage)
+	}
+	req := &kasa.ProvisionRequest{
+		SetupHost: *host,
+		SSID:      flags.Arg(0),
+		Password:  flags.Arg(1),
+		Timeout:   *timeout,
+	}
+	if *bind {
+		auth, _, err := c.config.ReadAuth(false)
+		if err != nil {
+			return &cliError{exitAuth, err}
+		}
+		req.CloudUsername = auth.Username
+		req.CloudPassword = auth.Password
+	}
+	dev, err := kasa.Provision(req)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(map[string]interface{}{
+			"host":  dev.Host,
+			"alias": dev.SysInfo.Alias,
+			"mac":   dev.SysInfo.MacAddress(),
+			"model": dev.SysInfo.Model,
+		})
+	}
+	fmt.Fprintf(c.out, "%s (%s) joined %s at %s\n", dev.SysInfo.Alias, dev.SysInfo.Model, req.SSID, dev.Host)
+	return nil
+}
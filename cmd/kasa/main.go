@@ -0,0 +1,210 @@
+// Command kasa controls the devices of a TP-Link Kasa account from the
+// shell. It shares config.json, the keyring passphrase and the saved
+// session with the tray.
+//
+//	kasa [--json] [--config dir] <command> [args]
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/tusharsrivastava/kasa-systray/tools"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+// Exit codes, so scripts can tell what went wrong.
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitAuth     = 3
+	exitNotFound = 4
+	exitOffline  = 5
+)
+
+type cliError struct {
+	code int
+	err  error
+}
+
+func (e *cliError) Error() string {
+	return e.err.Error()
+}
+
+func failWith(code int, format string, args ...interface{}) error {
+	return &cliError{code, fmt.Errorf(format, args...)}
+}
+
+type command struct {
+	usage string
+	help  string
+	run   func(c *cli, args []string) error
+}
+
+var commands = map[string]*command{
+	"login":      {"login", "log in and save the session", (*cli).login},
+	"list":       {"list", "list the devices of the account", (*cli).list},
+	"info":       {"info <device>", "show everything known about a device", (*cli).info},
+	"on":         {"on <device>", "turn a device on", (*cli).on},
+	"off":        {"off <device>", "turn a device off", (*cli).off},
+	"brightness": {"brightness <device> <pct>", "turn a light on at a brightness", (*cli).brightness},
+	"preset":     {"preset <device> <n|label>", "apply a saved light preset", (*cli).preset},
+	"raw":        {"raw <device> <json>", "send a raw smart home protocol request", (*cli).raw},
+	"watch":      {"watch [device...]", "print state changes until interrupted", (*cli).watch},
+	"mqtt":       {"mqtt [--interval d]", "bridge the devices to the configured MQTT broker", (*cli).mqtt},
+	"provision":  {"provision [--bind] <ssid> [password]", "connect a device in setup mode to Wi-Fi", (*cli).provision},
+}
+
+var commandOrder = []string{"login", "list", "info", "on", "off", "brightness", "preset", "raw", "watch", "mqtt", "provision"}
+
+type cli struct {
+	config  *tools.Configuration
+	usage   string
+	json    bool
+	out     io.Writer
+	link    kasa.TPLink
+	devices []kasa.Device
+}
+
+func main() {
+	log.SetFlags(0)
+	flags := flag.NewFlagSet("kasa", flag.ContinueOnError)
+	flags.Usage = func() { usage(flags.Output()) }
+	jsonOutput := flags.Bool("json", false, "print JSON instead of tables")
+	configDir := flags.String("config", ".", "directory holding config.json")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		os.Exit(exitUsage)
+	}
+	args := flags.Args()
+	if len(args) == 0 {
+		usage(os.Stderr)
+		os.Exit(exitUsage)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "kasa: unknown command %q\n\n", args[0])
+		usage(os.Stderr)
+		os.Exit(exitUsage)
+	}
+
+	c := &cli{usage: cmd.usage, json: *jsonOutput, out: os.Stdout}
+	err := c.setup(*configDir)
+	if err == nil {
+		err = cmd.run(c, args[1:])
+	}
+	os.Exit(exitCode(err))
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: kasa [--json] [--config dir] <command> [args]")
+	fmt.Fprintln(w, "\ncommands:")
+	for _, name := range commandOrder {
+		fmt.Fprintf(w, "  %-28s %s\n", commands[name].usage, commands[name].help)
+	}
+	fmt.Fprintln(w, "\nexit codes: 1 error, 2 usage, 3 authentication failed, 4 device not found, 5 device offline")
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintln(os.Stderr, "kasa:", err)
+	var cliErr *cliError
+	if errors.As(err, &cliErr) {
+		return cliErr.code
+	}
+	if kasa.IsDeviceOffline(err) {
+		return exitOffline
+	}
+	return exitError
+}
+
+func (c *cli) setup(configDir string) error {
+	c.config = tools.SetupConfigurationIn(configDir)
+	passphrase, err := tools.ReadPassphrase()
+	if err != nil {
+		return &cliError{exitAuth, err}
+	}
+	return c.config.SetPassphrase(passphrase)
+}
+
+// connect logs in, preferring the saved session, and loads the devices.
+func (c *cli) connect() error {
+	if c.link != nil {
+		return nil
+	}
+	auth, isFresh, err := c.config.ReadAuth(false)
+	if err != nil {
+		return &cliError{exitAuth, err}
+	}
+	session, err := c.config.ReadSession()
+	if err != nil {
+		log.Println(err)
+		session = &tools.Session{}
+	}
+	opts := &kasa.LoginOptions{
+		TermId:       session.TermId,
+		RefreshToken: session.RefreshToken,
+		MFACode:      tools.MFACodePrompt,
+		BaseURL:      c.config.CloudURL,
+	}
+	if c.config.TraceDir != "" {
+		recorder, err := kasa.NewRecorder(nil, c.config.TraceDir)
+		if err != nil {
+			return err
+		}
+		opts.Transport = recorder
+	}
+	link, err := kasa.TpLinkLoginWithOptions(auth.Username, auth.Password, opts)
+	if err != nil {
+		var loginErr *kasa.LoginError
+		if errors.As(err, &loginErr) {
+			return &cliError{exitAuth, err}
+		}
+		return err
+	}
+	if isFresh {
+		c.config.WriteConfiguration()
+	}
+	if link.RefreshToken() != session.RefreshToken {
+		err = c.config.SetSession(&tools.Session{TermId: link.TermId(), RefreshToken: link.RefreshToken()})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	link.SetLocalHosts(c.config.TapoHosts)
+	c.link = link
+	c.devices = link.DeviceList()
+	return nil
+}
+
+// findDevice matches an alias (case insensitive) or a device id.
+func (c *cli) findDevice(name string) (kasa.Device, error) {
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	for _, device := range c.devices {
+		if strings.EqualFold(device.Alias(), name) || device.Id() == name {
+			return device, nil
+		}
+	}
+	return nil, failWith(exitNotFound, "no device %q", name)
+}
+
+// onlineDevice is findDevice for commands that need the device to answer.
+func (c *cli) onlineDevice(name string) (kasa.Device, error) {
+	device, err := c.findDevice(name)
+	if err != nil {
+		return nil, err
+	}
+	if device.SyncError() != nil {
+		return nil, failWith(exitOffline, "%s is offline", device.Alias())
+	}
+	return device, nil
+}
@@ -2,7 +2,14 @@ module github.com/tusharsrivastava/kasa-systray
 
 go 1.17
 
-require github.com/getlantern/systray v1.2.0
+require (
+	github.com/getlantern/systray v1.2.0
+	github.com/godbus/dbus/v5 v5.0.6
+	github.com/ncruces/zenity v0.7.12
+	github.com/spf13/viper v1.10.1
+	google.golang.org/grpc v1.43.0
+	google.golang.org/protobuf v1.27.1
+)
 
 require (
 	github.com/akavel/rsrc v0.10.2 // indirect
@@ -10,22 +17,22 @@ require (
 	github.com/danieljoos/wincred v1.1.0 // indirect
 	github.com/dchest/jsmin v0.0.0-20160823214000-faeced883947 // indirect
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
-	github.com/godbus/dbus/v5 v5.0.6 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/josephspurrier/goversioninfo v1.3.0 // indirect
 	github.com/magiconair/properties v1.8.5 // indirect
 	github.com/mitchellh/mapstructure v1.4.3 // indirect
-	github.com/ncruces/zenity v0.7.12 // indirect
 	github.com/pelletier/go-toml v1.9.4 // indirect
 	github.com/randall77/makefat v0.0.0-20210315173500-7ddd0e42c844 // indirect
 	github.com/spf13/afero v1.6.0 // indirect
 	github.com/spf13/cast v1.4.1 // indirect
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/spf13/viper v1.10.1 // indirect
 	github.com/subosito/gotenv v1.2.0 // indirect
 	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d // indirect
+	golang.org/x/net v0.0.0-20210813160813-60bc85c4be6d // indirect
 	golang.org/x/text v0.3.7 // indirect
+	google.golang.org/genproto v0.0.0-20211208223120-3a66f561d7aa // indirect
 	gopkg.in/ini.v1 v1.66.2 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
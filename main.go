@@ -1,16 +1,60 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
 	"github.com/tusharsrivastava/kasa-systray/tools"
+	"github.com/tusharsrivastava/kasa-systray/tools/instance"
+	"github.com/tusharsrivastava/kasa-systray/tools/tray"
 )
 
 func main() {
+	flag.String(instance.ActionOn, "", "turn a device on")
+	flag.String(instance.ActionOff, "", "turn a device off")
+	flag.String(instance.ActionToggle, "", "turn a device on or off")
+	flag.String(instance.ActionScene, "", "apply a scene")
+	flag.Parse()
+	var request *instance.Request
+	var actions int
+	flag.Visit(func(f *flag.Flag) {
+		request = &instance.Request{Action: f.Name, Target: f.Value.String()}
+		actions++
+	})
+	if actions > 1 || flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	server, err := instance.Listen()
+	if err == instance.ErrRunning {
+		// Hand the action to the running tray instead of starting another.
+		if request == nil {
+			log.Println(err)
+			return
+		}
+		message, err := instance.Send(request)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(message)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+	}
+
 	var configuration = tools.SetupConfiguration()
 	passphrase, err := tools.SetPassphraseGUI()
 	if err != nil {
 		panic(err)
 	}
 	_ = configuration.SetPassphrase(passphrase)
-	app := tools.NewTray("", "Kasa by TPLink", configuration)
+	app := tray.NewTray("", "Kasa by TPLink", configuration)
+	if server != nil {
+		app.Serve(server, request)
+	}
 	app.Run()
 }
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+const (
+	EventState  = kasa.ChangeState
+	EventEnergy = kasa.ChangeEnergy
+)
+
+// keepAlive is how often an idle event stream gets a comment, so proxies
+// and clients do not time it out.
+const keepAlive = 15 * time.Second
+
+// Event is pushed to the /events subscribers when a device changes. Energy
+// is only set on energy events.
+type Event struct {
+	Type   string              `json:"type"`
+	Time   time.Time           `json:"time"`
+	Device *kasa.DeviceState   `json:"device"`
+	Energy *kasa.EnergyReading `json:"energy,omitempty"`
+}
+
+// newEvent turns a change of the hub into the event of the stream.
+func newEvent(change *kasa.Change) *Event {
+	return &Event{Type: change.Type, Time: change.Time, Device: change.State, Energy: change.Energy}
+}
+
+// eventsHandler streams the events as server-sent events, starting with
+// the current state of every device.
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	replay, ch := s.Hub.Subscribe(64)
+	defer s.Hub.Unsubscribe(ch)
+	for _, change := range replay {
+		writeEvent(w, newEvent(change))
+	}
+	flusher.Flush()
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case change := <-ch:
+			writeEvent(w, newEvent(change))
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event *Event) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+}
@@ -0,0 +1,218 @@
+package api_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/api"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+type testServer struct {
+	*httptest.Server
+	cloud *kasatest.Cloud
+	bulb  *kasatest.Bulb
+	plug  *kasatest.Plug
+	hub   *kasa.Hub
+}
+
+// newTestServer serves the API over a simulated cloud with a bulb and a
+// plug, and an "evening" scene that dims the bulb and switches the plug
+// off.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	ts := &testServer{
+		bulb: kasatest.NewBulb("bulb-1", "Lamp", "KL130"),
+		plug: kasatest.NewPlug("plug-1", "Fan", "HS100"),
+	}
+	ts.plug.SetOn(true)
+	ts.cloud = kasatest.NewCloud("user@example.org", "secret", ts.bulb, ts.plug)
+	cloudSrv := ts.cloud.Start()
+	t.Cleanup(cloudSrv.Close)
+	link, err := kasa.TpLinkLoginWithOptions("user@example.org", "secret", &kasa.LoginOptions{BaseURL: cloudSrv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := kasa.NewRegistry()
+	registry.Set(link.DeviceList())
+	ts.hub = kasa.NewHub(registry)
+	server := api.NewServer(ts.hub, token)
+	on, off, brightness := true, false, 30
+	scenes := map[string]kasa.Scene{
+		"evening": {
+			{Device: "Lamp", On: &on, Brightness: &brightness},
+			{Device: "Fan", On: &off},
+		},
+	}
+	server.Scenes = func() map[string]kasa.Scene {
+		return scenes
+	}
+	ts.Server = httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// do sends an authorized request and decodes the answer into out, if set.
+func (ts *testServer) do(t *testing.T, method string, path string, body string, out interface{}) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if out != nil {
+		if err = json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return res.StatusCode
+}
+
+func TestListDevices(t *testing.T) {
+	ts := newTestServer(t)
+	states := []*kasa.DeviceState{}
+	if status := ts.do(t, http.MethodGet, "/devices", "", &states); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if len(states) != 2 {
+		t.Fatalf("got %d devices, want 2", len(states))
+	}
+	for _, state := range states {
+		if !state.Online {
+			t.Errorf("%s is offline", state.Alias)
+		}
+		if state.Id == "plug-1" && (!state.On || state.Brightness != nil) {
+			t.Errorf("plug state %+v, want on without brightness", state)
+		}
+	}
+}
+
+func TestDeviceActions(t *testing.T) {
+	ts := newTestServer(t)
+	state := &kasa.DeviceState{}
+	if status := ts.do(t, http.MethodPost, "/devices/bulb-1/on", "", state); status != http.StatusOK || !state.On {
+		t.Errorf("turning the bulb on: status %d, state %+v", status, state)
+	}
+	if !ts.bulb.IsOn() {
+		t.Error("the bulb is still off")
+	}
+	state = &kasa.DeviceState{}
+	status := ts.do(t, http.MethodPut, "/devices/Lamp/brightness", `{"brightness": 25}`, state)
+	if status != http.StatusOK || state.Brightness == nil || *state.Brightness != 25 {
+		t.Errorf("dimming the bulb: status %d, state %+v", status, state)
+	}
+	if status = ts.do(t, http.MethodPost, "/devices/plug-1/off", "", nil); status != http.StatusOK || ts.plug.IsOn() {
+		t.Errorf("turning the plug off: status %d", status)
+	}
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{http.MethodGet, "/devices/nothing", "", http.StatusNotFound},
+		{http.MethodPost, "/devices/plug-1/explode", "", http.StatusNotFound},
+		{http.MethodGet, "/devices/plug-1/on", "", http.StatusMethodNotAllowed},
+		{http.MethodPut, "/devices/bulb-1/brightness", `{"brightness": 101}`, http.StatusBadRequest},
+		{http.MethodPut, "/devices/plug-1/brightness", `{"brightness": 50}`, http.StatusUnprocessableEntity},
+	} {
+		if status := ts.do(t, tc.method, tc.path, tc.body, nil); status != tc.want {
+			t.Errorf("%s %s: status %d, want %d", tc.method, tc.path, status, tc.want)
+		}
+	}
+
+	ts.cloud.SetOffline("plug-1", true)
+	if status := ts.do(t, http.MethodPost, "/devices/plug-1/on", "", nil); status != http.StatusServiceUnavailable {
+		t.Errorf("turning an offline plug on: status %d", status)
+	}
+}
+
+func TestScenes(t *testing.T) {
+	ts := newTestServer(t)
+	names := []string{}
+	if status := ts.do(t, http.MethodGet, "/scenes", "", &names); status != http.StatusOK || len(names) != 1 || names[0] != "evening" {
+		t.Errorf("scenes: status %d, %v", status, names)
+	}
+	if status := ts.do(t, http.MethodPost, "/scenes/Evening", "", nil); status != http.StatusOK {
+		t.Fatalf("applying the scene: status %d", status)
+	}
+	if !ts.bulb.IsOn() || ts.plug.IsOn() {
+		t.Error("the scene did not switch the devices")
+	}
+	if status := ts.do(t, http.MethodPost, "/scenes/morning", "", nil); status != http.StatusNotFound {
+		t.Errorf("an unknown scene: status %d", status)
+	}
+
+	ts.cloud.SetOffline("plug-1", true)
+	res := map[string]interface{}{}
+	if status := ts.do(t, http.MethodPost, "/scenes/evening", "", &res); status != http.StatusBadGateway || res["errors"] == nil {
+		t.Errorf("a scene with an offline device: status %d, %v", status, res)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ts := newTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/events", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	events := readEvents(res.Body)
+
+	for i := 0; i < 2; i++ {
+		if event := <-events; event == nil || event.Type != api.EventState {
+			t.Fatalf("replayed event %d: %+v", i, event)
+		}
+	}
+	if status := ts.do(t, http.MethodPost, "/devices/plug-1/off", "", nil); status != http.StatusOK {
+		t.Fatalf("turning the plug off: status %d", status)
+	}
+	event := <-events
+	if event == nil || event.Type != api.EventState || event.Device.Id != "plug-1" || event.Device.On {
+		t.Errorf("event %+v, want the plug off", event)
+	}
+
+	device := ts.hub.Registry.Find("plug-1")
+	ts.hub.PublishEnergy(device, &kasa.EnergyReading{Power: 3.5, Total: 1})
+	event = <-events
+	if event == nil || event.Type != api.EventEnergy || event.Energy == nil || event.Energy.Power != 3.5 {
+		t.Errorf("event %+v, want the energy reading", event)
+	}
+}
+
+// readEvents decodes the server-sent events of r, the channel is closed
+// with a nil event when the stream ends.
+func readEvents(r io.Reader) chan *api.Event {
+	events := make(chan *api.Event, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			data := strings.TrimPrefix(scanner.Text(), "data: ")
+			if data == scanner.Text() {
+				continue
+			}
+			event := &api.Event{}
+			if json.Unmarshal([]byte(data), event) != nil {
+				return
+			}
+			events <- event
+		}
+	}()
+	return events
+}
@@ -0,0 +1,286 @@
+// Package api serves a local HTTP API to control the devices of the
+// running tray session.
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+//go:embed openapi.json
+var openAPI []byte
+
+// DefaultAddr is where the API listens unless configured otherwise.
+const DefaultAddr = "127.0.0.1:7373"
+
+// Server exposes the devices of a registry over HTTP. Every endpoint but
+// the OpenAPI document needs "Authorization: Bearer <Token>". GET /events
+// also takes an access_token query parameter, for clients like EventSource
+// that cannot set headers.
+type Server struct {
+	Registry *kasa.Registry
+	// Hub streams the device changes to /events and gets the changes the
+	// requests make.
+	Hub   *kasa.Hub
+	Token string
+	// Scenes returns the configured scenes by lowercase name.
+	Scenes func() map[string]kasa.Scene
+
+	mux    *http.ServeMux
+	server *http.Server
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type brightnessRequest struct {
+	Brightness *int `json:"brightness"`
+}
+
+type sceneResponse struct {
+	Scene  string            `json:"scene"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+func NewServer(hub *kasa.Hub, token string) *Server {
+	s := &Server{Registry: hub.Registry, Hub: hub, Token: token, mux: http.NewServeMux()}
+	s.Handle("/openapi.json", http.HandlerFunc(s.openAPIHandler))
+	s.Handle("/devices", s.Authorized(s.devicesHandler))
+	s.Handle("/devices/", s.Authorized(s.deviceHandler))
+	s.Handle("/scenes", s.Authorized(s.scenesHandler))
+	s.Handle("/scenes/", s.Authorized(s.sceneHandler))
+	s.Handle("/events", s.authorizedStream(s.eventsHandler))
+	return s
+}
+
+// Handle adds an endpoint next to the built-in ones. The handler is not
+// wrapped, use Authorized for endpoints that need the token.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves on addr, which must be a loopback address: the API
+// hands out control of the devices to anyone holding the token and is not
+// meant to be reachable from the network.
+func (s *Server) ListenAndServe(addr string) error {
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("local API must listen on a loopback address, not %s", host)
+	}
+	s.server = &http.Server{Addr: addr, Handler: s}
+	log.Printf("Local API listening on http://%s\n", addr)
+	err = s.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+// NewToken returns a random token for Configuration.APIToken.
+func NewToken() string {
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Authorized wraps handler with the bearer token check.
+func (s *Server) Authorized(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.authorize(w, r, "") {
+			handler(w, r)
+		}
+	})
+}
+
+// authorizedStream is Authorized that also takes the token from the query
+// of a GET. Query strings end up in logs and the browser history, so no
+// request that changes anything may use it.
+func (s *Server) authorizedStream(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := ""
+		if r.Method == http.MethodGet {
+			query = r.URL.Query().Get("access_token")
+		}
+		if s.authorize(w, r, query) {
+			handler(w, r)
+		}
+	})
+}
+
+// authorize checks the bearer token, or the query token when there is no
+// header, and answers 401 when neither matches.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, query string) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = query
+	}
+	if s.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("missing or wrong bearer token"))
+		return false
+	}
+	return true
+}
+
+func (s *Server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI)
+}
+
+func (s *Server) devicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+		return
+	}
+	states := []*kasa.DeviceState{}
+	for _, device := range s.Registry.Devices() {
+		states = append(states, kasa.StateOf(device))
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+// deviceHandler serves /devices/{id} and the actions below it.
+func (s *Server) deviceHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/devices/"), "/"), "/")
+	device := s.Registry.Find(parts[0])
+	if device == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no device %q", parts[0]))
+		return
+	}
+	action := ""
+	if len(parts) > 1 {
+		action = strings.Join(parts[1:], "/")
+	}
+	var err error
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, kasa.StateOf(device))
+		return
+	case action == "on" && r.Method == http.MethodPost:
+		err = device.TurnOn()
+	case action == "off" && r.Method == http.MethodPost:
+		err = device.TurnOff()
+	case action == "brightness" && r.Method == http.MethodPut:
+		req := &brightnessRequest{}
+		decodeErr := json.NewDecoder(r.Body).Decode(req)
+		if decodeErr != nil || req.Brightness == nil || *req.Brightness < 0 || *req.Brightness > 100 {
+			writeError(w, http.StatusBadRequest, errors.New(`body must be {"brightness": 0-100}`))
+			return
+		}
+		err = device.SetBrightness(*req.Brightness)
+	case action == "" || action == "on" || action == "off" || action == "brightness":
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed here", r.Method))
+		return
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown action %q", action))
+		return
+	}
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	s.Hub.Publish(device)
+	writeJSON(w, http.StatusOK, kasa.StateOf(device))
+}
+
+func (s *Server) scenesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+		return
+	}
+	names := []string{}
+	for name := range s.scenes() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeJSON(w, http.StatusOK, names)
+}
+
+func (s *Server) sceneHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	name := strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/scenes/"), "/"))
+	scene, ok := s.scenes()[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no scene %q", name))
+		return
+	}
+	res := &sceneResponse{Scene: name}
+	errs := kasa.ApplyScene(s.Registry, scene)
+	for _, action := range scene {
+		if device := s.Registry.Find(action.Device); device != nil {
+			s.Hub.Publish(device)
+		}
+	}
+	status := http.StatusOK
+	if len(errs) > 0 {
+		status = http.StatusBadGateway
+		res.Errors = map[string]string{}
+		for device, err := range errs {
+			res.Errors[device] = err.Error()
+		}
+	}
+	writeJSON(w, status, res)
+}
+
+func (s *Server) scenes() map[string]kasa.Scene {
+	if s.Scenes == nil {
+		return map[string]kasa.Scene{}
+	}
+	return s.Scenes()
+}
+
+// statusFor maps device errors: unsupported features are the caller's
+// fault, everything else is the device or the cloud failing.
+func statusFor(err error) int {
+	var capErr *kasa.CapabilityError
+	switch {
+	case errors.As(err, &capErr):
+		return http.StatusUnprocessableEntity
+	case kasa.IsDeviceOffline(err):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &errorResponse{err.Error()})
+}
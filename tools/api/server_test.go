@@ -0,0 +1,43 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/api"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+const token = "secret-token"
+
+func TestQueryTokenOnlyOnEvents(t *testing.T) {
+	srv := httptest.NewServer(api.NewServer(kasa.NewHub(kasa.NewRegistry()), token))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/devices?access_token=" + token, http.StatusUnauthorized},
+		{http.MethodPost, "/scenes/evening?access_token=" + token, http.StatusUnauthorized},
+		{http.MethodPost, "/events?access_token=" + token, http.StatusUnauthorized},
+		{http.MethodGet, "/events?access_token=wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/events?access_token=" + token, http.StatusOK},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		req, _ := http.NewRequestWithContext(ctx, tc.method, srv.URL+tc.path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		cancel()
+		if res.StatusCode != tc.want {
+			t.Errorf("%s %s: status %d, want %d", tc.method, tc.path, res.StatusCode, tc.want)
+		}
+	}
+}
@@ -9,13 +9,17 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 
 	"github.com/ncruces/zenity"
 	"github.com/spf13/viper"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
 	"github.com/zalando/go-keyring"
 )
 
@@ -26,6 +30,59 @@ type Configuration struct {
 	Passphrase    string `json:"passphrase"`
 	EncryptedAuth string `json:"encrypted_auth"`
 	AutoConnect   bool   `json:"auto_connect"`
+	// PresetLabels maps a device id to its preset labels by slot index.
+	// Viper lowercases keys, so device ids are stored lowercase.
+	PresetLabels map[string]map[string]string `json:"preset_labels"`
+	// TapoHosts maps the MAC of a Tapo device to its LAN address, Tapo
+	// devices are not reachable through the cloud passthrough. The devices
+	// missing from it are found by LAN discovery, which needs the tray on
+	// the same network segment.
+	TapoHosts map[string]string `json:"tapo_hosts"`
+	// EncryptedSession holds the terminal id and refresh token of the last
+	// cloud login, encrypted like the credentials.
+	EncryptedSession string `json:"encrypted_session"`
+	// CloudURL overrides the TP-Link cloud endpoint, e.g. a regional host
+	// or a local mock cloud. Empty means the default endpoint.
+	CloudURL string `json:"cloud_url"`
+	// TraceDir, if set, records every cloud exchange with personal data
+	// redacted, in a new subdirectory per session, for attaching to bug
+	// reports.
+	TraceDir string `json:"trace_dir"`
+	// APIEnabled serves the local control API on APIListen (a loopback
+	// address, api.DefaultAddr when empty) for clients that send APIToken.
+	APIEnabled bool   `json:"api_enabled"`
+	APIListen  string `json:"api_listen"`
+	APIToken   string `json:"api_token"`
+	// Scenes maps a scene name to its actions. Viper lowercases keys, so
+	// names are matched lowercase.
+	Scenes map[string]kasa.Scene `json:"scenes"`
+	// MQTTBroker, if set, bridges the devices to this broker (host:port)
+	// for Home Assistant. The topics start with MQTTPrefix, "kasa" when
+	// empty, and the discovery configs with MQTTDiscoveryPrefix,
+	// "homeassistant" when empty. A password written to MQTTPassword is
+	// moved to EncryptedMQTTPassword by ReadMQTTPassword.
+	MQTTBroker            string `json:"mqtt_broker"`
+	MQTTUsername          string `json:"mqtt_username"`
+	MQTTPassword          string `json:"mqtt_password"`
+	EncryptedMQTTPassword string `json:"encrypted_mqtt_password"`
+	MQTTPrefix            string `json:"mqtt_prefix"`
+	MQTTDiscoveryPrefix   string `json:"mqtt_discovery_prefix"`
+	// MetricsEnabled serves Prometheus metrics on MetricsListen,
+	// metrics.DefaultAddr when empty.
+	MetricsEnabled bool   `json:"metrics_enabled"`
+	MetricsListen  string `json:"metrics_listen"`
+	// DBusEnabled exports the devices on the session bus as
+	// org.kasa.Systray.
+	DBusEnabled bool `json:"dbus_enabled"`
+	// GRPCEnabled serves the gRPC API on GRPCListen, grpc.DefaultAddr when
+	// empty, for clients that send APIToken.
+	GRPCEnabled bool   `json:"grpc_enabled"`
+	GRPCListen  string `json:"grpc_listen"`
+}
+
+type Session struct {
+	TermId       string `json:"term_id"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 type Auth struct {
@@ -34,8 +91,14 @@ type Auth struct {
 }
 
 func SetupConfiguration() *Configuration {
+	return SetupConfigurationIn(".")
+}
+
+// SetupConfigurationIn reads config.json from dir instead of the working
+// directory.
+func SetupConfigurationIn(dir string) *Configuration {
 	viper.SetConfigName("config")
-	viper.AddConfigPath(".")
+	viper.AddConfigPath(dir)
 	viper.SetConfigType("json")
 
 	viper.AutomaticEnv()
@@ -43,7 +106,7 @@ func SetupConfiguration() *Configuration {
 	var configuration Configuration
 
 	if err := viper.ReadInConfig(); err != nil {
-		viper.SetConfigFile(path.Join("./", "config.json"))
+		viper.SetConfigFile(path.Join(dir, "config.json"))
 		log.Printf("Error reading config file, %s\n", err)
 	}
 
@@ -57,6 +120,26 @@ func SetupConfiguration() *Configuration {
 func (config *Configuration) WriteConfiguration() error {
 	viper.Set("encrypted_auth", config.EncryptedAuth)
 	viper.Set("auto_connect", config.AutoConnect)
+	viper.Set("preset_labels", config.PresetLabels)
+	viper.Set("tapo_hosts", config.TapoHosts)
+	viper.Set("encrypted_session", config.EncryptedSession)
+	viper.Set("cloud_url", config.CloudURL)
+	viper.Set("trace_dir", config.TraceDir)
+	viper.Set("api_enabled", config.APIEnabled)
+	viper.Set("api_listen", config.APIListen)
+	viper.Set("api_token", config.APIToken)
+	viper.Set("scenes", config.Scenes)
+	viper.Set("mqtt_broker", config.MQTTBroker)
+	viper.Set("mqtt_username", config.MQTTUsername)
+	viper.Set("mqtt_password", config.MQTTPassword)
+	viper.Set("encrypted_mqtt_password", config.EncryptedMQTTPassword)
+	viper.Set("mqtt_prefix", config.MQTTPrefix)
+	viper.Set("mqtt_discovery_prefix", config.MQTTDiscoveryPrefix)
+	viper.Set("metrics_enabled", config.MetricsEnabled)
+	viper.Set("metrics_listen", config.MetricsListen)
+	viper.Set("dbus_enabled", config.DBusEnabled)
+	viper.Set("grpc_enabled", config.GRPCEnabled)
+	viper.Set("grpc_listen", config.GRPCListen)
 
 	log.Println("\nWriting configuration...", viper.ConfigFileUsed())
 
@@ -78,6 +161,26 @@ func (config *Configuration) SetPassphrase(passphrase string) error {
 	return nil
 }
 
+func (config *Configuration) PresetLabel(deviceId string, idx int) string {
+	return config.PresetLabels[strings.ToLower(deviceId)][strconv.Itoa(idx)]
+}
+
+func (config *Configuration) SetPresetLabel(deviceId string, idx int, label string) error {
+	if config.PresetLabels == nil {
+		config.PresetLabels = map[string]map[string]string{}
+	}
+	key := strings.ToLower(deviceId)
+	if config.PresetLabels[key] == nil {
+		config.PresetLabels[key] = map[string]string{}
+	}
+	if label == "" {
+		delete(config.PresetLabels[key], strconv.Itoa(idx))
+	} else {
+		config.PresetLabels[key][strconv.Itoa(idx)] = label
+	}
+	return config.WriteConfiguration()
+}
+
 func (config *Configuration) SetAuth(username string, password string) error {
 	auth := Auth{Username: username, Password: password}
 	err := config.encrypt(auth)
@@ -87,6 +190,56 @@ func (config *Configuration) SetAuth(username string, password string) error {
 	return config.WriteConfiguration()
 }
 
+// SetSession stores the terminal id and refresh token of a cloud login so
+// that the next start can renew the session without the password.
+func (config *Configuration) SetSession(session *Session) error {
+	encrypted, err := config.encryptValue(session)
+	if err != nil {
+		return err
+	}
+	config.EncryptedSession = encrypted
+	return config.WriteConfiguration()
+}
+
+func (config *Configuration) ReadSession() (*Session, error) {
+	session := &Session{}
+	if config.EncryptedSession == "" {
+		return session, nil
+	}
+	err := config.decryptValue(config.EncryptedSession, session)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// ReadMQTTPassword returns the password of the MQTT broker. A plain
+// mqtt_password is encrypted like the credentials and removed from the
+// config file on the first read.
+func (config *Configuration) ReadMQTTPassword() (string, error) {
+	if config.MQTTPassword != "" {
+		password := config.MQTTPassword
+		encrypted, err := config.encryptValue(password)
+		if err != nil {
+			return "", err
+		}
+		config.EncryptedMQTTPassword = encrypted
+		config.MQTTPassword = ""
+		if err = config.WriteConfiguration(); err != nil {
+			return "", err
+		}
+		return password, nil
+	}
+	password := ""
+	if config.EncryptedMQTTPassword == "" {
+		return password, nil
+	}
+	if err := config.decryptValue(config.EncryptedMQTTPassword, &password); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
 func (config *Configuration) ReadAuth(useGUI bool) (*Auth, bool, error) {
 	var auth Auth
 	var isFresh bool = false
@@ -112,15 +265,7 @@ func (config *Configuration) ReadAuth(useGUI bool) (*Auth, bool, error) {
 
 		isFresh = true
 	}
-	ciphertext, err := base64.StdEncoding.DecodeString(config.EncryptedAuth)
-	if err != nil {
-		return nil, isFresh, err
-	}
-	data, err := config.decrypt(ciphertext)
-	if err != nil {
-		return nil, isFresh, err
-	}
-	err = json.Unmarshal(data, &auth)
+	err := config.decryptValue(config.EncryptedAuth, &auth)
 	if err != nil {
 		return nil, isFresh, err
 	}
@@ -128,27 +273,47 @@ func (config *Configuration) ReadAuth(useGUI bool) (*Auth, bool, error) {
 }
 
 func (config *Configuration) encrypt(data interface{}) error {
+	encrypted, err := config.encryptValue(data)
+	if err != nil {
+		return err
+	}
+	config.EncryptedAuth = encrypted
+	return nil
+}
+
+func (config *Configuration) encryptValue(data interface{}) (string, error) {
 	// Use DES to encrypt the data.
 	dataByte, err := json.Marshal(data)
 	if err != nil {
-		return err
+		return "", err
 	}
 	c, err := aes.NewCipher([]byte(createHash(config.Passphrase)))
 	if err != nil {
-		return err
+		return "", err
 	}
 	gcm, err := cipher.NewGCM(c)
 	if err != nil {
-		return err
+		return "", err
 	}
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err = rand.Read(nonce); err != nil {
-		return err
+		return "", err
 	}
 	ciphertext := gcm.Seal(nonce, nonce, dataByte, nil)
 
-	config.EncryptedAuth = base64.StdEncoding.EncodeToString(ciphertext)
-	return nil
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (config *Configuration) decryptValue(encrypted string, out interface{}) error {
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return err
+	}
+	data, err := config.decrypt(ciphertext)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
 }
 
 func (config *Configuration) decrypt(data []byte) ([]byte, error) {
@@ -203,6 +368,42 @@ func SetPassphraseGUI() (passphrase string, err error) {
 	return passphrase, nil
 }
 
+// ReadPassphrase is SetPassphraseGUI for the terminal: the keyring, then
+// $KASA_PASSPHRASE, then a prompt on stdin.
+func ReadPassphrase() (string, error) {
+	passphrase, err := keyring.Get(APP_SERVICE, KEYRING_KEY)
+	if err == nil {
+		return passphrase, nil
+	}
+	if passphrase = os.Getenv("KASA_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+	fmt.Println("Keyring passphrase:")
+	fmt.Scanln(&passphrase)
+	if passphrase == "" {
+		return "", errors.New("no passphrase given")
+	}
+	if err = keyring.Set(APP_SERVICE, KEYRING_KEY, passphrase); err != nil {
+		log.Printf("Could not store the passphrase in the keyring: %s\n", err)
+	}
+	return passphrase, nil
+}
+
+// MFACodePrompt asks for the two-step verification code on stdin.
+func MFACodePrompt() (string, error) {
+	var code string
+	fmt.Println("Verification code:")
+	fmt.Scanln(&code)
+	return code, nil
+}
+
+func MFACodeGUI() (string, error) {
+	return zenity.Entry(
+		"Enter the verification code sent to you",
+		zenity.Title("Two-step verification"),
+	)
+}
+
 func SetAuthGUI() (username string, password string, err error) {
 	username, err = zenity.Entry(
 		"Enter your Email ID",
@@ -0,0 +1,339 @@
+// Package dbus exports the devices of the running tray on the session bus,
+// for desktop widgets and scripts:
+//
+//	busctl --user call org.kasa.Systray /org/kasa/Systray org.kasa.Systray TurnOn s "Desk Lamp"
+package dbus
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	godbus "github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+const (
+	BusName    = "org.kasa.Systray"
+	ObjectPath = godbus.ObjectPath("/org/kasa/Systray")
+	Interface  = "org.kasa.Systray"
+)
+
+// Errors returned to callers, with the message as their only argument.
+const (
+	ErrorNotFound    = Interface + ".Error.NotFound"
+	ErrorUnsupported = Interface + ".Error.Unsupported"
+	ErrorOffline     = Interface + ".Error.Offline"
+	ErrorFailed      = Interface + ".Error.Failed"
+)
+
+// Device is the state of a device on the bus, (sssbbi). Brightness is -1
+// for devices that cannot be dimmed.
+type Device struct {
+	Id         string
+	Alias      string
+	Model      string
+	Online     bool
+	On         bool
+	Brightness int32
+}
+
+// Service owns BusName and serves the methods of object, the DeviceChanged
+// signal and the Devices property.
+type Service struct {
+	Registry *kasa.Registry
+	// Hub feeds the signals and gets the changes the methods make.
+	Hub *kasa.Hub
+	// Scenes returns the configured scenes by lowercase name.
+	Scenes func() map[string]kasa.Scene
+
+	conn    *godbus.Conn
+	props   *prop.Properties
+	changes chan *kasa.Change
+	done    chan struct{}
+	watcher sync.WaitGroup
+	// setMu serializes the updates of Devices, setting is 1 during one.
+	setMu   sync.Mutex
+	setting int32
+}
+
+// object holds the methods callable over the bus, kept apart from Service
+// so that only they are exported.
+type object struct {
+	s *Service
+}
+
+func NewService(hub *kasa.Hub) *Service {
+	return &Service{Registry: hub.Registry, Hub: hub}
+}
+
+// Start connects to the session bus and takes BusName. It fails if another
+// process already owns the name.
+func (s *Service) Start() error {
+	conn, err := godbus.ConnectSessionBus()
+	if err != nil {
+		return err
+	}
+	reply, err := conn.RequestName(BusName, godbus.NameFlagDoNotQueue)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if reply != godbus.RequestNameReplyPrimaryOwner {
+		conn.Close()
+		return fmt.Errorf("%s is already owned on the session bus", BusName)
+	}
+	obj := &object{s}
+	if err = conn.Export(obj, ObjectPath, Interface); err != nil {
+		conn.Close()
+		return err
+	}
+	s.props, err = prop.Export(conn, ObjectPath, map[string]map[string]*prop.Prop{
+		Interface: {
+			"Devices": {Value: s.devices(), Emit: prop.EmitTrue, Writable: true, Callback: s.checkWrite},
+		},
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	node := &introspect.Node{
+		Name: string(ObjectPath),
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			prop.IntrospectData,
+			{
+				Name:       Interface,
+				Methods:    introspect.Methods(obj),
+				Properties: readOnly(s.props.Introspection(Interface)),
+				Signals: []introspect.Signal{{
+					Name: "DeviceChanged",
+					Args: []introspect.Arg{{Name: "device", Type: "(sssbbi)", Direction: "out"}},
+				}},
+			},
+		},
+	}
+	err = conn.Export(introspect.NewIntrospectable(node), ObjectPath, "org.freedesktop.DBus.Introspectable")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn = conn
+	_, s.changes = s.Hub.Subscribe(16)
+	s.done = make(chan struct{})
+	s.watcher.Add(1)
+	go s.watch()
+	return nil
+}
+
+// Close stops watch before closing the connection it emits on.
+func (s *Service) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	s.Hub.Unsubscribe(s.changes)
+	close(s.done)
+	s.watcher.Wait()
+	return s.conn.Close()
+}
+
+// Refresh updates the Devices property after the devices of the registry
+// were replaced, e.g. by a new login.
+func (s *Service) Refresh() {
+	if s.props != nil {
+		s.setDevices()
+	}
+}
+
+// setDevices updates the Devices property and emits its change. The
+// property is writable so that prop.Set reports a failed emit where SetMust
+// would panic, checkWrite still refuses the writes of bus clients.
+func (s *Service) setDevices() {
+	s.setMu.Lock()
+	defer s.setMu.Unlock()
+	atomic.StoreInt32(&s.setting, 1)
+	err := s.props.Set(Interface, "Devices", devicesVariant(s.devices()))
+	atomic.StoreInt32(&s.setting, 0)
+	if err != nil {
+		log.Printf("Updating the D-Bus devices failed: %s\n", err)
+	}
+}
+
+func (s *Service) checkWrite(*prop.Change) *godbus.Error {
+	if atomic.LoadInt32(&s.setting) == 0 {
+		return prop.ErrReadOnly
+	}
+	return nil
+}
+
+// devicesVariant holds devices in the form prop.Set stores from, the one
+// they arrive in over the bus, structs as slices of their fields.
+func devicesVariant(devices []Device) godbus.Variant {
+	wire := make([][]interface{}, 0, len(devices))
+	for _, d := range devices {
+		wire = append(wire, []interface{}{d.Id, d.Alias, d.Model, d.Online, d.On, d.Brightness})
+	}
+	return godbus.MakeVariantWithSignature(wire, godbus.SignatureOf(devices))
+}
+
+// readOnly introspects the properties as read only to bus clients.
+func readOnly(props []introspect.Property) []introspect.Property {
+	for i := range props {
+		props[i].Access = "read"
+	}
+	return props
+}
+
+// watch emits DeviceChanged and PropertiesChanged for Devices on every
+// state change of the hub until Close.
+func (s *Service) watch() {
+	defer s.watcher.Done()
+	for {
+		select {
+		case <-s.done:
+			return
+		case change := <-s.changes:
+			if change.Type != kasa.ChangeState {
+				continue
+			}
+			err := s.conn.Emit(ObjectPath, Interface+".DeviceChanged", busDevice(change.State))
+			if err != nil {
+				log.Println(err)
+			}
+			s.setDevices()
+		}
+	}
+}
+
+// devices lists the devices with their last published state.
+func (s *Service) devices() []Device {
+	devices := []Device{}
+	for _, device := range s.Registry.Devices() {
+		devices = append(devices, busDevice(s.Hub.State(device)))
+	}
+	return devices
+}
+
+func busDevice(state *kasa.DeviceState) Device {
+	device := Device{
+		Id:         state.Id,
+		Alias:      state.Alias,
+		Model:      state.Model,
+		Online:     state.Online,
+		On:         state.On,
+		Brightness: -1,
+	}
+	if state.Brightness != nil {
+		device.Brightness = int32(*state.Brightness)
+	}
+	return device
+}
+
+func (o *object) ListDevices() ([]Device, *godbus.Error) {
+	return o.s.devices(), nil
+}
+
+func (o *object) GetDevice(name string) (Device, *godbus.Error) {
+	device, dbusErr := o.find(name)
+	if dbusErr != nil {
+		return Device{}, dbusErr
+	}
+	return busDevice(kasa.StateOf(device)), nil
+}
+
+func (o *object) TurnOn(name string) (Device, *godbus.Error) {
+	return o.do(name, kasa.Device.TurnOn)
+}
+
+func (o *object) TurnOff(name string) (Device, *godbus.Error) {
+	return o.do(name, kasa.Device.TurnOff)
+}
+
+func (o *object) Toggle(name string) (Device, *godbus.Error) {
+	return o.do(name, func(device kasa.Device) error {
+		if device.IsConnected() {
+			return device.TurnOff()
+		}
+		return device.TurnOn()
+	})
+}
+
+func (o *object) SetBrightness(name string, brightness int32) (Device, *godbus.Error) {
+	return o.do(name, func(device kasa.Device) error {
+		return device.SetBrightness(int(brightness))
+	})
+}
+
+func (o *object) ListScenes() ([]string, *godbus.Error) {
+	names := []string{}
+	if o.s.Scenes != nil {
+		for name := range o.s.Scenes() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ApplyScene returns the error of every device that failed, by name.
+func (o *object) ApplyScene(name string) (map[string]string, *godbus.Error) {
+	var scene kasa.Scene
+	ok := false
+	if o.s.Scenes != nil {
+		scene, ok = o.s.Scenes()[strings.ToLower(name)]
+	}
+	if !ok {
+		return nil, newError(ErrorNotFound, fmt.Sprintf("no scene %q", name))
+	}
+	failed := map[string]string{}
+	for device, err := range kasa.ApplyScene(o.s.Registry, scene) {
+		failed[device] = err.Error()
+	}
+	for _, action := range scene {
+		if device := o.s.Registry.Find(action.Device); device != nil {
+			o.s.Hub.Publish(device)
+		}
+	}
+	return failed, nil
+}
+
+func (o *object) find(name string) (kasa.Device, *godbus.Error) {
+	device := o.s.Registry.Find(name)
+	if device == nil {
+		return nil, newError(ErrorNotFound, fmt.Sprintf("no device %q", name))
+	}
+	return device, nil
+}
+
+func (o *object) do(name string, fn func(device kasa.Device) error) (Device, *godbus.Error) {
+	device, dbusErr := o.find(name)
+	if dbusErr != nil {
+		return Device{}, dbusErr
+	}
+	if err := fn(device); err != nil {
+		return Device{}, busError(err)
+	}
+	o.s.Hub.Publish(device)
+	return busDevice(kasa.StateOf(device)), nil
+}
+
+func busError(err error) *godbus.Error {
+	var capErr *kasa.CapabilityError
+	switch {
+	case errors.As(err, &capErr):
+		return newError(ErrorUnsupported, err.Error())
+	case kasa.IsDeviceOffline(err):
+		return newError(ErrorOffline, err.Error())
+	}
+	return newError(ErrorFailed, err.Error())
+}
+
+func newError(name string, message string) *godbus.Error {
+	return godbus.NewError(name, []interface{}{message})
+}
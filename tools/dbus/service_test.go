@@ -0,0 +1,174 @@
+package dbus_test
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	godbus "github.com/godbus/dbus/v5"
+	"github.com/tusharsrivastava/kasa-systray/tools/dbus"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:dir=DIR</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startBus runs a private dbus-daemon and points the session bus of the
+// test at it. The test is skipped where there is no dbus-daemon.
+func startBus(t *testing.T) string {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("no dbus-daemon")
+	}
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	if err = os.WriteFile(config, []byte(strings.Replace(busConfig, "DIR", dir, 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = strings.TrimSpace(addr)
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", addr)
+	return addr
+}
+
+func TestService(t *testing.T) {
+	addr := startBus(t)
+	bulb := kasatest.NewBulb("bulb-1", "Lamp", "KL130")
+	plug := kasatest.NewPlug("plug-1", "Fan", "HS100")
+	cloud := kasatest.NewCloud("user@example.org", "secret", bulb, plug)
+	cloudSrv := cloud.Start()
+	defer cloudSrv.Close()
+	link, err := kasa.TpLinkLoginWithOptions("user@example.org", "secret", &kasa.LoginOptions{BaseURL: cloudSrv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := link.DeviceList()
+	registry := kasa.NewRegistry()
+	registry.Set(devices[:1])
+	hub := kasa.NewHub(registry)
+	service := dbus.NewService(hub)
+	off := false
+	service.Scenes = func() map[string]kasa.Scene {
+		return map[string]kasa.Scene{"night": {{Device: "Lamp", On: &off}}}
+	}
+	if err = service.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	conn, err := godbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	obj := conn.Object(dbus.BusName, dbus.ObjectPath)
+	listDevices := func() []dbus.Device {
+		t.Helper()
+		variant, err := obj.GetProperty(dbus.Interface + ".Devices")
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := []dbus.Device{}
+		if err = variant.Store(&list); err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+	if list := listDevices(); len(list) != 1 || list[0].Id != "bulb-1" {
+		t.Fatalf("devices %+v, want the bulb", list)
+	}
+
+	// A new login replaces the devices of the registry.
+	registry.Set(devices)
+	service.Refresh()
+	if list := listDevices(); len(list) != 2 {
+		t.Fatalf("devices %+v after the refresh, want both", list)
+	}
+	err = obj.SetProperty(dbus.Interface+".Devices", godbus.MakeVariant([]dbus.Device{}))
+	if err == nil || len(listDevices()) != 2 {
+		t.Errorf("a bus client wrote the devices: %v", err)
+	}
+
+	if err = conn.AddMatchSignal(godbus.WithMatchInterface(dbus.Interface), godbus.WithMatchMember("DeviceChanged")); err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan *godbus.Signal, 8)
+	conn.Signal(signals)
+
+	device := dbus.Device{}
+	if err = obj.Call(dbus.Interface+".SetBrightness", 0, "Lamp", int32(20)).Store(&device); err != nil {
+		t.Fatal(err)
+	}
+	if !device.On || device.Brightness != 20 || !bulb.IsOn() {
+		t.Errorf("bulb %+v after SetBrightness", device)
+	}
+	select {
+	case signal := <-signals:
+		changed := dbus.Device{}
+		if err = godbus.Store(signal.Body, &changed); err != nil || changed.Id != "bulb-1" || changed.Brightness != 20 {
+			t.Errorf("DeviceChanged %+v: %v", changed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no DeviceChanged signal")
+	}
+
+	callError := func(method string, args ...interface{}) string {
+		t.Helper()
+		call := obj.Call(dbus.Interface+"."+method, 0, args...)
+		if dbusErr, ok := call.Err.(godbus.Error); ok {
+			return dbusErr.Name
+		}
+		t.Errorf("%s: %v, want a D-Bus error", method, call.Err)
+		return ""
+	}
+	if name := callError("TurnOn", "Heater"); name != dbus.ErrorNotFound {
+		t.Errorf("unknown device: %s", name)
+	}
+	if name := callError("SetBrightness", "Fan", int32(50)); name != dbus.ErrorUnsupported {
+		t.Errorf("dimming a plug: %s", name)
+	}
+	cloud.SetOffline("plug-1", true)
+	if name := callError("TurnOn", "Fan"); name != dbus.ErrorOffline {
+		t.Errorf("turning an offline plug on: %s", name)
+	}
+
+	failed := map[string]string{}
+	if err = obj.Call(dbus.Interface+".ApplyScene", 0, "Night").Store(&failed); err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 || bulb.IsOn() {
+		t.Errorf("the scene left the bulb on, failures %v", failed)
+	}
+}
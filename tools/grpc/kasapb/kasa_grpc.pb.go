@@ -0,0 +1,325 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.19.1
+// source: kasapb/kasa.proto
+
+package kasapb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// KasaClient is the client API for Kasa service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type KasaClient interface {
+	ListDevices(ctx context.Context, in *ListDevicesRequest, opts ...grpc.CallOption) (*ListDevicesResponse, error)
+	// GetDevice looks the device up by id, or by alias ignoring case.
+	GetDevice(ctx context.Context, in *GetDeviceRequest, opts ...grpc.CallOption) (*Device, error)
+	// SetDevice switches the device and returns its new state. Setting the
+	// brightness turns the device on.
+	SetDevice(ctx context.Context, in *SetDeviceRequest, opts ...grpc.CallOption) (*Device, error)
+	ListScenes(ctx context.Context, in *ListScenesRequest, opts ...grpc.CallOption) (*ListScenesResponse, error)
+	ApplyScene(ctx context.Context, in *ApplySceneRequest, opts ...grpc.CallOption) (*ApplySceneResponse, error)
+	// WatchDevices sends the current state of the devices, then every change
+	// until the call is cancelled. A client that does not keep up loses
+	// events.
+	WatchDevices(ctx context.Context, in *WatchDevicesRequest, opts ...grpc.CallOption) (Kasa_WatchDevicesClient, error)
+}
+
+type kasaClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKasaClient(cc grpc.ClientConnInterface) KasaClient {
+	return &kasaClient{cc}
+}
+
+func (c *kasaClient) ListDevices(ctx context.Context, in *ListDevicesRequest, opts ...grpc.CallOption) (*ListDevicesResponse, error) {
+	out := new(ListDevicesResponse)
+	err := c.cc.Invoke(ctx, "/kasa.v1.Kasa/ListDevices", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kasaClient) GetDevice(ctx context.Context, in *GetDeviceRequest, opts ...grpc.CallOption) (*Device, error) {
+	out := new(Device)
+	err := c.cc.Invoke(ctx, "/kasa.v1.Kasa/GetDevice", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kasaClient) SetDevice(ctx context.Context, in *SetDeviceRequest, opts ...grpc.CallOption) (*Device, error) {
+	out := new(Device)
+	err := c.cc.Invoke(ctx, "/kasa.v1.Kasa/SetDevice", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kasaClient) ListScenes(ctx context.Context, in *ListScenesRequest, opts ...grpc.CallOption) (*ListScenesResponse, error) {
+	out := new(ListScenesResponse)
+	err := c.cc.Invoke(ctx, "/kasa.v1.Kasa/ListScenes", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kasaClient) ApplyScene(ctx context.Context, in *ApplySceneRequest, opts ...grpc.CallOption) (*ApplySceneResponse, error) {
+	out := new(ApplySceneResponse)
+	err := c.cc.Invoke(ctx, "/kasa.v1.Kasa/ApplyScene", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kasaClient) WatchDevices(ctx context.Context, in *WatchDevicesRequest, opts ...grpc.CallOption) (Kasa_WatchDevicesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Kasa_ServiceDesc.Streams[0], "/kasa.v1.Kasa/WatchDevices", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kasaWatchDevicesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Kasa_WatchDevicesClient interface {
+	Recv() (*DeviceEvent, error)
+	grpc.ClientStream
+}
+
+type kasaWatchDevicesClient struct {
+	grpc.ClientStream
+}
+
+func (x *kasaWatchDevicesClient) Recv() (*DeviceEvent, error) {
+	m := new(DeviceEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// KasaServer is the server API for Kasa service.
+// All implementations must embed UnimplementedKasaServer
+// for forward compatibility
+type KasaServer interface {
+	ListDevices(context.Context, *ListDevicesRequest) (*ListDevicesResponse, error)
+	// GetDevice looks the device up by id, or by alias ignoring case.
+	GetDevice(context.Context, *GetDeviceRequest) (*Device, error)
+	// SetDevice switches the device and returns its new state. Setting the
+	// brightness turns the device on.
+	SetDevice(context.Context, *SetDeviceRequest) (*Device, error)
+	ListScenes(context.Context, *ListScenesRequest) (*ListScenesResponse, error)
+	ApplyScene(context.Context, *ApplySceneRequest) (*ApplySceneResponse, error)
+	// WatchDevices sends the current state of the devices, then every change
+	// until the call is cancelled. A client that does not keep up loses
+	// events.
+	WatchDevices(*WatchDevicesRequest, Kasa_WatchDevicesServer) error
+	mustEmbedUnimplementedKasaServer()
+}
+
+// UnimplementedKasaServer must be embedded to have forward compatible implementations.
+type UnimplementedKasaServer struct {
+}
+
+func (UnimplementedKasaServer) ListDevices(context.Context, *ListDevicesRequest) (*ListDevicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDevices not implemented")
+}
+func (UnimplementedKasaServer) GetDevice(context.Context, *GetDeviceRequest) (*Device, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDevice not implemented")
+}
+func (UnimplementedKasaServer) SetDevice(context.Context, *SetDeviceRequest) (*Device, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetDevice not implemented")
+}
+func (UnimplementedKasaServer) ListScenes(context.Context, *ListScenesRequest) (*ListScenesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListScenes not implemented")
+}
+func (UnimplementedKasaServer) ApplyScene(context.Context, *ApplySceneRequest) (*ApplySceneResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ApplyScene not implemented")
+}
+func (UnimplementedKasaServer) WatchDevices(*WatchDevicesRequest, Kasa_WatchDevicesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchDevices not implemented")
+}
+func (UnimplementedKasaServer) mustEmbedUnimplementedKasaServer() {}
+
+// UnsafeKasaServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KasaServer will
+// result in compilation errors.
+type UnsafeKasaServer interface {
+	mustEmbedUnimplementedKasaServer()
+}
+
+func RegisterKasaServer(s grpc.ServiceRegistrar, srv KasaServer) {
+	s.RegisterService(&Kasa_ServiceDesc, srv)
+}
+
+func _Kasa_ListDevices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListDevicesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KasaServer).ListDevices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kasa.v1.Kasa/ListDevices",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KasaServer).ListDevices(ctx, req.(*ListDevicesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kasa_GetDevice_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetDeviceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KasaServer).GetDevice(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kasa.v1.Kasa/GetDevice",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KasaServer).GetDevice(ctx, req.(*GetDeviceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kasa_SetDevice_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetDeviceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KasaServer).SetDevice(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kasa.v1.Kasa/SetDevice",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KasaServer).SetDevice(ctx, req.(*SetDeviceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kasa_ListScenes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListScenesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KasaServer).ListScenes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kasa.v1.Kasa/ListScenes",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KasaServer).ListScenes(ctx, req.(*ListScenesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kasa_ApplyScene_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ApplySceneRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KasaServer).ApplyScene(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kasa.v1.Kasa/ApplyScene",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KasaServer).ApplyScene(ctx, req.(*ApplySceneRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Kasa_WatchDevices_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchDevicesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KasaServer).WatchDevices(m, &kasaWatchDevicesServer{stream})
+}
+
+type Kasa_WatchDevicesServer interface {
+	Send(*DeviceEvent) error
+	grpc.ServerStream
+}
+
+type kasaWatchDevicesServer struct {
+	grpc.ServerStream
+}
+
+func (x *kasaWatchDevicesServer) Send(m *DeviceEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Kasa_ServiceDesc is the grpc.ServiceDesc for Kasa service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Kasa_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kasa.v1.Kasa",
+	HandlerType: (*KasaServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListDevices",
+			Handler:    _Kasa_ListDevices_Handler,
+		},
+		{
+			MethodName: "GetDevice",
+			Handler:    _Kasa_GetDevice_Handler,
+		},
+		{
+			MethodName: "SetDevice",
+			Handler:    _Kasa_SetDevice_Handler,
+		},
+		{
+			MethodName: "ListScenes",
+			Handler:    _Kasa_ListScenes_Handler,
+		},
+		{
+			MethodName: "ApplyScene",
+			Handler:    _Kasa_ApplyScene_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchDevices",
+			Handler:       _Kasa_WatchDevices_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "kasapb/kasa.proto",
+}
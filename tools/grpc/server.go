@@ -0,0 +1,273 @@
+// Package grpc serves the Kasa service of kasapb/kasa.proto, a typed
+// control API for clients in other languages, on the devices of the
+// running tray session.
+package grpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative kasapb/kasa.proto
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/grpc/kasapb"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	googlegrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultAddr is where the server listens unless configured otherwise.
+const DefaultAddr = "127.0.0.1:7374"
+
+// Server implements kasapb.KasaServer on a registry. Every call needs the
+// metadata "authorization: Bearer <Token>".
+type Server struct {
+	kasapb.UnimplementedKasaServer
+
+	Registry *kasa.Registry
+	// Hub streams the device changes to WatchDevices and gets the changes
+	// the calls make.
+	Hub   *kasa.Hub
+	Token string
+	// Scenes returns the configured scenes by lowercase name.
+	Scenes func() map[string]kasa.Scene
+
+	server *googlegrpc.Server
+}
+
+func NewServer(hub *kasa.Hub, token string) *Server {
+	return &Server{Registry: hub.Registry, Hub: hub, Token: token}
+}
+
+// ListenAndServe serves the Kasa service on addr until Close. Like the
+// HTTP API, addr must be a loopback address.
+func (s *Server) ListenAndServe(addr string) error {
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("gRPC API must listen on a loopback address, not %s", host)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.server = googlegrpc.NewServer(
+		googlegrpc.UnaryInterceptor(s.authorizeUnary),
+		googlegrpc.StreamInterceptor(s.authorizeStream),
+	)
+	kasapb.RegisterKasaServer(s.server, s)
+	log.Printf("gRPC API on %s\n", addr)
+	err = s.server.Serve(listener)
+	if errors.Is(err, googlegrpc.ErrServerStopped) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Close() error {
+	if s.server != nil {
+		s.server.Stop()
+	}
+	return nil
+}
+
+func (s *Server) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		token := strings.TrimPrefix(value, "Bearer ")
+		if s.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or wrong token")
+}
+
+func (s *Server) authorizeUnary(ctx context.Context, req interface{}, info *googlegrpc.UnaryServerInfo, handler googlegrpc.UnaryHandler) (interface{}, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) authorizeStream(srv interface{}, stream googlegrpc.ServerStream, info *googlegrpc.StreamServerInfo, handler googlegrpc.StreamHandler) error {
+	if err := s.authorize(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+func (s *Server) ListDevices(ctx context.Context, req *kasapb.ListDevicesRequest) (*kasapb.ListDevicesResponse, error) {
+	res := &kasapb.ListDevicesResponse{}
+	for _, device := range s.Registry.Devices() {
+		res.Devices = append(res.Devices, pbDevice(kasa.StateOf(device)))
+	}
+	return res, nil
+}
+
+func (s *Server) GetDevice(ctx context.Context, req *kasapb.GetDeviceRequest) (*kasapb.Device, error) {
+	device, err := s.find(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	return pbDevice(kasa.StateOf(device)), nil
+}
+
+func (s *Server) SetDevice(ctx context.Context, req *kasapb.SetDeviceRequest) (*kasapb.Device, error) {
+	device, err := s.find(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case req.Brightness != nil && (*req.Brightness < 0 || *req.Brightness > 100):
+		return nil, status.Error(codes.InvalidArgument, "brightness must be 0-100")
+	case req.On != nil && !*req.On:
+		err = device.TurnOff()
+	case req.Brightness != nil:
+		err = device.SetBrightness(int(*req.Brightness))
+	case req.On != nil:
+		err = device.TurnOn()
+	default:
+		return nil, status.Error(codes.InvalidArgument, "set on or brightness")
+	}
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	s.Hub.Publish(device)
+	return pbDevice(kasa.StateOf(device)), nil
+}
+
+func (s *Server) ListScenes(ctx context.Context, req *kasapb.ListScenesRequest) (*kasapb.ListScenesResponse, error) {
+	res := &kasapb.ListScenesResponse{Scenes: []string{}}
+	for name := range s.scenes() {
+		res.Scenes = append(res.Scenes, name)
+	}
+	sort.Strings(res.Scenes)
+	return res, nil
+}
+
+func (s *Server) ApplyScene(ctx context.Context, req *kasapb.ApplySceneRequest) (*kasapb.ApplySceneResponse, error) {
+	scene, ok := s.scenes()[strings.ToLower(req.Scene)]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no scene %q", req.Scene)
+	}
+	res := &kasapb.ApplySceneResponse{Errors: map[string]string{}}
+	for device, err := range kasa.ApplyScene(s.Registry, scene) {
+		res.Errors[device] = err.Error()
+	}
+	for _, action := range scene {
+		if device := s.Registry.Find(action.Device); device != nil {
+			s.Hub.Publish(device)
+		}
+	}
+	return res, nil
+}
+
+// WatchDevices replays the last published state of the watched devices,
+// then streams their changes.
+func (s *Server) WatchDevices(req *kasapb.WatchDevicesRequest, stream kasapb.Kasa_WatchDevicesServer) error {
+	ids := map[string]bool{}
+	for _, name := range req.Devices {
+		device, err := s.find(name)
+		if err != nil {
+			return err
+		}
+		ids[device.Id()] = true
+	}
+	send := func(change *kasa.Change) error {
+		if len(ids) > 0 && !ids[change.State.Id] {
+			return nil
+		}
+		return stream.Send(newEvent(change))
+	}
+
+	replay, ch := s.Hub.Subscribe(16)
+	defer s.Hub.Unsubscribe(ch)
+	for _, change := range replay {
+		if err := send(change); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case change := <-ch:
+			if err := send(change); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Server) find(name string) (kasa.Device, error) {
+	device := s.Registry.Find(name)
+	if device == nil {
+		return nil, status.Errorf(codes.NotFound, "no device %q", name)
+	}
+	return device, nil
+}
+
+func (s *Server) scenes() map[string]kasa.Scene {
+	if s.Scenes == nil {
+		return map[string]kasa.Scene{}
+	}
+	return s.Scenes()
+}
+
+func newEvent(change *kasa.Change) *kasapb.DeviceEvent {
+	event := &kasapb.DeviceEvent{
+		Type:   kasapb.DeviceEvent_TYPE_STATE,
+		Time:   timestamppb.New(change.Time),
+		Device: pbDevice(change.State),
+	}
+	if change.Energy != nil {
+		event.Type = kasapb.DeviceEvent_TYPE_ENERGY
+		event.Energy = &kasapb.Energy{PowerW: change.Energy.Power, TotalKwh: change.Energy.Total}
+	}
+	return event
+}
+
+func pbDevice(state *kasa.DeviceState) *kasapb.Device {
+	device := &kasapb.Device{
+		Id:     state.Id,
+		Alias:  state.Alias,
+		Model:  state.Model,
+		Type:   state.Type,
+		Online: state.Online,
+		On:     state.On,
+		Mode:   state.Mode,
+		Shared: state.Shared,
+	}
+	if state.Brightness != nil {
+		brightness := int32(*state.Brightness)
+		device.Brightness = &brightness
+	}
+	return device
+}
+
+// statusFor maps device errors like the HTTP API does: unsupported
+// features are the caller's fault, everything else is the device or the
+// cloud failing.
+func statusFor(err error) error {
+	var capErr *kasa.CapabilityError
+	switch {
+	case errors.As(err, &capErr):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case kasa.IsDeviceOffline(err):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
@@ -0,0 +1,71 @@
+package grpc_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/grpc"
+	"github.com/tusharsrivastava/kasa-systray/tools/grpc/kasapb"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	googlegrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestListenOnlyOnLoopback(t *testing.T) {
+	s := grpc.NewServer(kasa.NewHub(kasa.NewRegistry()), "secret-token")
+	for _, addr := range []string{"0.0.0.0:0", ":0", "example.org:7374"} {
+		if err := s.ListenAndServe(addr); err == nil {
+			t.Errorf("served on %s", addr)
+		}
+	}
+}
+
+// serve runs s on a free loopback port and returns a client for it.
+func serve(t *testing.T, s *grpc.Server) kasapb.KasaClient {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe(addr) }()
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := googlegrpc.DialContext(ctx, addr, googlegrpc.WithTransportCredentials(insecure.NewCredentials()), googlegrpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return kasapb.NewKasaClient(conn)
+}
+
+func TestAuthorize(t *testing.T) {
+	for _, tc := range []struct {
+		serverToken string
+		clientToken string
+		want        codes.Code
+	}{
+		{"secret-token", "secret-token", codes.OK},
+		{"secret-token", "wrong", codes.Unauthenticated},
+		{"secret-token", "", codes.Unauthenticated},
+		{"", "", codes.Unauthenticated},
+	} {
+		client := serve(t, grpc.NewServer(kasa.NewHub(kasa.NewRegistry()), tc.serverToken))
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+tc.clientToken)
+		_, err := client.ListDevices(ctx, &kasapb.ListDevicesRequest{})
+		if code := status.Code(err); code != tc.want {
+			t.Errorf("token %q on a server with %q: %v, want %v", tc.clientToken, tc.serverToken, code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Package instance keeps the tray to a single running instance. The first
+// one listens on a unix socket in the runtime directory, a second launch
+// hands it the action of its command line and exits, so that desktop
+// shortcuts can drive the tray:
+//
+//	kasa-systray --toggle "Desk Lamp"
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Actions a launch can forward, Target names the device or the scene.
+const (
+	ActionOn     = "on"
+	ActionOff    = "off"
+	ActionToggle = "toggle"
+	ActionScene  = "scene"
+)
+
+// ErrRunning is returned by Listen when another instance owns the socket.
+var ErrRunning = errors.New("kasa-systray is already running")
+
+// timeout bounds a whole exchange, the running instance answers once the
+// devices did.
+const timeout = 30 * time.Second
+
+type Request struct {
+	Action string `json:"action"`
+	Target string `json:"target"`
+}
+
+type response struct {
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Handler runs a forwarded request and returns a message for the caller.
+type Handler func(req *Request) (string, error)
+
+// Server owns the socket of the running instance.
+type Server struct {
+	listener net.Listener
+}
+
+// SocketPath is the socket in $XDG_RUNTIME_DIR, or in the cache directory
+// of the user where there is none. Unlike the temporary directory, neither
+// is shared with the other users.
+func SocketPath() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "kasa-systray.sock"), nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "kasa-systray", "kasa-systray.sock"), nil
+}
+
+// Listen takes the socket, or returns ErrRunning if an instance answers on
+// it. A socket left behind by an instance that crashed is replaced.
+func Listen() (*Server, error) {
+	path, err := SocketPath()
+	if err != nil {
+		return nil, err
+	}
+	if err = privateDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		conn, dialErr := net.Dial("unix", path)
+		if dialErr == nil {
+			conn.Close()
+			return nil, ErrRunning
+		}
+		// Only ever remove a socket, never a file someone put in its place.
+		if info, statErr := os.Lstat(path); statErr != nil || info.Mode()&os.ModeSocket == 0 {
+			return nil, err
+		}
+		if removeErr := os.Remove(path); removeErr != nil && !os.IsNotExist(removeErr) {
+			return nil, err
+		}
+		listener, err = net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &Server{listener}, nil
+}
+
+// privateDir creates dir if needed and refuses one that other users can
+// write to, they could swap the socket for their own.
+func privateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() || info.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("%s is not a private directory", dir)
+	}
+	return nil
+}
+
+// Serve answers forwarded requests with handle until the server is closed.
+func (s *Server) Serve(handle Handler) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go serveConn(conn, handle)
+	}
+}
+
+// Close stops serving and removes the socket.
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+func serveConn(conn net.Conn, handle Handler) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	req := &Request{}
+	if err := json.NewDecoder(conn).Decode(req); err != nil {
+		// Listen of a later launch only checks that the socket answers.
+		if err != io.EOF {
+			log.Println(err)
+		}
+		return
+	}
+	res := &response{}
+	message, err := handle(req)
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Message = message
+	}
+	json.NewEncoder(conn).Encode(res)
+}
+
+// Send forwards req to the running instance and returns its answer.
+func Send(req *Request) (string, error) {
+	path, err := SocketPath()
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return "", err
+	}
+	res := &response{}
+	if err = json.NewDecoder(conn).Decode(res); err != nil {
+		return "", err
+	}
+	if res.Error != "" {
+		return "", errors.New(res.Error)
+	}
+	return res.Message, nil
+}
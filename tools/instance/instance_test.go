@@ -0,0 +1,110 @@
+package instance_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/instance"
+)
+
+func runtimeDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	return dir
+}
+
+func TestForward(t *testing.T) {
+	runtimeDir(t)
+	server, err := instance.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve(func(req *instance.Request) (string, error) {
+		if req.Target != "Desk Lamp" {
+			return "", errors.New("no device " + req.Target)
+		}
+		return req.Action + " " + req.Target, nil
+	})
+
+	if _, err = instance.Listen(); err != instance.ErrRunning {
+		t.Fatalf("second Listen: %v, want ErrRunning", err)
+	}
+	message, err := instance.Send(&instance.Request{Action: instance.ActionToggle, Target: "Desk Lamp"})
+	if err != nil || message != "toggle Desk Lamp" {
+		t.Errorf("Send: %q, %v", message, err)
+	}
+	if _, err = instance.Send(&instance.Request{Action: instance.ActionOn, Target: "Heater"}); err == nil || err.Error() != "no device Heater" {
+		t.Errorf("Send to an unknown device: %v", err)
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	dir := runtimeDir(t)
+	path := filepath.Join(dir, "kasa-systray.sock")
+	// A crashed instance leaves its socket behind.
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	server, err := instance.Listen()
+	if err != nil {
+		t.Fatalf("Listen over a stale socket: %v", err)
+	}
+	server.Close()
+}
+
+func TestListenKeepsOtherFiles(t *testing.T) {
+	dir := runtimeDir(t)
+	path := filepath.Join(dir, "kasa-systray.sock")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if server, err := instance.Listen(); err == nil {
+		server.Close()
+		t.Fatal("Listen replaced a regular file")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Errorf("the file was removed: %v", err)
+	}
+}
+
+func TestSocketOutsideTempDir(t *testing.T) {
+	cache := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	t.Setenv("XDG_CACHE_HOME", cache)
+	path, err := instance.SocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(filepath.Dir(path)) != cache {
+		t.Fatalf("socket %s, want it in the cache directory", path)
+	}
+	server, err := instance.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil || info.Mode().Perm() != 0o700 {
+		t.Errorf("socket directory %v: %v", info.Mode(), err)
+	}
+}
+
+func TestListenRefusesSharedDir(t *testing.T) {
+	dir := runtimeDir(t)
+	if err := os.Chmod(dir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if server, err := instance.Listen(); err == nil {
+		server.Close()
+		t.Fatal("Listen took a socket in a directory anyone can write to")
+	}
+}
@@ -0,0 +1,148 @@
+package kasa
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// Role is the role of the account on a device in the cloud device list.
+type Role int
+
+const (
+	RoleOwner  Role = 0
+	RoleShared Role = 1
+)
+
+// UnmarshalJSON takes the number the cloud sends, and the same number as
+// a string as some app versions see it.
+func (r *Role) UnmarshalJSON(data []byte) error {
+	var role interface{}
+	if err := json.Unmarshal(data, &role); err != nil {
+		return err
+	}
+	switch role := role.(type) {
+	case nil:
+		*r = RoleOwner
+	case float64:
+		*r = Role(role)
+	case string:
+		n, err := strconv.Atoi(role)
+		if err != nil {
+			return errors.New("role " + strconv.Quote(role) + " is not a number")
+		}
+		*r = Role(n)
+	default:
+		return errors.New("role is not a number")
+	}
+	return nil
+}
+
+type AccountInfo struct {
+	AccountId string `json:"accountId"`
+	Email     string `json:"email"`
+	Nickname  string `json:"nickname"`
+	RegTime   string `json:"regTime"`
+	Locale    string `json:"locale"`
+	Timezone  string `json:"timezone"`
+}
+
+type ShareUser struct {
+	AccountId string `json:"accountId"`
+	Email     string `json:"email"`
+	Nickname  string `json:"nickname"`
+	ShareTime string `json:"shareTime"`
+}
+
+type shareUserList struct {
+	ShareUserList []*ShareUser `json:"shareUserList"`
+}
+
+type DeviceUsage struct {
+	DeviceId     string `json:"deviceId"`
+	BindTime     int64  `json:"bindTime"`
+	LastUsedTime int64  `json:"lastUsedTime"`
+	UsedCount    int    `json:"usedCount"`
+	// Fields keeps everything the cloud returned, the usage metadata is
+	// not documented and differs between app versions.
+	Fields map[string]interface{} `json:"-"`
+}
+
+// IsShared reports whether the device belongs to another account and was
+// shared with us.
+func IsShared(device Device) bool {
+	return device.Role() == RoleShared
+}
+
+// CanControl reports whether we own or were granted the device. A device
+// that is offline right now still can be.
+func CanControl(device Device) bool {
+	role := device.Role()
+	return role == RoleOwner || role == RoleShared
+}
+
+func (t *tpLink) AccountInfo() (*AccountInfo, error) {
+	res, err := t.request(map[string]interface{}{
+		"method": "getAccountInfo",
+		"params": map[string]interface{}{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := &AccountInfo{}
+	transcode(res, &info)
+	return info, nil
+}
+
+func (t *tpLink) ShareUsers(deviceId string) ([]*ShareUser, error) {
+	res, err := t.request(map[string]interface{}{
+		"method": "getShareUserList",
+		"params": map[string]interface{}{
+			"deviceId": deviceId,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	list := &shareUserList{}
+	transcode(res, &list)
+	return list.ShareUserList, nil
+}
+
+func (t *tpLink) ShareDevice(deviceId string, email string) error {
+	return t.shareRequest("shareDevice", deviceId, email)
+}
+
+func (t *tpLink) UnshareDevice(deviceId string, email string) error {
+	return t.shareRequest("unshareDevice", deviceId, email)
+}
+
+func (t *tpLink) shareRequest(method string, deviceId string, email string) error {
+	if email == "" {
+		return errors.New("no email given")
+	}
+	_, err := t.request(map[string]interface{}{
+		"method": method,
+		"params": map[string]interface{}{
+			"deviceId": deviceId,
+			"email":    email,
+		},
+	})
+	return err
+}
+
+func (t *tpLink) DeviceUsage(deviceId string) (*DeviceUsage, error) {
+	res, err := t.request(map[string]interface{}{
+		"method": "getDeviceUsage",
+		"params": map[string]interface{}{
+			"deviceId": deviceId,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	usage := &DeviceUsage{}
+	transcode(res, &usage)
+	transcode(res, &usage.Fields)
+	return usage, nil
+}
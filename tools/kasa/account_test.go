@@ -0,0 +1,49 @@
+package kasa_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+func TestRoleDecoding(t *testing.T) {
+	for data, want := range map[string]kasa.Role{
+		`{"role": 0}`:   kasa.RoleOwner,
+		`{"role": 1}`:   kasa.RoleShared,
+		`{"role": "1"}`: kasa.RoleShared,
+		`{}`:            kasa.RoleOwner,
+	} {
+		info := &kasa.TPLinkDeviceInfo{}
+		if err := json.Unmarshal([]byte(data), info); err != nil {
+			t.Errorf("%s: %v", data, err)
+			continue
+		}
+		if info.Role != want {
+			t.Errorf("%s: role %d, want %d", data, info.Role, want)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"role": "owner"}`), &kasa.TPLinkDeviceInfo{}); err == nil {
+		t.Error("a role that is not a number decoded")
+	}
+}
+
+func TestCanControl(t *testing.T) {
+	owned := kasatest.NewPlug("plug-1", "Fan", "HS100")
+	shared := kasatest.NewBulb("bulb-1", "Lamp", "KL110")
+	shared.SetRole(kasa.RoleShared)
+	foreign := kasatest.NewPlug("plug-2", "Heater", "HS100")
+	foreign.SetRole(2)
+	cloud, link := login(t, owned, shared, foreign)
+	cloud.SetOffline("plug-1", true)
+	want := map[string]bool{"plug-1": true, "bulb-1": true, "plug-2": false}
+	for _, device := range link.DeviceList() {
+		if got := kasa.CanControl(device); got != want[device.Id()] {
+			t.Errorf("CanControl(%s) = %v, want %v", device.Id(), got, want[device.Id()])
+		}
+	}
+	if device, _ := link.FindDevice("Lamp"); device == nil || !kasa.IsShared(device) {
+		t.Error("the shared bulb is not reported as shared")
+	}
+}
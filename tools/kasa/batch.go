@@ -0,0 +1,125 @@
+package kasa
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+type batchCall struct {
+	module string
+	method string
+	args   map[string]interface{}
+}
+
+// Batch combines several module/method calls into one request. The device
+// runs the modules in the order they appear in the JSON, so the batch keeps
+// them in insertion order instead of marshalling a map.
+type Batch struct {
+	calls []*batchCall
+}
+
+type BatchResult struct {
+	data  map[string]interface{}
+	calls []*batchCall
+}
+
+func NewBatch() *Batch {
+	return &Batch{calls: []*batchCall{}}
+}
+
+// Add appends a call. A request holds a module/method only once, so adding
+// one again merges its args into the earlier call, the later values win.
+func (b *Batch) Add(module string, method string, args map[string]interface{}) *Batch {
+	merged := map[string]interface{}{}
+	for _, call := range b.calls {
+		if call.module == module && call.method == method {
+			for key, value := range call.args {
+				merged[key] = value
+			}
+			for key, value := range args {
+				merged[key] = value
+			}
+			call.args = merged
+			return b
+		}
+	}
+	for key, value := range args {
+		merged[key] = value
+	}
+	b.calls = append(b.calls, &batchCall{module, method, merged})
+	return b
+}
+
+func (b *Batch) Len() int {
+	return len(b.calls)
+}
+
+func (b *Batch) MarshalJSON() ([]byte, error) {
+	modules := []string{}
+	methods := map[string][]*batchCall{}
+	for _, call := range b.calls {
+		if _, ok := methods[call.module]; !ok {
+			modules = append(modules, call.module)
+		}
+		methods[call.module] = append(methods[call.module], call)
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteByte('{')
+	for i, module := range modules {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(module)
+		buf.Write(name)
+		buf.WriteString(":{")
+		for j, call := range methods[module] {
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			method, _ := json.Marshal(call.method)
+			args, err := json.Marshal(call.args)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(method)
+			buf.WriteByte(':')
+			buf.Write(args)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Result returns the response of a single call in the batch, with the
+// module's err_code turned into a ModuleError.
+func (r *BatchResult) Result(module string, method string) (map[string]interface{}, error) {
+	return methodResult(r.data, module, method)
+}
+
+// Errors returns the error of every call that failed, in batch order.
+func (r *BatchResult) Errors() []error {
+	errs := []error{}
+	for _, call := range r.calls {
+		if _, err := r.Result(call.module, call.method); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Err returns the first failed call of the batch, if any.
+func (r *BatchResult) Err() error {
+	if errs := r.Errors(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func sendBatch(send requestFunc, b *Batch) (*BatchResult, error) {
+	data, err := send(b)
+	if err != nil {
+		return nil, err
+	}
+	return &BatchResult{data, b.calls}, nil
+}
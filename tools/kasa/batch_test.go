@@ -0,0 +1,79 @@
+package kasa_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+func TestBatchKeepsOrder(t *testing.T) {
+	batch := kasa.NewBatch().
+		Add("system", "set_relay_state", map[string]interface{}{"state": 1}).
+		Add("emeter", "get_realtime", nil).
+		Add("system", "get_sysinfo", nil)
+	data, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"system":{"set_relay_state":{"state":1},"get_sysinfo":{}},"emeter":{"get_realtime":{}}}`
+	if string(data) != want {
+		t.Errorf("batch %s, want %s", data, want)
+	}
+}
+
+func TestBatchMergesRepeatedCalls(t *testing.T) {
+	first := map[string]interface{}{"on_off": 1, "brightness": 20}
+	batch := kasa.NewBatch().
+		Add("smartlife.iot.smartbulb.lightingservice", "transition_light_state", first).
+		Add("system", "get_sysinfo", nil).
+		Add("smartlife.iot.smartbulb.lightingservice", "transition_light_state", map[string]interface{}{"brightness": 60})
+	if batch.Len() != 2 {
+		t.Errorf("batch has %d calls, want the repeated one merged", batch.Len())
+	}
+	data, _ := json.Marshal(batch)
+	want := `{"smartlife.iot.smartbulb.lightingservice":{"transition_light_state":{"brightness":60,"on_off":1}},"system":{"get_sysinfo":{}}}`
+	if string(data) != want {
+		t.Errorf("batch %s, want %s", data, want)
+	}
+	if first["brightness"] != 20 {
+		t.Error("merging changed the args of the caller")
+	}
+}
+
+func TestBatchResultPerModule(t *testing.T) {
+	srv := serveLocal(t, kasatest.NewPlug("plug-1", "Fan", "HS100"))
+	res, err := kasa.NewLocalClient(srv.Addr()).Do(kasa.NewBatch().
+		Add("system", "get_sysinfo", nil).
+		Add("smartlife.iot.dimmer", "set_brightness", map[string]interface{}{"brightness": 50}).
+		Add("system", "reboot_now", nil).
+		Add("netif", "set_stainfo", map[string]interface{}{"ssid": "elsewhere"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := res.Result("system", "get_sysinfo"); err != nil || info["alias"] != "Fan" {
+		t.Errorf("sysinfo %v: %v", info, err)
+	}
+	errs := res.Errors()
+	if len(errs) != 3 {
+		t.Fatalf("got errors %v, want three", errs)
+	}
+	for i, want := range []struct {
+		module string
+		code   int
+	}{
+		{"smartlife.iot.dimmer", -1},
+		{"system", -2},
+		{"netif", -3},
+	} {
+		var modErr *kasa.ModuleError
+		if !errors.As(errs[i], &modErr) || modErr.Module != want.module || modErr.ErrorCode != want.code {
+			t.Errorf("error %d is %v, want %s failing with %d", i, errs[i], want.module, want.code)
+		}
+	}
+	if res.Err() == nil || res.Err().Error() != errs[0].Error() {
+		t.Errorf("Err is %v, want the first failed call", res.Err())
+	}
+}
@@ -0,0 +1,119 @@
+package kasa
+
+import "fmt"
+
+const lightingService = "smartlife.iot.smartbulb.lightingservice"
+
+// Power-on behavior modes. A bulb either comes back as it was before or
+// with a fixed light state, given either as one of its preset slots
+// (Index) or as the light values.
+const (
+	BehaviorLastStatus = "last_status"
+	BehaviorPreset     = "customize_preset"
+)
+
+// Light modes. In circadian mode the bulb follows the time of day with its
+// color temperature and brightness.
+const (
+	ModeNormal    = "normal"
+	ModeCircadian = "circadian"
+)
+
+// PowerOnBehavior fields left nil are not sent, zero is a valid hue and
+// color temperature 0 selects the hue.
+type PowerOnBehavior struct {
+	Mode       string `json:"mode"`
+	Index      *int   `json:"index,omitempty"`
+	Brightness *int   `json:"brightness,omitempty"`
+	ColorTemp  *int   `json:"color_temp,omitempty"`
+	Hue        *int   `json:"hue,omitempty"`
+	Saturation *int   `json:"saturation,omitempty"`
+}
+
+// DefaultBehavior is what a bulb does when switched on from the app or a
+// wall switch (SoftOn) and when power comes back after a cut (HardOn).
+// A nil entry is left untouched by SetDefaultBehavior.
+type DefaultBehavior struct {
+	SoftOn *PowerOnBehavior `json:"soft_on,omitempty"`
+	HardOn *PowerOnBehavior `json:"hard_on,omitempty"`
+}
+
+func (d *TpLinkDevice) DefaultBehavior() (*DefaultBehavior, error) {
+	if err := requireCapability(d, CapabilityPowerOnBehavior); err != nil {
+		return nil, err
+	}
+	res, err := d.Do(NewBatch().Add(lightingService, "get_default_behavior", nil))
+	if err != nil {
+		return nil, err
+	}
+	data, err := res.Result(lightingService, "get_default_behavior")
+	if err != nil {
+		return nil, err
+	}
+	behavior := &DefaultBehavior{}
+	transcode(data, &behavior)
+	return behavior, nil
+}
+
+func (d *TpLinkDevice) SetDefaultBehavior(behavior *DefaultBehavior) error {
+	if err := requireCapability(d, CapabilityPowerOnBehavior); err != nil {
+		return err
+	}
+	args := map[string]interface{}{}
+	transcode(behavior, &args)
+	res, err := d.Do(NewBatch().Add(lightingService, "set_default_behavior", args))
+	if err != nil {
+		return err
+	}
+	_, err = res.Result(lightingService, "set_default_behavior")
+	return err
+}
+
+// Mode returns the light mode the bulb is in, or comes back with when it is
+// off.
+func (d *TpLinkDevice) Mode() string {
+	sysInfo := d.LastSysInfo()
+	if sysInfo == nil || sysInfo.LightState == nil {
+		return ""
+	}
+	if sysInfo.LightState.OnOff == 0 && sysInfo.LightState.DftOnState != nil {
+		return sysInfo.LightState.DftOnState.Mode
+	}
+	return sysInfo.LightState.Mode
+}
+
+func (d *TpLinkDevice) SetMode(mode string) error {
+	if mode != ModeNormal && mode != ModeCircadian {
+		return fmt.Errorf("unknown light mode %q", mode)
+	}
+	if mode == ModeCircadian {
+		if err := requireCapability(d, CapabilityCircadian); err != nil {
+			return err
+		}
+	}
+	// Keep the power state, a bulb that is off only changes the mode it
+	// comes back with.
+	onOff := 0
+	if d.IsConnected() {
+		onOff = 1
+	}
+	return d.transition(map[string]interface{}{
+		"mode":   mode,
+		"on_off": onOff,
+	})
+}
+
+// ApplyDefaultBehavior sets the same power-on behavior on every bulb in the
+// list and skips the other devices. The failures are returned by device id.
+func ApplyDefaultBehavior(devices []Device, behavior *DefaultBehavior) map[string]error {
+	errs := map[string]error{}
+	for _, device := range devices {
+		if !device.Capabilities().PowerOnBehavior {
+			continue
+		}
+		if err := device.SetDefaultBehavior(behavior); err != nil {
+			errs[device.Id()] = err
+		}
+	}
+	return errs
+}
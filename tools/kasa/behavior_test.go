@@ -0,0 +1,100 @@
+package kasa_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestDefaultBehaviorRoundTrip(t *testing.T) {
+	_, link := login(t, kasatest.NewBulb("bulb-1", "Lamp", "KL130"))
+	device := link.DeviceList()[0]
+
+	behavior, err := device.DefaultBehavior()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if behavior.SoftOn.Mode != kasa.BehaviorLastStatus || behavior.HardOn.Mode != kasa.BehaviorLastStatus {
+		t.Errorf("a new bulb comes back with %+v and %+v", behavior.SoftOn, behavior.HardOn)
+	}
+
+	softOn := &kasa.PowerOnBehavior{Mode: kasa.BehaviorPreset, Index: intPtr(2)}
+	if err = device.SetDefaultBehavior(&kasa.DefaultBehavior{SoftOn: softOn}); err != nil {
+		t.Fatal(err)
+	}
+	// Zero is a valid hue and must survive the round trip.
+	hardOn := &kasa.PowerOnBehavior{
+		Mode:       kasa.BehaviorPreset,
+		Brightness: intPtr(60),
+		ColorTemp:  intPtr(0),
+		Hue:        intPtr(0),
+		Saturation: intPtr(100),
+	}
+	if err = device.SetDefaultBehavior(&kasa.DefaultBehavior{HardOn: hardOn}); err != nil {
+		t.Fatal(err)
+	}
+
+	behavior, err = device.DefaultBehavior()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(behavior.SoftOn, softOn) {
+		t.Errorf("soft on %+v, want %+v", behavior.SoftOn, softOn)
+	}
+	if !reflect.DeepEqual(behavior.HardOn, hardOn) {
+		t.Errorf("hard on %+v, want %+v", behavior.HardOn, hardOn)
+	}
+}
+
+func TestApplyDefaultBehavior(t *testing.T) {
+	cloud, link := login(t,
+		kasatest.NewBulb("bulb-1", "Lamp", "KL130"),
+		kasatest.NewBulb("bulb-2", "Hall", "KL110"),
+		kasatest.NewPlug("plug-1", "Fan", "HS100"),
+	)
+	devices := link.DeviceList()
+	cloud.SetOffline("bulb-2", true)
+
+	softOn := &kasa.PowerOnBehavior{Mode: kasa.BehaviorPreset, Index: intPtr(1)}
+	errs := kasa.ApplyDefaultBehavior(devices, &kasa.DefaultBehavior{SoftOn: softOn})
+	if len(errs) != 1 || errs["bulb-2"] == nil {
+		t.Errorf("failures %v, want only the offline bulb, the plug is skipped", errs)
+	}
+	device, _ := link.FindDevice("Lamp")
+	behavior, err := device.DefaultBehavior()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(behavior.SoftOn, softOn) || behavior.HardOn.Mode != kasa.BehaviorLastStatus {
+		t.Errorf("the bulb comes back with %+v and %+v", behavior.SoftOn, behavior.HardOn)
+	}
+}
+
+func TestCircadianMode(t *testing.T) {
+	_, link := login(t, kasatest.NewBulb("bulb-1", "Lamp", "KL130"), kasatest.NewBulb("bulb-2", "Hall", "KL110"))
+	link.DeviceList()
+	lamp, _ := link.FindDevice("Lamp")
+	if !lamp.Capabilities().Circadian {
+		t.Fatal("the KL130 has no circadian mode")
+	}
+	if err := lamp.SetMode(kasa.ModeCircadian); err != nil {
+		t.Fatal(err)
+	}
+	if lamp.Mode() != kasa.ModeCircadian {
+		t.Errorf("mode %q after switching to circadian", lamp.Mode())
+	}
+
+	// A white bulb has no color temperature to follow the day with.
+	hall, _ := link.FindDevice("Hall")
+	var capErr *kasa.CapabilityError
+	if err := hall.SetMode(kasa.ModeCircadian); !errors.As(err, &capErr) || capErr.Capability != kasa.CapabilityCircadian {
+		t.Errorf("circadian mode on a KL110: %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package kasa
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	CapabilityOnOff     = "on/off"
+	CapabilityDimmable  = "brightness"
+	CapabilityColor     = "color"
+	CapabilityColorTemp = "color temperature"
+	CapabilityEmeter    = "energy monitoring"
+	CapabilityChildren  = "child outlets"
+	CapabilityEffects   = "light effects"
+	CapabilityCountdown = "countdown"
+	CapabilitySchedule  = "schedule"
+	// CapabilityPowerOnBehavior is the choice of the light a bulb comes
+	// back with, see DefaultBehavior.
+	CapabilityPowerOnBehavior = "power-on behavior"
+	// CapabilityCircadian is the light mode following the time of day, see
+	// SetMode.
+	CapabilityCircadian = "circadian mode"
+)
+
+type ColorTempRange struct {
+	Min int
+	Max int
+}
+
+// Capabilities describes what a device can do. It is derived from the
+// sysinfo flags and completed with per-model knowledge the sysinfo does
+// not carry.
+type Capabilities struct {
+	OnOff     bool
+	Dimmable  bool
+	Color     bool
+	ColorTemp *ColorTempRange
+	Emeter    bool
+	Children  bool
+	Effects   bool
+	Countdown bool
+	Schedule  bool
+	// PowerOnBehavior is only offered by Kasa bulbs.
+	PowerOnBehavior bool
+	// Circadian is only offered by Kasa bulbs with a variable color
+	// temperature, Tapo bulbs have no such mode.
+	Circadian bool
+}
+
+type CapabilityError struct {
+	Device     string
+	Capability string
+}
+
+func (e *CapabilityError) Error() string {
+	return fmt.Sprintf("%s does not support %s", e.Device, e.Capability)
+}
+
+// Color temperature range by model prefix, the sysinfo only says whether
+// the temperature is variable.
+var colorTempRanges = map[string]*ColorTempRange{
+	"LB120": {2700, 6500},
+	"LB130": {2500, 9000},
+	"LB230": {2500, 9000},
+	"KL120": {2700, 5000},
+	"KL125": {2500, 6500},
+	"KL130": {2500, 9000},
+	"KL135": {2500, 6500},
+	"KL400": {2500, 9000},
+	"KL420": {2500, 9000},
+	"KL430": {2500, 9000},
+}
+
+var defaultColorTempRange = &ColorTempRange{2700, 6500}
+
+// Plugs only advertise energy monitoring in their feature string, so the
+// models known to have one are listed here.
+var emeterModels = []string{"HS110", "HS300", "KP115", "KP125", "LB1", "LB2", "KL1", "KL4"}
+
+var effectModels = []string{"KL400", "KL420", "KL430"}
+
+func modelHasPrefix(model string, prefixes []string) bool {
+	model = strings.ToUpper(model)
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func colorTempRangeFor(model string) *ColorTempRange {
+	model = strings.ToUpper(model)
+	for prefix, r := range colorTempRanges {
+		if strings.HasPrefix(model, prefix) {
+			return &ColorTempRange{r.Min, r.Max}
+		}
+	}
+	return &ColorTempRange{defaultColorTempRange.Min, defaultColorTempRange.Max}
+}
+
+func isBulbType(deviceType string) bool {
+	return strings.Contains(strings.ToUpper(deviceType), "SMARTBULB")
+}
+
+// CapabilitiesFromSysInfo computes the capabilities of a device from its
+// sysinfo and the model tables.
+func CapabilitiesFromSysInfo(sysInfo *SysInfo) *Capabilities {
+	caps := &Capabilities{OnOff: true, Schedule: true}
+	if sysInfo == nil {
+		return caps
+	}
+	fields := sysInfo.Fields()
+	if isBulbType(sysInfo.DeviceType()) {
+		caps.Dimmable = sysInfo.IsDimmable == 1
+		caps.PowerOnBehavior = true
+		caps.Color = sysInfo.IsColor == 1
+		if sysInfo.IsVariableColorTemp == 1 {
+			caps.ColorTemp = colorTempRangeFor(sysInfo.Model)
+			caps.Circadian = true
+		}
+		_, hasEffect := fields["lighting_effect_state"]
+		caps.Effects = hasEffect || modelHasPrefix(sysInfo.Model, effectModels)
+	} else {
+		_, hasBrightness := fields["brightness"]
+		caps.Dimmable = hasBrightness
+		caps.Countdown = true
+	}
+	if _, ok := fields["children"]; ok {
+		caps.Children = true
+	}
+	caps.Emeter = strings.Contains(sysInfo.Feature, "ENE") || modelHasPrefix(sysInfo.Model, emeterModels)
+	return caps
+}
+
+// Supports reports whether the named capability is available.
+func (c *Capabilities) Supports(capability string) bool {
+	switch capability {
+	case CapabilityOnOff:
+		return c.OnOff
+	case CapabilityDimmable:
+		return c.Dimmable
+	case CapabilityColor:
+		return c.Color
+	case CapabilityColorTemp:
+		return c.ColorTemp != nil
+	case CapabilityEmeter:
+		return c.Emeter
+	case CapabilityChildren:
+		return c.Children
+	case CapabilityEffects:
+		return c.Effects
+	case CapabilityCountdown:
+		return c.Countdown
+	case CapabilitySchedule:
+		return c.Schedule
+	case CapabilityPowerOnBehavior:
+		return c.PowerOnBehavior
+	case CapabilityCircadian:
+		return c.Circadian
+	}
+	return false
+}
+
+// Names lists the supported capabilities, followed by the color
+// temperature range if there is one.
+func (c *Capabilities) Names() []string {
+	names := []string{}
+	for _, name := range []string{
+		CapabilityOnOff,
+		CapabilityDimmable,
+		CapabilityColor,
+		CapabilityColorTemp,
+		CapabilityEmeter,
+		CapabilityChildren,
+		CapabilityEffects,
+		CapabilityCountdown,
+		CapabilitySchedule,
+		CapabilityPowerOnBehavior,
+		CapabilityCircadian,
+	} {
+		if c.Supports(name) {
+			names = append(names, name)
+		}
+	}
+	if c.ColorTemp != nil {
+		names = append(names, fmt.Sprintf("%dK-%dK", c.ColorTemp.Min, c.ColorTemp.Max))
+	}
+	return names
+}
+
+func requireCapability(device Device, capability string) error {
+	if device.Capabilities().Supports(capability) {
+		return nil
+	}
+	return &CapabilityError{device.Alias(), capability}
+}
@@ -0,0 +1,109 @@
+package kasa_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+func TestCapabilitiesFromSysInfo(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		sysInfo string
+		want    kasa.Capabilities
+	}{
+		{
+			"plug",
+			`{"model": "HS100(US)", "type": "IOT.SMARTPLUGSWITCH", "feature": "TIM"}`,
+			kasa.Capabilities{OnOff: true, Countdown: true, Schedule: true},
+		},
+		{
+			"plug with a meter in the feature string",
+			`{"model": "HS105(US)", "type": "IOT.SMARTPLUGSWITCH", "feature": "TIM:ENE"}`,
+			kasa.Capabilities{OnOff: true, Emeter: true, Countdown: true, Schedule: true},
+		},
+		{
+			"plug with a meter by model",
+			`{"model": "KP115(US)", "type": "IOT.SMARTPLUGSWITCH", "feature": "TIM"}`,
+			kasa.Capabilities{OnOff: true, Emeter: true, Countdown: true, Schedule: true},
+		},
+		{
+			"dimmer",
+			`{"model": "HS220(US)", "type": "IOT.SMARTPLUGSWITCH", "feature": "TIM", "brightness": 50}`,
+			kasa.Capabilities{OnOff: true, Dimmable: true, Countdown: true, Schedule: true},
+		},
+		{
+			"strip",
+			`{"model": "HS300(US)", "type": "IOT.SMARTPLUGSWITCH", "feature": "TIM:ENE", "children": []}`,
+			kasa.Capabilities{OnOff: true, Emeter: true, Children: true, Countdown: true, Schedule: true},
+		},
+		{
+			"white bulb",
+			`{"model": "KL110(US)", "mic_type": "IOT.SMARTBULB", "is_dimmable": 1}`,
+			kasa.Capabilities{OnOff: true, Dimmable: true, Emeter: true, Schedule: true, PowerOnBehavior: true},
+		},
+		{
+			"color bulb",
+			`{"model": "KL130(US)", "mic_type": "IOT.SMARTBULB", "is_dimmable": 1, "is_color": 1, "is_variable_color_temp": 1}`,
+			kasa.Capabilities{
+				OnOff: true, Dimmable: true, Color: true, ColorTemp: &kasa.ColorTempRange{Min: 2500, Max: 9000},
+				Emeter: true, Schedule: true, PowerOnBehavior: true, Circadian: true,
+			},
+		},
+		{
+			"light strip",
+			`{"model": "KL430(US)", "mic_type": "IOT.SMARTBULB", "is_dimmable": 1, "is_color": 1, "is_variable_color_temp": 1}`,
+			kasa.Capabilities{
+				OnOff: true, Dimmable: true, Color: true, ColorTemp: &kasa.ColorTempRange{Min: 2500, Max: 9000},
+				Emeter: true, Effects: true, Schedule: true, PowerOnBehavior: true, Circadian: true,
+			},
+		},
+		{
+			"bulb missing from the tables",
+			`{"model": "XX999", "mic_type": "IOT.SMARTBULB", "is_dimmable": 1, "is_variable_color_temp": 1}`,
+			kasa.Capabilities{
+				OnOff: true, Dimmable: true, ColorTemp: &kasa.ColorTempRange{Min: 2700, Max: 6500},
+				Schedule: true, PowerOnBehavior: true, Circadian: true,
+			},
+		},
+	} {
+		sysInfo := &kasa.SysInfo{}
+		if err := json.Unmarshal([]byte(tc.sysInfo), sysInfo); err != nil {
+			t.Fatal(err)
+		}
+		if got := kasa.CapabilitiesFromSysInfo(sysInfo); !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("%s: %+v, want %+v", tc.name, *got, tc.want)
+		}
+	}
+}
+
+func TestCapabilityNames(t *testing.T) {
+	caps := &kasa.Capabilities{OnOff: true, Dimmable: true, ColorTemp: &kasa.ColorTempRange{Min: 2700, Max: 5000}}
+	want := []string{kasa.CapabilityOnOff, kasa.CapabilityDimmable, kasa.CapabilityColorTemp, "2700K-5000K"}
+	if names := caps.Names(); !reflect.DeepEqual(names, want) {
+		t.Errorf("names %v, want %v", names, want)
+	}
+}
+
+func TestCapabilityError(t *testing.T) {
+	_, link := login(t, kasatest.NewPlug("plug-1", "Fan", "HS100"))
+	device := link.DeviceList()[0]
+	for name, err := range map[string]error{
+		"SetBrightness": device.SetBrightness(50),
+		"SetColorTemp":  kasa.SetColorTemp(device, 4000),
+		"SetMode":       device.SetMode(kasa.ModeCircadian),
+	} {
+		var capErr *kasa.CapabilityError
+		if !errors.As(err, &capErr) || capErr.Device != "Fan" {
+			t.Errorf("%s on a plug: %v, want a CapabilityError", name, err)
+		}
+	}
+	err := device.SetBrightness(50)
+	if err.Error() != "Fan does not support brightness" {
+		t.Errorf("error %q", err)
+	}
+}
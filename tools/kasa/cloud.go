@@ -0,0 +1,89 @@
+package kasa
+
+// Plugs and switches expose the cloud binding service as cnCloud, bulbs
+// moved it into the smartlife namespace.
+const (
+	cloudModuleIOT  = "cnCloud"
+	cloudModuleBulb = "smartlife.iot.common.cloud"
+)
+
+type requestFunc func(command interface{}) (map[string]interface{}, error)
+
+type CloudInfo struct {
+	Username        string `json:"username"`
+	Server          string `json:"server"`
+	Binded          int    `json:"binded"`
+	CloudConnection int    `json:"cld_connection"`
+	IllegalType     int    `json:"illegalType"`
+	StopConnect     int    `json:"stopConnect"`
+	TcspStatus      int    `json:"tcspStatus"`
+	FwDlPage        string `json:"fwDlPage"`
+	FwNotifyType    int    `json:"fwNotifyType"`
+}
+
+func (c *CloudInfo) IsBound() bool {
+	return c.Binded == 1
+}
+
+func (c *CloudInfo) IsConnected() bool {
+	return c.CloudConnection == 1
+}
+
+func cloudModuleFor(deviceType string) string {
+	if isBulbType(deviceType) {
+		return cloudModuleBulb
+	}
+	return cloudModuleIOT
+}
+
+func getCloudInfo(send requestFunc, module string) (*CloudInfo, error) {
+	data, err := send(map[string]interface{}{
+		module: map[string]interface{}{
+			"get_info": map[string]interface{}{},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cloudInfoResult(data, module)
+}
+
+func cloudInfoResult(data map[string]interface{}, module string) (*CloudInfo, error) {
+	res, err := methodResult(data, module, "get_info")
+	if err != nil {
+		return nil, err
+	}
+	info := &CloudInfo{}
+	transcode(res, &info)
+	return info, nil
+}
+
+func bindCloud(send requestFunc, module string, username string, password string) error {
+	return cloudCommand(send, module, "bind", map[string]interface{}{
+		"username": username,
+		"password": password,
+	})
+}
+
+func unbindCloud(send requestFunc, module string) error {
+	return cloudCommand(send, module, "unbind", map[string]interface{}{})
+}
+
+func setCloudServer(send requestFunc, module string, server string) error {
+	return cloudCommand(send, module, "set_server_url", map[string]interface{}{
+		"server": server,
+	})
+}
+
+func cloudCommand(send requestFunc, module string, method string, args map[string]interface{}) error {
+	data, err := send(map[string]interface{}{
+		module: map[string]interface{}{
+			method: args,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = methodResult(data, module, method)
+	return err
+}
@@ -0,0 +1,101 @@
+package kasa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// LightColor is the color a bulb shows, or turns on with while it is off.
+// ColorTemp is in kelvin and 0 when the bulb shows Hue/Saturation.
+type LightColor struct {
+	ColorTemp  int
+	Hue        int
+	Saturation int
+}
+
+// ColorOf returns the color from the last sysinfo, nil for devices that
+// are not bulbs or did not answer.
+func ColorOf(device Device) *LightColor {
+	sysInfo := device.LastSysInfo()
+	if sysInfo == nil || sysInfo.LightState == nil {
+		return nil
+	}
+	state := sysInfo.LightState.defaultOnState
+	if sysInfo.LightState.OnOff == 0 && sysInfo.LightState.DftOnState != nil {
+		state = *sysInfo.LightState.DftOnState
+	}
+	return &LightColor{state.ColorTemp, state.Hue, state.Saturation}
+}
+
+// SetColorTemp turns a bulb on with a white of kelvin degrees.
+func SetColorTemp(device Device, kelvin int) error {
+	return SetLightColor(device, &LightColor{ColorTemp: kelvin}, nil)
+}
+
+// SetHueSaturation turns a color bulb on with hue (0-360) and saturation
+// (0-100).
+func SetHueSaturation(device Device, hue int, saturation int) error {
+	return SetLightColor(device, &LightColor{Hue: hue, Saturation: saturation}, nil)
+}
+
+// SetLightColor turns a bulb on with color, a white when its ColorTemp is
+// set, and with brightness unless it is nil, in a single change.
+func SetLightColor(device Device, color *LightColor, brightness *int) error {
+	light := map[string]interface{}{}
+	if color.ColorTemp > 0 {
+		if err := requireCapability(device, CapabilityColorTemp); err != nil {
+			return err
+		}
+		r := device.Capabilities().ColorTemp
+		if color.ColorTemp < r.Min || color.ColorTemp > r.Max {
+			return fmt.Errorf("color temperature %dK out of range %dK-%dK", color.ColorTemp, r.Min, r.Max)
+		}
+		light["color_temp"] = color.ColorTemp
+	} else {
+		if err := requireCapability(device, CapabilityColor); err != nil {
+			return err
+		}
+		if color.Hue < 0 || color.Hue > 360 || color.Saturation < 0 || color.Saturation > 100 {
+			return fmt.Errorf("hue %d or saturation %d out of range", color.Hue, color.Saturation)
+		}
+		light["hue"] = color.Hue
+		light["saturation"] = color.Saturation
+		light["color_temp"] = 0
+	}
+	if brightness != nil {
+		if *brightness < 0 || *brightness > 100 {
+			return fmt.Errorf("brightness %d out of range 0-100", *brightness)
+		}
+		light["brightness"] = *brightness
+	}
+	return setLight(device, light)
+}
+
+// setLight sends the light change in the protocol of the device and syncs
+// it, the Device interface has no setter for colors.
+func setLight(device Device, light map[string]interface{}) error {
+	var request map[string]interface{}
+	if IsTapoType(device.Type()) {
+		light["device_on"] = true
+		request = map[string]interface{}{"method": "set_device_info", "params": light}
+	} else {
+		light["on_off"] = 1
+		request = map[string]interface{}{lightingService: map[string]interface{}{"transition_light_state": light}}
+	}
+	data, _ := json.Marshal(request)
+	raw, err := device.Raw(context.Background(), data)
+	if err != nil {
+		return err
+	}
+	if !IsTapoType(device.Type()) {
+		res := map[string]interface{}{}
+		if err = json.Unmarshal(raw, &res); err != nil {
+			return err
+		}
+		if _, err = methodResult(res, lightingService, "transition_light_state"); err != nil {
+			return err
+		}
+	}
+	return device.Sync()
+}
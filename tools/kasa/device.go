@@ -2,19 +2,21 @@ package kasa
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"sync"
 )
 
 type TPLinkDeviceInfo struct {
 	FwVer        string `json:"fwVer"`
 	Alias        string `json:"alias"`
 	Status       int    `json:"status"`
-	Role         string `json:"role"`
+	Role         Role   `json:"role"`
 	DeviceId     string `json:"deviceId"`
 	DeviceMac    string `json:"deviceMac"`
 	DeviceName   string `json:"deviceName"`
@@ -26,7 +28,7 @@ type TPLinkDeviceInfo struct {
 type Device interface {
 	Id() string
 	FirmwareVersion() string
-	Role() string
+	Role() Role
 	Mac() string
 	Model() string
 	Name() string
@@ -40,81 +42,120 @@ type Device interface {
 	IsDisconnected() bool
 	TurnOn() error
 	TurnOff() error
+	SetBrightness(brightness int) error
+	Sync() error
+	// SyncError is the error of the last sync, nil once the device
+	// answered again.
+	SyncError() error
 	SystemInfo() (*SysInfo, error)
+	LastSysInfo() *SysInfo
+	Capabilities() *Capabilities
 	PreferredStates() []*PreferredState
 	SetPreferredState(idx int) error
-	passthroughRequest(command map[string]interface{}) (map[string]interface{}, error)
+	SavePreferredState(idx int) error
+	DefaultBehavior() (*DefaultBehavior, error)
+	SetDefaultBehavior(behavior *DefaultBehavior) error
+	Mode() string
+	SetMode(mode string) error
+	CloudInfo() (*CloudInfo, error)
+	BindCloud(username string, password string) error
+	UnbindCloud() error
+	SetCloudServer(server string) error
+	DayStats(year int, month int) ([]*DayStat, error)
+	MonthStats(year int) ([]*MonthStat, error)
+	Do(batch *Batch) (*BatchResult, error)
+	// Raw sends a request in the device's own protocol and returns its
+	// answer, for features this package does not wrap. Kasa devices take
+	// {"module": {"method": args}}, Tapo devices {"method": ..., "params": ...}.
+	Raw(ctx context.Context, request json.RawMessage) (json.RawMessage, error)
+	passthroughRequest(command interface{}) (map[string]interface{}, error)
 }
 
 type TpLinkDevice struct {
-	GenericType     string
+	GenericType string
+	link        TPLink
+	client      *http.Client
+
+	// mu guards the state of the last sync, the tray polls while the
+	// front ends read. device is replaced, never changed in place.
+	mu              sync.RWMutex
 	device          *TPLinkDeviceInfo
-	params          *url.Values
 	preferredStates []*PreferredState
 	brightness      int
+	sysInfo         *SysInfo
+	caps            *Capabilities
+	syncErr         error
 }
 
 func NewTpLinkDevice(link TPLink, deviceInfo *TPLinkDeviceInfo) Device {
+	if deviceInfo.AppServerUrl == "" {
+		deviceInfo.AppServerUrl = link.BaseURL()
+	}
 	dev := &TpLinkDevice{
 		GenericType: "device",
 		device:      deviceInfo,
 		brightness:  0,
-		params: &url.Values{
-			"appName": {"Kasa_Android"},
-			"termID":  {link.TermId()},
-			"appVer":  {"1.4.4.607"},
-			"ospf":    {"Android+6.0.1"},
-			"netType": {"wifi"},
-			"locale":  {"es_ES"},
-			"token":   {link.Token()},
-		},
+		link:        link,
+		client:      link.HTTPClient(),
 	}
-	dev.syncState()
+	// Until the device answers only the cloud device type is known.
+	dev.caps = CapabilitiesFromSysInfo(nil)
+	dev.caps.Dimmable = isBulbType(dev.Type())
+	dev.caps.PowerOnBehavior = dev.caps.Dimmable
+	dev.Sync()
 	return dev
 }
 
 func (d *TpLinkDevice) PreferredStates() []*PreferredState {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	return d.preferredStates
 }
 
+func (d *TpLinkDevice) deviceInfo() *TPLinkDeviceInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.device
+}
+
 func (d *TpLinkDevice) Id() string {
-	return d.device.DeviceId
+	return d.deviceInfo().DeviceId
 }
 
 func (d *TpLinkDevice) FirmwareVersion() string {
-	return d.device.FwVer
+	return d.deviceInfo().FwVer
 }
 
-func (d *TpLinkDevice) Role() string {
-	return d.device.Role
+func (d *TpLinkDevice) Role() Role {
+	return d.deviceInfo().Role
 }
 
 func (d *TpLinkDevice) Mac() string {
-	return d.device.DeviceMac
+	return d.deviceInfo().DeviceMac
 }
 
 func (d *TpLinkDevice) Model() string {
-	return d.device.DeviceModel
+	return d.deviceInfo().DeviceModel
 }
 
 func (d *TpLinkDevice) Name() string {
-	return d.device.DeviceName
+	return d.deviceInfo().DeviceName
 }
 
 func (d *TpLinkDevice) Type() string {
-	return d.device.DeviceType
+	return d.deviceInfo().DeviceType
 }
 
 func (d *TpLinkDevice) Status() int {
-	return d.device.Status
+	return d.deviceInfo().Status
 }
 
 func (d *TpLinkDevice) Alias() string {
-	return d.device.Alias
+	return d.deviceInfo().Alias
 }
 
 func (d *TpLinkDevice) AppServerUrl() string {
-	return d.device.AppServerUrl
+	return d.deviceInfo().AppServerUrl
 }
 
 func (d *TpLinkDevice) HumanName() string {
@@ -125,85 +166,250 @@ func (d *TpLinkDevice) HumanName() string {
 		return "OFF"
 	}(d.IsConnected())
 
-	return fmt.Sprintf("%s [%s %d%%]", d.device.Alias, status, d.brightness)
+	if !d.Capabilities().Dimmable {
+		return fmt.Sprintf("%s [%s]", d.Alias(), status)
+	}
+	if d.Mode() == ModeCircadian {
+		return fmt.Sprintf("%s [%s %d%% %s]", d.Alias(), status, d.Brightness(), ModeCircadian)
+	}
+	return fmt.Sprintf("%s [%s %d%%]", d.Alias(), status, d.Brightness())
+}
+
+// Capabilities returns the capabilities computed at the last sync.
+func (d *TpLinkDevice) Capabilities() *Capabilities {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.caps
 }
 
 func (d *TpLinkDevice) Brightness() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	return d.brightness
 }
 
 func (d *TpLinkDevice) IsConnected() bool {
-	return d.device.Status == 1
+	return d.Status() == 1
 }
 
 func (d *TpLinkDevice) IsDisconnected() bool {
-	return d.device.Status == 0
+	return d.Status() == 0
 }
 
 func (d *TpLinkDevice) TurnOn() error {
-	_, err := d.passthroughRequest(map[string]interface{}{
-		"smartlife.iot.smartbulb.lightingservice": map[string]interface{}{
-			"transition_light_state": map[string]interface{}{
-				"brightness": 100,
-				"on_off":     1,
-			},
-		},
-	})
-	if err != nil {
+	return d.setPower(true)
+}
+
+func (d *TpLinkDevice) TurnOff() error {
+	return d.setPower(false)
+}
+
+func (d *TpLinkDevice) setPower(on bool) error {
+	if err := requireCapability(d, CapabilityOnOff); err != nil {
 		return err
 	}
-	return d.syncState()
+	state := 0
+	if on {
+		state = 1
+	}
+	if !isBulbType(d.Type()) {
+		return d.changeState("system", "set_relay_state", map[string]interface{}{
+			"state": state,
+		})
+	}
+	light := map[string]interface{}{"on_off": state}
+	if d.Capabilities().Dimmable {
+		light["brightness"] = 100
+	}
+	return d.transition(light)
 }
 
-func (d *TpLinkDevice) TurnOff() error {
-	_, err := d.passthroughRequest(map[string]interface{}{
-		"smartlife.iot.smartbulb.lightingservice": map[string]interface{}{
-			"transition_light_state": map[string]interface{}{
-				"brightness": 100,
-				"on_off":     0,
-			},
-		},
-	})
-	if err != nil {
+// SetBrightness turns the device on at brightness percent. Bulbs go through
+// the lighting service, dimmer switches through their dimmer module.
+func (d *TpLinkDevice) SetBrightness(brightness int) error {
+	if err := requireCapability(d, CapabilityDimmable); err != nil {
 		return err
 	}
-	return d.syncState()
+	if brightness < 0 || brightness > 100 {
+		return fmt.Errorf("brightness %d out of range 0-100", brightness)
+	}
+	if !isBulbType(d.Type()) {
+		return d.changeState("smartlife.iot.dimmer", "set_brightness", map[string]interface{}{
+			"brightness": brightness,
+		})
+	}
+	return d.transition(map[string]interface{}{
+		"on_off":     1,
+		"brightness": brightness,
+	})
 }
 
+// SystemInfo fetches the sysinfo together with the cloud binding state in
+// a single passthrough.
 func (d *TpLinkDevice) SystemInfo() (*SysInfo, error) {
-	sysInfo, err := d.passthroughRequest(map[string]interface{}{
-		"system": map[string]interface{}{
-			"get_sysinfo": map[string]interface{}{},
-		},
-	})
+	res, err := d.Do(d.sysInfoBatch(NewBatch()))
+	if err != nil {
+		return nil, err
+	}
+	return d.sysInfoResult(res)
+}
+
+// LastSysInfo returns the sysinfo of the last sync without another round
+// trip to the device.
+func (d *TpLinkDevice) LastSysInfo() *SysInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.sysInfo
+}
+
+func (d *TpLinkDevice) Do(batch *Batch) (*BatchResult, error) {
+	return sendBatch(d.passthroughRequest, batch)
+}
+
+// sysInfoBatch appends the calls needed to refresh the device state, so
+// that a state change and its sync cost a single round trip.
+func (d *TpLinkDevice) sysInfoBatch(batch *Batch) *Batch {
+	return batch.
+		Add("system", "get_sysinfo", nil).
+		Add(d.cloudModule(), "get_info", nil)
+}
+
+func (d *TpLinkDevice) sysInfoResult(res *BatchResult) (*SysInfo, error) {
+	data, err := res.Result("system", "get_sysinfo")
+	if err != nil {
+		return nil, err
+	}
+	sysInfo := &SysInfo{}
+	transcode(data, &sysInfo)
+	if cloud, err := cloudInfoResult(res.data, d.cloudModule()); err == nil {
+		sysInfo.Cloud = cloud
+	}
+	return sysInfo, nil
+}
+
+// transition changes the light state and reads back the sysinfo in the
+// same passthrough.
+func (d *TpLinkDevice) transition(state map[string]interface{}) error {
+	return d.changeState(lightingService, "transition_light_state", state)
+}
+
+func (d *TpLinkDevice) changeState(module string, method string, args map[string]interface{}) error {
+	res, err := d.Do(d.sysInfoBatch(NewBatch().Add(module, method, args)))
+	if err != nil {
+		return err
+	}
+	if _, err = res.Result(module, method); err != nil {
+		return err
+	}
+	sysInfo, err := d.sysInfoResult(res)
 	if err != nil {
+		return err
+	}
+	d.applySysInfo(sysInfo)
+	return nil
+}
+
+func (d *TpLinkDevice) CloudInfo() (*CloudInfo, error) {
+	return getCloudInfo(d.passthroughRequest, d.cloudModule())
+}
+
+func (d *TpLinkDevice) BindCloud(username string, password string) error {
+	return bindCloud(d.passthroughRequest, d.cloudModule(), username, password)
+}
+
+func (d *TpLinkDevice) UnbindCloud() error {
+	return unbindCloud(d.passthroughRequest, d.cloudModule())
+}
+
+func (d *TpLinkDevice) SetCloudServer(server string) error {
+	return setCloudServer(d.passthroughRequest, d.cloudModule(), server)
+}
+
+func (d *TpLinkDevice) DayStats(year int, month int) ([]*DayStat, error) {
+	if err := requireCapability(d, CapabilitySchedule); err != nil {
+		return nil, err
+	}
+	return getDayStats(d.passthroughRequest, scheduleModuleFor(d.Type()), year, month)
+}
+
+func (d *TpLinkDevice) MonthStats(year int) ([]*MonthStat, error) {
+	if err := requireCapability(d, CapabilitySchedule); err != nil {
 		return nil, err
 	}
-	response := &sysInfoResponse{}
-	transcode(sysInfo, &response)
-	return response.System.SysInfo, nil
+	return getMonthStats(d.passthroughRequest, scheduleModuleFor(d.Type()), year)
+}
+
+func (d *TpLinkDevice) cloudModule() string {
+	return cloudModuleFor(d.Type())
 }
 
 func (d *TpLinkDevice) SetPreferredState(idx int) error {
-	if idx < 0 || idx >= len(d.preferredStates) {
+	if err := requireCapability(d, CapabilityDimmable); err != nil {
+		return err
+	}
+	states := d.PreferredStates()
+	if idx < 0 || idx >= len(states) {
 		return fmt.Errorf("invalid preferred state index %d", idx)
 	}
-	state := d.preferredStates[idx]
-	_, err := d.passthroughRequest(map[string]interface{}{
-		"smartlife.iot.smartbulb.lightingservice": map[string]interface{}{
-			"transition_light_state": map[string]interface{}{
-				"brightness": state.Brightness,
-				"on_off":     1,
-			},
-		},
-	})
-	if err != nil {
+	state := states[idx]
+	light := map[string]interface{}{
+		"brightness": state.Brightness,
+		"on_off":     1,
+	}
+	caps := d.Capabilities()
+	if caps.Color && state.ColorTemp == 0 {
+		light["hue"] = state.Hue
+		light["saturation"] = state.Saturation
+		light["color_temp"] = 0
+	} else if caps.ColorTemp != nil && state.ColorTemp != 0 {
+		light["color_temp"] = state.ColorTemp
+	}
+	return d.transition(light)
+}
+
+// SavePreferredState overwrites the preset slot idx with the current light
+// state (or the state the bulb comes back with when it is off).
+func (d *TpLinkDevice) SavePreferredState(idx int) error {
+	if err := requireCapability(d, CapabilityDimmable); err != nil {
 		return err
 	}
-	return d.syncState()
+	if idx < 0 || idx >= len(d.PreferredStates()) {
+		return fmt.Errorf("invalid preferred state index %d", idx)
+	}
+	sysInfo := d.LastSysInfo()
+	if sysInfo == nil || sysInfo.LightState == nil {
+		return errors.New("current light state is unknown")
+	}
+	current := sysInfo.LightState.defaultOnState
+	if sysInfo.LightState.OnOff == 0 && sysInfo.LightState.DftOnState != nil {
+		current = *sysInfo.LightState.DftOnState
+	}
+	return d.changeState(lightingService, "set_preferred_state", map[string]interface{}{
+		"index":      idx,
+		"brightness": current.Brightness,
+		"hue":        current.Hue,
+		"saturation": current.Saturation,
+		"color_temp": current.ColorTemp,
+	})
+}
+
+func (d *TpLinkDevice) passthroughRequest(command interface{}) (map[string]interface{}, error) {
+	return d.passthroughContext(context.Background(), command)
 }
 
-func (d *TpLinkDevice) passthroughRequest(command map[string]interface{}) (map[string]interface{}, error) {
+// passthroughContext sends command through the cloud. The token is the
+// one the session holds now, an expired one is renewed and the command
+// sent once more.
+func (d *TpLinkDevice) passthroughContext(ctx context.Context, command interface{}) (map[string]interface{}, error) {
+	token := d.link.Token()
+	data, err := d.passthroughToken(ctx, command, token)
+	if isTokenExpired(err) && d.link.renewToken(token) == nil {
+		data, err = d.passthroughToken(ctx, command, d.link.Token())
+	}
+	return data, err
+}
+
+func (d *TpLinkDevice) passthroughToken(ctx context.Context, command interface{}, token string) (map[string]interface{}, error) {
 	cmdJson, _ := json.Marshal(command)
 	requestBody, _ := json.Marshal(map[string]interface{}{
 		"method": "passthrough",
@@ -212,8 +418,7 @@ func (d *TpLinkDevice) passthroughRequest(command map[string]interface{}) (map[s
 			"requestData": string(cmdJson),
 		},
 	})
-	client := &http.Client{}
-	request, err := http.NewRequest("POST", d.AppServerUrl(), bytes.NewBuffer(requestBody))
+	request, err := http.NewRequestWithContext(ctx, "POST", d.AppServerUrl(), bytes.NewBuffer(requestBody))
 	if err != nil {
 		return nil, err
 	}
@@ -222,8 +427,17 @@ func (d *TpLinkDevice) passthroughRequest(command map[string]interface{}) (map[s
 		"User-Agent":    []string{"Dalvik/2.1.0 (Linux; U; Android 6.0.1; A0001 Build/M4B30X)"},
 		"Content-Type":  []string{"application/json"},
 	}
-	request.URL.RawQuery = d.params.Encode()
-	response, err := client.Do(request)
+	params := url.Values{
+		"appName": {"Kasa_Android"},
+		"termID":  {d.link.TermId()},
+		"appVer":  {"1.4.4.607"},
+		"ospf":    {"Android+6.0.1"},
+		"netType": {"wifi"},
+		"locale":  {"es_ES"},
+		"token":   {token},
+	}
+	request.URL.RawQuery = params.Encode()
+	response, err := d.client.Do(request)
 	if err != nil {
 		return nil, err
 	}
@@ -239,40 +453,67 @@ func (d *TpLinkDevice) passthroughRequest(command map[string]interface{}) (map[s
 	}
 
 	if res.ErrorCode != 0 {
-		return nil, errors.New(res.Message)
+		return nil, &CloudError{res.ErrorCode, res.Message}
 	}
 
-	responseData := res.Result.(map[string]interface{})["responseData"]
-	if responseData != "" {
+	result, ok := res.Result.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("passthrough returned no result")
+	}
+	if responseData, ok := result["responseData"].(string); ok && responseData != "" {
 		var data map[string]interface{}
-		err = json.Unmarshal([]byte(responseData.(string)), &data)
+		err = json.Unmarshal([]byte(responseData), &data)
 		if err != nil {
 			return nil, err
 		}
 		return data, nil
 	}
-	return res.Result.(map[string]interface{}), nil
+	return result, nil
 }
 
-func (d *TpLinkDevice) syncState() error {
+// Sync reads the device state again. A failed sync keeps the last state
+// and is reported by SyncError until the device answers.
+func (d *TpLinkDevice) Sync() error {
 	sysInfo, err := d.SystemInfo()
 	if err != nil {
+		d.mu.Lock()
+		d.syncErr = err
+		d.mu.Unlock()
 		return err
 	}
+	d.applySysInfo(sysInfo)
+	return nil
+}
+
+func (d *TpLinkDevice) SyncError() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.syncErr
+}
+
+func (d *TpLinkDevice) applySysInfo(sysInfo *SysInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	devInfo := &TPLinkDeviceInfo{
 		FwVer:        d.device.FwVer,
 		Alias:        sysInfo.Alias,
-		Status:       sysInfo.LightState.OnOff,
+		Status:       sysInfo.RelayState,
 		Role:         d.device.Role,
 		DeviceId:     sysInfo.DeviceId,
-		DeviceMac:    sysInfo.MicMac,
+		DeviceMac:    sysInfo.MacAddress(),
 		DeviceName:   sysInfo.Description,
-		DeviceType:   sysInfo.MicType,
+		DeviceType:   sysInfo.DeviceType(),
 		DeviceModel:  sysInfo.Model,
 		AppServerUrl: d.device.AppServerUrl,
 	}
+	d.brightness = sysInfo.Brightness
+	if sysInfo.LightState != nil {
+		devInfo.Status = sysInfo.LightState.OnOff
+		d.brightness = sysInfo.LightState.Brightness
+	}
 	d.device = devInfo
-	d.brightness = sysInfo.LightState.Brightness
 	d.preferredStates = sysInfo.PreferredState
-	return nil
+	d.sysInfo = sysInfo
+	d.caps = CapabilitiesFromSysInfo(sysInfo)
+	d.syncErr = nil
 }
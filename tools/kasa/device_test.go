@@ -0,0 +1,129 @@
+package kasa_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+// login starts a simulated cloud with the devices and logs in to it.
+func login(t *testing.T, devices ...kasatest.Device) (*kasatest.Cloud, kasa.TPLink) {
+	t.Helper()
+	cloud := kasatest.NewCloud("user@example.org", "secret", devices...)
+	srv := cloud.Start()
+	t.Cleanup(srv.Close)
+	link, err := kasa.TpLinkLoginWithOptions("user@example.org", "secret", &kasa.LoginOptions{BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cloud, link
+}
+
+func TestLoginWithWrongPassword(t *testing.T) {
+	cloud := kasatest.NewCloud("user@example.org", "secret")
+	srv := cloud.Start()
+	defer srv.Close()
+	_, err := kasa.TpLinkLoginWithOptions("user@example.org", "wrong", &kasa.LoginOptions{BaseURL: srv.URL})
+	var loginErr *kasa.LoginError
+	if !errors.As(err, &loginErr) || loginErr.ErrorCode != kasatest.ErrorCodeWrongPassword {
+		t.Fatalf("login with a wrong password: %v", err)
+	}
+}
+
+func TestDeviceList(t *testing.T) {
+	_, link := login(t,
+		kasatest.NewBulb("bulb-1", "Lamp", "KL130"),
+		kasatest.NewPlug("plug-1", "Fan", "HS110"),
+		kasatest.NewStrip("strip-1", "Desk", "HS300", 2),
+	)
+	want := map[string]string{"bulb-1": "Lamp", "plug-1": "Fan", "strip-1": "Desk"}
+	devices := link.DeviceList()
+	if len(devices) != len(want) {
+		t.Fatalf("got %d devices, want %d", len(devices), len(want))
+	}
+	for _, device := range devices {
+		if device.Alias() != want[device.Id()] {
+			t.Errorf("device %s is %q, want %q", device.Id(), device.Alias(), want[device.Id()])
+		}
+	}
+	if device, _ := link.FindDevice("Lamp"); device == nil || !device.Capabilities().Dimmable {
+		t.Error("the bulb is missing or not dimmable")
+	}
+	if device, _ := link.FindDevice("Fan"); device == nil || !device.Capabilities().Emeter {
+		t.Error("the HS110 is missing or has no energy meter")
+	}
+}
+
+func TestTurnOnAndOff(t *testing.T) {
+	plug := kasatest.NewPlug("plug-1", "Fan", "HS100")
+	_, link := login(t, plug)
+	device := link.DeviceList()[0]
+
+	if err := device.TurnOn(); err != nil {
+		t.Fatal(err)
+	}
+	if !plug.IsOn() || !device.IsConnected() {
+		t.Error("the plug did not turn on")
+	}
+	if err := device.TurnOff(); err != nil {
+		t.Fatal(err)
+	}
+	if plug.IsOn() || !device.IsDisconnected() {
+		t.Error("the plug did not turn off")
+	}
+}
+
+func TestBrightnessAndPreset(t *testing.T) {
+	bulb := kasatest.NewBulb("bulb-1", "Lamp", "KL130")
+	_, link := login(t, bulb)
+	device := link.DeviceList()[0]
+
+	if err := device.SetBrightness(40); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !bulb.IsOn() || device.Brightness() != 40 {
+		t.Errorf("brightness %d, want 40", device.Brightness())
+	}
+
+	states := device.PreferredStates()
+	if len(states) != 4 {
+		t.Fatalf("got %d presets, want 4", len(states))
+	}
+	if err := device.SetPreferredState(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if device.Brightness() != states[2].Brightness {
+		t.Errorf("brightness %d after the preset, want %d", device.Brightness(), states[2].Brightness)
+	}
+
+	plug := kasatest.NewPlug("plug-1", "Fan", "HS100")
+	_, link = login(t, plug)
+	var capErr *kasa.CapabilityError
+	if err := link.DeviceList()[0].SetBrightness(50); !errors.As(err, &capErr) {
+		t.Errorf("dimming a plug: %v", err)
+	}
+}
+
+func TestSyncSeesOutsideChanges(t *testing.T) {
+	plug := kasatest.NewPlug("plug-1", "Fan", "HS100")
+	_, link := login(t, plug)
+	device := link.DeviceList()[0]
+	if device.IsConnected() {
+		t.Fatal("the plug starts on")
+	}
+	plug.SetOn(true)
+	if err := device.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !device.IsConnected() {
+		t.Error("the sync missed the plug turning on")
+	}
+}
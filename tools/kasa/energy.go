@@ -0,0 +1,87 @@
+package kasa
+
+import (
+	"context"
+	"encoding/json"
+)
+
+const (
+	emeterModuleIOT  = "emeter"
+	emeterModuleBulb = "smartlife.iot.common.emeter"
+)
+
+// EnergyReading is what the energy meter of a device reports. Total is
+// the energy counted since the meter was reset on Kasa devices, and over
+// the current month on Tapo devices, which do not keep a lifetime total.
+type EnergyReading struct {
+	Power float64 `json:"power_w"`
+	Total float64 `json:"total_kwh"`
+}
+
+// Older Kasa firmware reports watts and kWh, newer firmware mW and Wh.
+type iotRealtime struct {
+	Power   *float64 `json:"power"`
+	PowerMw *float64 `json:"power_mw"`
+	Total   *float64 `json:"total"`
+	TotalWh *float64 `json:"total_wh"`
+}
+
+type tapoEnergyUsage struct {
+	CurrentPower float64 `json:"current_power"`
+	MonthEnergy  float64 `json:"month_energy"`
+}
+
+func emeterModuleFor(deviceType string) string {
+	if isBulbType(deviceType) {
+		return emeterModuleBulb
+	}
+	return emeterModuleIOT
+}
+
+// ReadEnergy asks the energy meter of device for its current reading.
+func ReadEnergy(ctx context.Context, device Device) (*EnergyReading, error) {
+	if !device.Capabilities().Emeter {
+		return nil, &CapabilityError{device.Alias(), CapabilityEmeter}
+	}
+	if IsTapoType(device.Type()) {
+		raw, err := device.Raw(ctx, json.RawMessage(`{"method": "get_energy_usage"}`))
+		if err != nil {
+			return nil, err
+		}
+		usage := &tapoEnergyUsage{}
+		if err = json.Unmarshal(raw, usage); err != nil {
+			return nil, err
+		}
+		return &EnergyReading{Power: usage.CurrentPower / 1000, Total: usage.MonthEnergy / 1000}, nil
+	}
+	module := emeterModuleFor(device.Type())
+	request, _ := json.Marshal(map[string]interface{}{
+		module: map[string]interface{}{"get_realtime": map[string]interface{}{}},
+	})
+	raw, err := device.Raw(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{}
+	if err = json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	res, err := methodResult(data, module, "get_realtime")
+	if err != nil {
+		return nil, err
+	}
+	realtime := &iotRealtime{}
+	transcode(res, realtime)
+	reading := &EnergyReading{}
+	if realtime.PowerMw != nil {
+		reading.Power = *realtime.PowerMw / 1000
+	} else if realtime.Power != nil {
+		reading.Power = *realtime.Power
+	}
+	if realtime.TotalWh != nil {
+		reading.Total = *realtime.TotalWh / 1000
+	} else if realtime.Total != nil {
+		reading.Total = *realtime.Total
+	}
+	return reading, nil
+}
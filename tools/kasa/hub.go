@@ -0,0 +1,136 @@
+package kasa
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Kinds of Change.
+const (
+	ChangeState  = "state"
+	ChangeEnergy = "energy"
+)
+
+// Change is a new state or energy meter reading of a device. Energy is
+// only set on energy changes.
+type Change struct {
+	Type   string
+	Time   time.Time
+	Device Device
+	State  *DeviceState
+	Energy *EnergyReading
+}
+
+// Hub hands the changes of the registry devices to the front ends. The
+// poller and the front ends publish, the hub leaves out what did not
+// change and keeps the last state and reading of every device for new
+// subscribers and for front ends that read rather than listen.
+type Hub struct {
+	Registry *Registry
+
+	mu          sync.Mutex
+	subscribers map[chan *Change]bool
+	states      map[string]*DeviceState
+	energy      map[string]*EnergyReading
+}
+
+func NewHub(registry *Registry) *Hub {
+	return &Hub{
+		Registry:    registry,
+		subscribers: map[chan *Change]bool{},
+		states:      map[string]*DeviceState{},
+		energy:      map[string]*EnergyReading{},
+	}
+}
+
+// Publish sends the state of device if it differs from the last one
+// published.
+func (h *Hub) Publish(device Device) {
+	state := StateOf(device)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if state.Equal(h.states[state.Id]) {
+		return
+	}
+	h.states[state.Id] = state
+	h.send(&Change{Type: ChangeState, Time: time.Now(), Device: device, State: state})
+}
+
+// PublishEnergy sends the reading if it differs from the last one
+// published for device.
+func (h *Hub) PublishEnergy(device Device, reading *EnergyReading) {
+	if reading == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if last := h.energy[device.Id()]; last != nil && *last == *reading {
+		return
+	}
+	h.energy[device.Id()] = reading
+	h.send(&Change{Type: ChangeEnergy, Time: time.Now(), Device: device, State: h.stateLocked(device), Energy: reading})
+}
+
+// State returns the last published state of device, or its current one if
+// none was published yet.
+func (h *Hub) State(device Device) *DeviceState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stateLocked(device)
+}
+
+// Energy returns the last published reading of device, nil if there is
+// none.
+func (h *Hub) Energy(device Device) *EnergyReading {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.energy[device.Id()]
+}
+
+// Subscribe returns the changes that bring a new subscriber up to date,
+// the state and last reading of every registry device, and the channel of
+// the next ones. A subscriber that does not keep up with its buffer loses
+// changes rather than holding up the publishers.
+func (h *Hub) Subscribe(buffer int) ([]*Change, chan *Change) {
+	devices := h.Registry.Devices()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	replay := []*Change{}
+	for _, device := range devices {
+		state := h.stateLocked(device)
+		replay = append(replay, &Change{Type: ChangeState, Time: now, Device: device, State: state})
+		if reading := h.energy[device.Id()]; reading != nil {
+			replay = append(replay, &Change{Type: ChangeEnergy, Time: now, Device: device, State: state, Energy: reading})
+		}
+	}
+	ch := make(chan *Change, buffer)
+	h.subscribers[ch] = true
+	return replay, ch
+}
+
+func (h *Hub) Unsubscribe(ch chan *Change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, ch)
+}
+
+// stateLocked is State with h.mu held.
+func (h *Hub) stateLocked(device Device) *DeviceState {
+	if state := h.states[device.Id()]; state != nil {
+		return state
+	}
+	return StateOf(device)
+}
+
+// send hands the change to every subscriber, h.mu must be held.
+func (h *Hub) send(change *Change) {
+	for ch := range h.subscribers {
+		select {
+		case ch <- change:
+		default:
+			log.Printf("Subscriber is not keeping up, dropping %s change of %s\n", change.Type, change.State.Alias)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package kasa_test
+
+import (
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+func TestHubSendsOnlyChanges(t *testing.T) {
+	_, link := login(t, kasatest.NewPlug("plug-1", "Fan", "HS110"))
+	registry := kasa.NewRegistry()
+	registry.Set(link.DeviceList())
+	device := registry.Devices()[0]
+	hub := kasa.NewHub(registry)
+
+	replay, changes := hub.Subscribe(4)
+	defer hub.Unsubscribe(changes)
+	if len(replay) != 1 || replay[0].Type != kasa.ChangeState || replay[0].State.On {
+		t.Fatalf("replay %+v, want the plug off", replay)
+	}
+
+	hub.Publish(device)
+	if err := device.TurnOn(); err != nil {
+		t.Fatal(err)
+	}
+	hub.Publish(device)
+	hub.Publish(device)
+	reading := &kasa.EnergyReading{Power: 12.5, Total: 3}
+	hub.PublishEnergy(device, reading)
+	hub.PublishEnergy(device, &kasa.EnergyReading{Power: 12.5, Total: 3})
+
+	want := []string{kasa.ChangeState, kasa.ChangeState, kasa.ChangeEnergy}
+	for i, kind := range want {
+		select {
+		case change := <-changes:
+			if change.Type != kind {
+				t.Errorf("change %d is %s, want %s", i, change.Type, kind)
+			}
+		default:
+			t.Fatalf("got %d changes, want %d", i, len(want))
+		}
+	}
+	select {
+	case change := <-changes:
+		t.Errorf("unexpected %s change", change.Type)
+	default:
+	}
+	if state := hub.State(device); !state.On {
+		t.Error("the hub did not keep the published state")
+	}
+	if got := hub.Energy(device); got != reading {
+		t.Errorf("energy %+v, want %+v", got, reading)
+	}
+}
@@ -0,0 +1,209 @@
+package kasatest
+
+import (
+	"strings"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+const lightingService = "smartlife.iot.smartbulb.lightingservice"
+
+type lightState struct {
+	Brightness int    `json:"brightness"`
+	ColorTemp  int    `json:"color_temp"`
+	Hue        int    `json:"hue"`
+	Saturation int    `json:"saturation"`
+	Mode       string `json:"mode"`
+}
+
+// Bulb simulates a Kasa smart bulb (LB/KL series). The model decides
+// whether it has color and a variable color temperature.
+type Bulb struct {
+	*base
+	on       bool
+	light    lightState
+	color    bool
+	variable bool
+	presets  []lightState
+	softOn   map[string]interface{}
+	hardOn   map[string]interface{}
+}
+
+func NewBulb(id string, alias string, model string) *Bulb {
+	upper := strings.ToUpper(model)
+	b := &Bulb{
+		base:     newBase(id, alias, model, "IOT.SMARTBULB"),
+		light:    lightState{Brightness: 100, ColorTemp: 2700, Mode: kasa.ModeNormal},
+		color:    strings.Contains(upper, "130") || strings.HasPrefix(upper, "KL4"),
+		variable: !strings.Contains(upper, "110") && !strings.Contains(upper, "100"),
+		presets: []lightState{
+			{Brightness: 50, ColorTemp: 2700},
+			{Brightness: 100, ColorTemp: 4000},
+			{Brightness: 30, ColorTemp: 2700},
+			{Brightness: 80, ColorTemp: 6500},
+		},
+		softOn: map[string]interface{}{"mode": kasa.BehaviorLastStatus},
+		hardOn: map[string]interface{}{"mode": kasa.BehaviorLastStatus},
+	}
+	if !b.variable {
+		b.light.ColorTemp = 0
+		for i := range b.presets {
+			b.presets[i].ColorTemp = 0
+		}
+	}
+	b.registerCommon("smartlife.iot.common.cloud", "smartlife.iot.common.schedule")
+	b.register("system", "get_sysinfo", b.sysInfo)
+	b.register(lightingService, "get_light_state", b.getLightState)
+	b.register(lightingService, "transition_light_state", b.transition)
+	b.register(lightingService, "set_preferred_state", b.setPreferredState)
+	b.register(lightingService, "get_default_behavior", b.getDefaultBehavior)
+	b.register(lightingService, "set_default_behavior", b.setDefaultBehavior)
+	return b
+}
+
+func (b *Bulb) Info() *kasa.TPLinkDeviceInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.info(1)
+}
+
+func (b *Bulb) Handle(command map[string]interface{}) map[string]interface{} {
+	return b.handle(command)
+}
+
+// SetOn flips the bulb as if someone used the wall switch or the app.
+func (b *Bulb) SetOn(on bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.on = on
+}
+
+func (b *Bulb) IsOn() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.on
+}
+
+func (b *Bulb) SetBrightness(brightness int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.light.Brightness = brightness
+}
+
+func (b *Bulb) lightStateMap() map[string]interface{} {
+	state := map[string]interface{}{"on_off": boolInt(b.on)}
+	current := map[string]interface{}{
+		"mode":       b.light.Mode,
+		"hue":        b.light.Hue,
+		"saturation": b.light.Saturation,
+		"color_temp": b.light.ColorTemp,
+		"brightness": b.light.Brightness,
+	}
+	if b.on {
+		for k, v := range current {
+			state[k] = v
+		}
+	} else {
+		state["dft_on_state"] = current
+	}
+	return state
+}
+
+func (b *Bulb) sysInfo(args map[string]interface{}) map[string]interface{} {
+	presets := []map[string]interface{}{}
+	for i, p := range b.presets {
+		presets = append(presets, map[string]interface{}{
+			"index":      i,
+			"brightness": p.Brightness,
+			"hue":        p.Hue,
+			"saturation": p.Saturation,
+			"color_temp": p.ColorTemp,
+		})
+	}
+	return map[string]interface{}{
+		"sw_ver":                 "1.0.0 Build 200000 Rel.000000",
+		"hw_ver":                 "1.0",
+		"model":                  b.model + "(US)",
+		"description":            "Smart Wi-Fi LED Bulb",
+		"alias":                  b.alias,
+		"mic_type":               b.deviceType,
+		"dev_state":              "normal",
+		"mic_mac":                b.mac,
+		"deviceId":               b.id,
+		"oemId":                  "kasatest",
+		"hwId":                   "kasatest",
+		"is_factory":             false,
+		"disco_ver":              "1.0",
+		"ctrl_protocols":         map[string]interface{}{"name": "Linkie", "version": "1.0"},
+		"light_state":            b.lightStateMap(),
+		"is_dimmable":            1,
+		"is_color":               boolInt(b.color),
+		"is_variable_color_temp": boolInt(b.variable),
+		"preferred_state":        presets,
+		"rssi":                   -52,
+		"active_mode":            "none",
+		"heapsize":               290000,
+	}
+}
+
+func (b *Bulb) getLightState(args map[string]interface{}) map[string]interface{} {
+	return b.lightStateMap()
+}
+
+func (b *Bulb) transition(args map[string]interface{}) map[string]interface{} {
+	if hasArg(args, "on_off") {
+		b.on = intArg(args, "on_off") == 1
+	}
+	if hasArg(args, "brightness") {
+		b.light.Brightness = intArg(args, "brightness")
+	}
+	if b.color && hasArg(args, "hue") {
+		b.light.Hue = intArg(args, "hue")
+		b.light.Saturation = intArg(args, "saturation")
+	}
+	if b.variable && hasArg(args, "color_temp") {
+		b.light.ColorTemp = intArg(args, "color_temp")
+	}
+	if mode, ok := args["mode"].(string); ok {
+		if mode == kasa.ModeCircadian && !b.variable {
+			return map[string]interface{}{"err_code": -3, "err_msg": "invalid mode"}
+		}
+		b.light.Mode = mode
+	}
+	return b.lightStateMap()
+}
+
+func (b *Bulb) setPreferredState(args map[string]interface{}) map[string]interface{} {
+	idx := intArg(args, "index")
+	if idx < 0 || idx >= len(b.presets) {
+		return map[string]interface{}{"err_code": -10, "err_msg": "index out of range"}
+	}
+	b.presets[idx] = lightState{
+		Brightness: intArg(args, "brightness"),
+		Hue:        intArg(args, "hue"),
+		Saturation: intArg(args, "saturation"),
+		ColorTemp:  intArg(args, "color_temp"),
+	}
+	return map[string]interface{}{}
+}
+
+func (b *Bulb) getDefaultBehavior(args map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"soft_on": b.softOn, "hard_on": b.hardOn}
+}
+
+func (b *Bulb) setDefaultBehavior(args map[string]interface{}) map[string]interface{} {
+	if soft, ok := args["soft_on"].(map[string]interface{}); ok {
+		b.softOn = soft
+	}
+	if hard, ok := args["hard_on"].(map[string]interface{}); ok {
+		b.hardOn = hard
+	}
+	return map[string]interface{}{}
+}
+
+func boolInt(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,339 @@
+// Package kasatest simulates the TP-Link cloud and the devices behind it so
+// the kasa client and the tray can run without hardware or network.
+package kasatest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+// Error codes the cloud answers with.
+const (
+	ErrorCodeWrongPassword  = -20601
+	ErrorCodeUnknownMethod  = -20104
+	ErrorCodeUnknownDevice  = -20580
+	ErrorCodeInvalidRequest = -10100
+)
+
+// Cloud is an http.Handler speaking the wap.tplinkcloud.com JSON API
+// (login, getDeviceList, passthrough and the account methods) on top of
+// simulated devices.
+type Cloud struct {
+	Username string
+	Password string
+	// OnRequest, if set, is called with every method the cloud receives.
+	OnRequest func(method string, params map[string]interface{})
+	// AppServerURL is the regional host getAccountStatusAndUrl sends the
+	// account to, e.g. the server of another Cloud. Empty keeps the account
+	// on this cloud.
+	AppServerURL string
+
+	mu            sync.Mutex
+	devices       []Device
+	offline       map[string]bool
+	tokens        map[string]bool
+	refreshTokens map[string]bool
+	shares        map[string][]string
+	latency       time.Duration
+	mfaCode       string
+	serial        int
+}
+
+type cloudRequest struct {
+	Method string                 `json:"method"`
+	Params map[string]interface{} `json:"params"`
+}
+
+func NewCloud(username string, password string, devices ...Device) *Cloud {
+	return &Cloud{
+		Username:      username,
+		Password:      password,
+		devices:       devices,
+		offline:       map[string]bool{},
+		tokens:        map[string]bool{},
+		refreshTokens: map[string]bool{},
+		shares:        map[string][]string{},
+	}
+}
+
+// Start serves the cloud on a local httptest server. Point the client at
+// it with kasa.LoginOptions.BaseURL.
+func (c *Cloud) Start() *httptest.Server {
+	return httptest.NewServer(c)
+}
+
+func (c *Cloud) AddDevice(device Device) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.devices = append(c.devices, device)
+}
+
+func (c *Cloud) Devices() []Device {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Device{}, c.devices...)
+}
+
+func (c *Cloud) Device(id string) Device {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.device(id)
+}
+
+// SetOffline makes passthrough requests to the device fail the way they do
+// when it lost its connection to the cloud.
+func (c *Cloud) SetOffline(id string, offline bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offline[id] = offline
+}
+
+func (c *Cloud) IsOffline(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offline[id]
+}
+
+// ExpireTokens invalidates every session token handed out so far. Refresh
+// tokens stay valid.
+func (c *Cloud) ExpireTokens() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens = map[string]bool{}
+}
+
+// SetLatency delays every response.
+func (c *Cloud) SetLatency(latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latency = latency
+}
+
+// RequireMFA turns on two-step verification, logins then need code.
+func (c *Cloud) RequireMFA(code string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mfaCode = code
+}
+
+func (c *Cloud) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := &cloudRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeCloudError(w, ErrorCodeInvalidRequest, "invalid request")
+		return
+	}
+	if req.Params == nil {
+		req.Params = map[string]interface{}{}
+	}
+	if c.OnRequest != nil {
+		c.OnRequest(req.Method, req.Params)
+	}
+	c.mu.Lock()
+	latency := c.latency
+	c.mu.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	baseURL := "http://" + r.Host
+	token := r.URL.Query().Get("token")
+	switch req.Method {
+	case "login", "checkMFACodeAndLogin":
+		c.login(w, req)
+		return
+	case "refreshToken":
+		c.refresh(w, req)
+		return
+	case "getAccountStatusAndUrl":
+		appServerURL := baseURL
+		if c.AppServerURL != "" {
+			appServerURL = c.AppServerURL
+		}
+		writeCloudResult(w, map[string]interface{}{"appServerUrl": appServerURL, "status": 1})
+		return
+	}
+	if !c.validToken(token) {
+		writeCloudError(w, kasa.ErrorCodeTokenExpired, "Token expired")
+		return
+	}
+	switch req.Method {
+	case "getDeviceList":
+		c.deviceList(w, baseURL)
+	case "passthrough":
+		c.passthrough(w, req)
+	case "getAccountInfo":
+		writeCloudResult(w, map[string]interface{}{
+			"accountId": "kasatest",
+			"email":     c.Username,
+			"nickname":  "kasatest",
+		})
+	case "getShareUserList":
+		c.shareUserList(w, req)
+	case "shareDevice", "unshareDevice":
+		c.share(w, req)
+	case "getDeviceUsage":
+		id, _ := req.Params["deviceId"].(string)
+		writeCloudResult(w, map[string]interface{}{"deviceId": id, "usedCount": 0})
+	default:
+		writeCloudError(w, ErrorCodeUnknownMethod, fmt.Sprintf("method %s not supported", req.Method))
+	}
+}
+
+func (c *Cloud) login(w http.ResponseWriter, req *cloudRequest) {
+	username, _ := req.Params["cloudUserName"].(string)
+	password, _ := req.Params["cloudPassword"].(string)
+	if username != c.Username || password != c.Password {
+		writeCloudError(w, ErrorCodeWrongPassword, "Incorrect email or password")
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mfaCode != "" {
+		code, _ := req.Params["code"].(string)
+		if req.Method == "login" {
+			writeCloudError(w, kasa.ErrorCodeMFARequired, "MFA required")
+			return
+		}
+		if code != c.mfaCode {
+			writeCloudError(w, ErrorCodeWrongPassword, "Incorrect verification code")
+			return
+		}
+	}
+	result := map[string]interface{}{
+		"accountId": "kasatest",
+		"email":     c.Username,
+		"token":     c.newToken(),
+	}
+	if needed, _ := req.Params["refreshTokenNeeded"].(bool); needed {
+		result["refreshToken"] = c.newRefreshToken()
+	}
+	writeCloudResult(w, result)
+}
+
+func (c *Cloud) refresh(w http.ResponseWriter, req *cloudRequest) {
+	refreshToken, _ := req.Params["refreshToken"].(string)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.refreshTokens[refreshToken] {
+		writeCloudError(w, kasa.ErrorCodeTokenExpired, "Refresh token expired")
+		return
+	}
+	writeCloudResult(w, map[string]interface{}{"token": c.newToken()})
+}
+
+func (c *Cloud) deviceList(w http.ResponseWriter, baseURL string) {
+	list := []*kasa.TPLinkDeviceInfo{}
+	for _, device := range c.Devices() {
+		info := device.Info()
+		info.AppServerUrl = baseURL
+		c.mu.Lock()
+		if c.offline[device.ID()] {
+			info.Status = 0
+		}
+		c.mu.Unlock()
+		list = append(list, info)
+	}
+	writeCloudResult(w, map[string]interface{}{"deviceList": list})
+}
+
+func (c *Cloud) passthrough(w http.ResponseWriter, req *cloudRequest) {
+	id, _ := req.Params["deviceId"].(string)
+	requestData, _ := req.Params["requestData"].(string)
+	c.mu.Lock()
+	device := c.device(id)
+	offline := c.offline[id]
+	c.mu.Unlock()
+	if device == nil {
+		writeCloudError(w, ErrorCodeUnknownDevice, "Device not found")
+		return
+	}
+	if offline {
+		writeCloudError(w, kasa.ErrorCodeDeviceOffline, "Device is offline")
+		return
+	}
+	command := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(requestData), &command); err != nil {
+		writeCloudError(w, ErrorCodeInvalidRequest, "invalid requestData")
+		return
+	}
+	responseData, _ := json.Marshal(device.Handle(command))
+	writeCloudResult(w, map[string]interface{}{"responseData": string(responseData)})
+}
+
+func (c *Cloud) shareUserList(w http.ResponseWriter, req *cloudRequest) {
+	id, _ := req.Params["deviceId"].(string)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	users := []map[string]interface{}{}
+	for _, email := range c.shares[id] {
+		users = append(users, map[string]interface{}{"email": email})
+	}
+	writeCloudResult(w, map[string]interface{}{"shareUserList": users})
+}
+
+func (c *Cloud) share(w http.ResponseWriter, req *cloudRequest) {
+	id, _ := req.Params["deviceId"].(string)
+	email, _ := req.Params["email"].(string)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.device(id) == nil {
+		writeCloudError(w, ErrorCodeUnknownDevice, "Device not found")
+		return
+	}
+	users := []string{}
+	for _, user := range c.shares[id] {
+		if user != email {
+			users = append(users, user)
+		}
+	}
+	if req.Method == "shareDevice" {
+		users = append(users, email)
+	}
+	c.shares[id] = users
+	writeCloudResult(w, map[string]interface{}{})
+}
+
+func (c *Cloud) device(id string) Device {
+	for _, device := range c.devices {
+		if device.ID() == id {
+			return device
+		}
+	}
+	return nil
+}
+
+func (c *Cloud) validToken(token string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens[token]
+}
+
+func (c *Cloud) newToken() string {
+	c.serial++
+	token := fmt.Sprintf("kasatest-token-%d", c.serial)
+	c.tokens[token] = true
+	return token
+}
+
+func (c *Cloud) newRefreshToken() string {
+	c.serial++
+	token := fmt.Sprintf("kasatest-refresh-%d", c.serial)
+	c.refreshTokens[token] = true
+	return token
+}
+
+func writeCloudResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"error_code": 0, "result": result})
+}
+
+func writeCloudError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"error_code": code, "msg": msg})
+}
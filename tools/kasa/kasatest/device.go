@@ -0,0 +1,269 @@
+package kasatest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+// Device is a simulated device. Handle answers a smart home protocol
+// request ({"module": {"method": args}}) the way the real device would.
+type Device interface {
+	ID() string
+	Info() *kasa.TPLinkDeviceInfo
+	Handle(command map[string]interface{}) map[string]interface{}
+}
+
+// Switch is a simulated device whose power can be flipped from outside,
+// as if someone used the button on it.
+type Switch interface {
+	Device
+	SetOn(on bool)
+	IsOn() bool
+}
+
+type methodFunc func(args map[string]interface{}) map[string]interface{}
+
+// base holds the state every simulated device shares and dispatches the
+// modules a concrete model registers.
+type base struct {
+	mu          sync.Mutex
+	id          string
+	alias       string
+	model       string
+	mac         string
+	deviceType  string
+	role        kasa.Role
+	cloudUser   string
+	cloudServer string
+	runtime     map[string]int
+	aps         []*kasa.AccessPoint
+	modules     map[string]map[string]methodFunc
+}
+
+func newBase(id string, alias string, model string, deviceType string) *base {
+	b := &base{
+		id:          id,
+		alias:       alias,
+		model:       model,
+		mac:         macFor(id),
+		deviceType:  deviceType,
+		role:        kasa.RoleOwner,
+		cloudServer: "devs.tplinkcloud.com",
+		runtime:     map[string]int{},
+		aps:         []*kasa.AccessPoint{{SSID: "kasatest", KeyType: kasa.KeyTypeWPA2}},
+		modules:     map[string]map[string]methodFunc{},
+	}
+	return b
+}
+
+func macFor(id string) string {
+	sum := 0
+	for _, c := range id {
+		sum = sum*31 + int(c)
+	}
+	return fmt.Sprintf("50C7BF%06X", sum&0xFFFFFF)
+}
+
+func (b *base) register(module string, method string, fn methodFunc) {
+	if b.modules[module] == nil {
+		b.modules[module] = map[string]methodFunc{}
+	}
+	b.modules[module][method] = fn
+}
+
+func (b *base) registerCommon(cloudModule string, scheduleModule string) {
+	b.register(cloudModule, "get_info", b.cloudInfo)
+	b.register(cloudModule, "bind", b.bind)
+	b.register(cloudModule, "unbind", b.unbind)
+	b.register(cloudModule, "set_server_url", b.setServerURL)
+	b.register(scheduleModule, "get_daystat", b.dayStat)
+	b.register(scheduleModule, "get_monthstat", b.monthStat)
+	b.register("netif", "get_scaninfo", b.scanInfo)
+	b.register("netif", "set_stainfo", b.staInfo)
+}
+
+func (b *base) ID() string {
+	return b.id
+}
+
+// SetRole changes the role the cloud reports for the account, e.g.
+// kasa.RoleShared.
+func (b *base) SetRole(role kasa.Role) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.role = role
+}
+
+// SetRuntime records how many minutes the device was on during day.
+func (b *base) SetRuntime(day time.Time, minutes int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.runtime[day.Format("2006-01-02")] = minutes
+}
+
+func (b *base) info(status int) *kasa.TPLinkDeviceInfo {
+	return &kasa.TPLinkDeviceInfo{
+		FwVer:       "1.0.0 Build 200000 Rel.000000",
+		Alias:       b.alias,
+		Status:      status,
+		Role:        b.role,
+		DeviceId:    b.id,
+		DeviceMac:   b.mac,
+		DeviceName:  b.model,
+		DeviceType:  b.deviceType,
+		DeviceModel: b.model,
+	}
+}
+
+// handle runs every module/method of the command. The firmware runs them
+// in JSON order and clients put the queries last, but the order is lost
+// once the request is decoded into a map, so changes run before get_*
+// queries. Unknown modules and methods get the error codes the firmware
+// uses.
+func (b *base) handle(command map[string]interface{}) map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dispatch(command)
+}
+
+// dispatch is handle without the lock, for models that need to prepare
+// some state around the request.
+func (b *base) dispatch(command map[string]interface{}) map[string]interface{} {
+	response := map[string]interface{}{}
+	queries := [][2]string{}
+	for module, calls := range command {
+		methods, ok := b.modules[module]
+		if !ok {
+			response[module] = map[string]interface{}{"err_code": -1, "err_msg": "module not support"}
+			continue
+		}
+		response[module] = map[string]interface{}{}
+		callMap, _ := calls.(map[string]interface{})
+		for method := range callMap {
+			if _, ok := methods[method]; !ok {
+				response[module].(map[string]interface{})[method] = map[string]interface{}{"err_code": -2, "err_msg": "member not support"}
+				continue
+			}
+			if strings.HasPrefix(method, "get_") {
+				queries = append(queries, [2]string{module, method})
+				continue
+			}
+			b.call(command, response, module, method)
+		}
+	}
+	for _, query := range queries {
+		b.call(command, response, query[0], query[1])
+	}
+	return response
+}
+
+func (b *base) call(command map[string]interface{}, response map[string]interface{}, module string, method string) {
+	argMap, _ := command[module].(map[string]interface{})[method].(map[string]interface{})
+	if argMap == nil {
+		argMap = map[string]interface{}{}
+	}
+	result := b.modules[module][method](argMap)
+	if _, ok := result["err_code"]; !ok {
+		result["err_code"] = 0
+	}
+	response[module].(map[string]interface{})[method] = result
+}
+
+func (b *base) cloudInfo(args map[string]interface{}) map[string]interface{} {
+	binded := 0
+	if b.cloudUser != "" {
+		binded = 1
+	}
+	return map[string]interface{}{
+		"username":       b.cloudUser,
+		"server":         b.cloudServer,
+		"binded":         binded,
+		"cld_connection": binded,
+	}
+}
+
+func (b *base) bind(args map[string]interface{}) map[string]interface{} {
+	username, _ := args["username"].(string)
+	if username == "" {
+		return map[string]interface{}{"err_code": -8, "err_msg": "invalid argument"}
+	}
+	b.cloudUser = username
+	return map[string]interface{}{}
+}
+
+func (b *base) unbind(args map[string]interface{}) map[string]interface{} {
+	b.cloudUser = ""
+	return map[string]interface{}{}
+}
+
+func (b *base) setServerURL(args map[string]interface{}) map[string]interface{} {
+	server, _ := args["server"].(string)
+	b.cloudServer = server
+	return map[string]interface{}{}
+}
+
+func (b *base) dayStat(args map[string]interface{}) map[string]interface{} {
+	year, month := intArg(args, "year"), intArg(args, "month")
+	days := []map[string]interface{}{}
+	for day := 1; day <= 31; day++ {
+		date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+		if int(date.Month()) != month {
+			break
+		}
+		if minutes, ok := b.runtime[date.Format("2006-01-02")]; ok {
+			days = append(days, map[string]interface{}{"year": year, "month": month, "day": day, "time": minutes})
+		}
+	}
+	return map[string]interface{}{"day_list": days}
+}
+
+func (b *base) monthStat(args map[string]interface{}) map[string]interface{} {
+	year := intArg(args, "year")
+	totals := map[int]int{}
+	for key, minutes := range b.runtime {
+		date, _ := time.Parse("2006-01-02", key)
+		if date.Year() == year {
+			totals[int(date.Month())] += minutes
+		}
+	}
+	months := []map[string]interface{}{}
+	for month := 1; month <= 12; month++ {
+		if minutes, ok := totals[month]; ok {
+			months = append(months, map[string]interface{}{"year": year, "month": month, "time": minutes})
+		}
+	}
+	return map[string]interface{}{"month_list": months}
+}
+
+func (b *base) scanInfo(args map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"ap_list": b.aps}
+}
+
+func (b *base) staInfo(args map[string]interface{}) map[string]interface{} {
+	ssid, _ := args["ssid"].(string)
+	for _, ap := range b.aps {
+		if ap.SSID == ssid {
+			return map[string]interface{}{}
+		}
+	}
+	return map[string]interface{}{"err_code": -3, "err_msg": "ssid not found"}
+}
+
+func intArg(args map[string]interface{}, key string) int {
+	switch v := args[key].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+func hasArg(args map[string]interface{}, key string) bool {
+	_, ok := args[key]
+	return ok
+}
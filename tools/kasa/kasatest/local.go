@@ -0,0 +1,134 @@
+package kasatest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+)
+
+const initializationVector = 171
+
+// LocalServer answers the LAN protocol (TCP 9999 and UDP discovery) for a
+// simulated device, so kasa.LocalClient and kasa.DiscoverAddr can talk to
+// it.
+type LocalServer struct {
+	Device Device
+	// OnRequest, if set, is called with every command the server receives.
+	OnRequest func(device Device, command map[string]interface{})
+
+	listener net.Listener
+	packets  net.PacketConn
+	wg       sync.WaitGroup
+}
+
+// ServeLocal listens on addr for both TCP and UDP. Use port 0 to pick a
+// free port, Addr tells which one was taken.
+func ServeLocal(device Device, addr string) (*LocalServer, error) {
+	listener, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	packets, err := net.ListenPacket("udp4", listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	s := &LocalServer{Device: device, listener: listener, packets: packets}
+	s.wg.Add(2)
+	go s.serveTCP()
+	go s.serveUDP()
+	return s, nil
+}
+
+func (s *LocalServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *LocalServer) Close() error {
+	s.listener.Close()
+	s.packets.Close()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *LocalServer) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *LocalServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		response, ok := s.respond(body)
+		if !ok {
+			return
+		}
+		frame := make([]byte, 4, 4+len(response))
+		binary.BigEndian.PutUint32(frame, uint32(len(response)))
+		if _, err := conn.Write(append(frame, response...)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *LocalServer) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := s.packets.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if response, ok := s.respond(buf[:n]); ok {
+			s.packets.WriteTo(response, from)
+		}
+	}
+}
+
+func (s *LocalServer) respond(payload []byte) ([]byte, bool) {
+	command := map[string]interface{}{}
+	if err := json.Unmarshal(decryptPayload(payload), &command); err != nil {
+		return nil, false
+	}
+	if s.OnRequest != nil {
+		s.OnRequest(s.Device, command)
+	}
+	response, _ := json.Marshal(s.Device.Handle(command))
+	return encryptPayload(response), true
+}
+
+func encryptPayload(data []byte) []byte {
+	key := byte(initializationVector)
+	out := make([]byte, len(data))
+	for i, b := range data {
+		key = key ^ b
+		out[i] = key
+	}
+	return out
+}
+
+func decryptPayload(data []byte) []byte {
+	key := byte(initializationVector)
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = key ^ b
+		key = b
+	}
+	return out
+}
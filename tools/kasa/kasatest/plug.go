@@ -0,0 +1,265 @@
+package kasatest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+// Plug simulates a single outlet smart plug (HS100/HS110/KP115). Models
+// with energy monitoring advertise it in their feature string.
+type Plug struct {
+	*base
+	on bool
+	// load is what the plugged in appliance draws while on, in watts.
+	load    float64
+	totalWh float64
+	metered time.Time
+}
+
+type outlet struct {
+	id    string
+	alias string
+	on    bool
+}
+
+// Strip simulates a power strip (HS300/KP303) whose outlets are exposed as
+// sysinfo children and switched with a child_ids context.
+type Strip struct {
+	*base
+	outlets []*outlet
+	scope   map[string]bool
+}
+
+func NewPlug(id string, alias string, model string) *Plug {
+	p := &Plug{base: newBase(id, alias, model, "IOT.SMARTPLUGSWITCH")}
+	p.registerCommon("cnCloud", "schedule")
+	p.register("system", "get_sysinfo", p.sysInfo)
+	p.register("system", "set_relay_state", p.setRelayState)
+	if hasEmeter(model) {
+		p.load = 60
+		p.metered = time.Now()
+		p.register("emeter", "get_realtime", p.realtime)
+	}
+	return p
+}
+
+func NewStrip(id string, alias string, model string, outlets int) *Strip {
+	s := &Strip{base: newBase(id, alias, model, "IOT.SMARTPLUGSWITCH")}
+	for i := 0; i < outlets; i++ {
+		s.outlets = append(s.outlets, &outlet{
+			id:    fmt.Sprintf("%s%02d", id, i),
+			alias: fmt.Sprintf("%s Outlet %d", alias, i+1),
+		})
+	}
+	s.registerCommon("cnCloud", "schedule")
+	s.register("system", "get_sysinfo", s.sysInfo)
+	s.register("system", "set_relay_state", s.setRelayState)
+	return s
+}
+
+func (p *Plug) Info() *kasa.TPLinkDeviceInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.info(1)
+}
+
+func (p *Plug) Handle(command map[string]interface{}) map[string]interface{} {
+	return p.handle(command)
+}
+
+func (p *Plug) SetOn(on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.meter()
+	p.on = on
+}
+
+// SetLoad changes what the plugged in appliance draws while on, in watts.
+func (p *Plug) SetLoad(watts float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.meter()
+	p.load = watts
+}
+
+func (p *Plug) IsOn() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.on
+}
+
+func (p *Plug) sysInfo(args map[string]interface{}) map[string]interface{} {
+	info := plugSysInfo(p.base)
+	info["relay_state"] = boolInt(p.on)
+	info["on_time"] = 0
+	return info
+}
+
+func (p *Plug) setRelayState(args map[string]interface{}) map[string]interface{} {
+	p.meter()
+	p.on = intArg(args, "state") == 1
+	return map[string]interface{}{}
+}
+
+// meter counts the energy used since the last call.
+func (p *Plug) meter() {
+	now := time.Now()
+	if p.on {
+		p.totalWh += p.load * now.Sub(p.metered).Hours()
+	}
+	p.metered = now
+}
+
+func (p *Plug) power() float64 {
+	if p.on {
+		return p.load
+	}
+	return 0
+}
+
+func (p *Plug) realtime(args map[string]interface{}) map[string]interface{} {
+	p.meter()
+	return map[string]interface{}{
+		"voltage_mv": 120000,
+		"current_ma": int(p.power() / 120 * 1000),
+		"power_mw":   int(p.power() * 1000),
+		"total_wh":   int(p.totalWh),
+	}
+}
+
+func (s *Strip) Info() *kasa.TPLinkDeviceInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info(1)
+}
+
+// Handle pulls the child_ids context out of the request before running it,
+// the way the strip firmware scopes relay changes to some outlets.
+func (s *Strip) Handle(command map[string]interface{}) map[string]interface{} {
+	scope := map[string]bool{}
+	calls := map[string]interface{}{}
+	for module, call := range command {
+		if module != "context" {
+			calls[module] = call
+			continue
+		}
+		context, _ := call.(map[string]interface{})
+		ids, _ := context["child_ids"].([]interface{})
+		for _, id := range ids {
+			if str, ok := id.(string); ok {
+				scope[str] = true
+			}
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scope = scope
+	defer func() { s.scope = nil }()
+	return s.dispatch(calls)
+}
+
+// SetOutlet switches a single outlet by index.
+func (s *Strip) SetOutlet(idx int, on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idx >= 0 && idx < len(s.outlets) {
+		s.outlets[idx].on = on
+	}
+}
+
+// SetOn switches every outlet.
+func (s *Strip) SetOn(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.outlets {
+		o.on = on
+	}
+}
+
+// IsOn reports whether any outlet is on, like the strip's relay_state.
+func (s *Strip) IsOn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.outlets {
+		if o.on {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Strip) sysInfo(args map[string]interface{}) map[string]interface{} {
+	info := plugSysInfo(s.base)
+	children := []map[string]interface{}{}
+	for _, o := range s.outlets {
+		children = append(children, map[string]interface{}{
+			"id":      o.id,
+			"alias":   o.alias,
+			"state":   boolInt(o.on),
+			"on_time": 0,
+		})
+	}
+	info["children"] = children
+	info["child_num"] = len(children)
+	on := 0
+	for _, o := range s.outlets {
+		if o.on {
+			on = 1
+		}
+	}
+	info["relay_state"] = on
+	return info
+}
+
+func (s *Strip) setRelayState(args map[string]interface{}) map[string]interface{} {
+	on := intArg(args, "state") == 1
+	for _, o := range s.outlets {
+		if len(s.scope) == 0 || s.scope[o.id] {
+			o.on = on
+		}
+	}
+	return map[string]interface{}{}
+}
+
+func plugSysInfo(b *base) map[string]interface{} {
+	feature := "TIM"
+	if hasEmeter(b.model) {
+		feature = "TIM:ENE"
+	}
+	return map[string]interface{}{
+		"sw_ver":      "1.0.0 Build 200000 Rel.000000",
+		"hw_ver":      "1.0",
+		"model":       b.model + "(US)",
+		"type":        b.deviceType,
+		"dev_name":    "Smart Wi-Fi Plug",
+		"alias":       b.alias,
+		"mac":         macWithColons(b.mac),
+		"deviceId":    b.id,
+		"oemId":       "kasatest",
+		"hwId":        "kasatest",
+		"feature":     feature,
+		"updating":    0,
+		"led_off":     0,
+		"rssi":        -48,
+		"active_mode": "none",
+		"latitude_i":  0,
+		"longitude_i": 0,
+	}
+}
+
+func hasEmeter(model string) bool {
+	return model == "HS110" || model == "KP115" || model == "HS300"
+}
+
+func macWithColons(mac string) string {
+	out := ""
+	for i := 0; i+1 < len(mac); i += 2 {
+		if i > 0 {
+			out += ":"
+		}
+		out += mac[i : i+2]
+	}
+	return out
+}
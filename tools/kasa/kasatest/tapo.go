@@ -0,0 +1,385 @@
+package kasatest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+// Error codes of the SMART protocol.
+const (
+	TapoErrorSessionExpired = 9999
+	TapoErrorUnknownMethod  = -1010
+	TapoErrorInvalidRequest = -1002
+	TapoErrorLoginFailed    = -1501
+)
+
+// Tapo simulates a Tapo plug or bulb. It shows up in the cloud device list,
+// but like the real devices only answers on the LAN, see ServeTapo.
+type Tapo struct {
+	*base
+	on         bool
+	brightness int
+}
+
+func NewTapoPlug(id string, alias string, model string) *Tapo {
+	return &Tapo{base: newBase(id, alias, model, "SMART.TAPOPLUG")}
+}
+
+func NewTapoBulb(id string, alias string, model string) *Tapo {
+	return &Tapo{base: newBase(id, alias, model, "SMART.TAPOBULB"), brightness: 100}
+}
+
+func (t *Tapo) Info() *kasa.TPLinkDeviceInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.info(1)
+}
+
+// Handle answers the cloud passthrough with the errors of unknown modules,
+// Tapo devices do not take IOT requests.
+func (t *Tapo) Handle(command map[string]interface{}) map[string]interface{} {
+	return t.handle(command)
+}
+
+func (t *Tapo) SetOn(on bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.on = on
+}
+
+func (t *Tapo) IsOn() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.on
+}
+
+func (t *Tapo) Brightness() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.brightness
+}
+
+func (t *Tapo) isBulb() bool {
+	return strings.Contains(t.deviceType, "BULB")
+}
+
+// Mac returns the MAC in the form the SMART protocol reports it.
+func (t *Tapo) Mac() string {
+	return macWithDashes(t.mac)
+}
+
+// call runs a method of the SMART protocol.
+func (t *Tapo) call(method string, params map[string]interface{}) (interface{}, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch method {
+	case "get_device_info":
+		info := map[string]interface{}{
+			"device_id": t.id,
+			"fw_ver":    "1.0.0 Build 200000 Rel.000000",
+			"hw_ver":    "1.0",
+			"type":      t.deviceType,
+			"model":     t.model,
+			"mac":       macWithDashes(t.mac),
+			"nickname":  base64.StdEncoding.EncodeToString([]byte(t.alias)),
+			"device_on": t.on,
+			"rssi":      -50,
+		}
+		if t.isBulb() {
+			info["brightness"] = t.brightness
+		}
+		return info, 0
+	case "set_device_info":
+		if on, ok := params["device_on"].(bool); ok {
+			t.on = on
+		}
+		if hasArg(params, "brightness") {
+			if !t.isBulb() {
+				return nil, TapoErrorInvalidRequest
+			}
+			t.brightness = intArg(params, "brightness")
+		}
+		return map[string]interface{}{}, 0
+	}
+	return nil, TapoErrorUnknownMethod
+}
+
+// TapoServer serves the /app endpoint of a simulated Tapo device, with
+// the securePassthrough handshake, and answers discovery probes on the
+// same port over UDP.
+type TapoServer struct {
+	Device   *Tapo
+	Username string
+	Password string
+
+	server  *http.Server
+	packets net.PacketConn
+	wg      sync.WaitGroup
+
+	mu       sync.Mutex
+	sessions map[string]*tapoSession
+}
+
+type tapoSession struct {
+	cipher cipher.Block
+	iv     []byte
+	token  string
+}
+
+// ServeTapo listens on addr for both TCP and UDP, port 0 picks a free
+// port. login_device only accepts the account username and password.
+func ServeTapo(device *Tapo, addr string, username string, password string) (*TapoServer, error) {
+	listener, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	packets, err := net.ListenPacket("udp4", listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	s := &TapoServer{
+		Device:   device,
+		Username: username,
+		Password: password,
+		packets:  packets,
+		sessions: map[string]*tapoSession{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/app", s.app)
+	s.server = &http.Server{Handler: mux}
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		s.server.Serve(listener)
+	}()
+	go s.serveDiscovery()
+	return s, nil
+}
+
+// Addr is the host and port to give kasa.NewTapoDevice.
+func (s *TapoServer) Addr() string {
+	return s.packets.LocalAddr().String()
+}
+
+func (s *TapoServer) Close() error {
+	s.server.Close()
+	s.packets.Close()
+	s.wg.Wait()
+	return nil
+}
+
+// ExpireSessions drops every session, the next request gets
+// TapoErrorSessionExpired as the firmware answers after a reboot.
+func (s *TapoServer) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = map[string]*tapoSession{}
+}
+
+func (s *TapoServer) app(w http.ResponseWriter, r *http.Request) {
+	req := &struct {
+		Method string                 `json:"method"`
+		Params map[string]interface{} `json:"params"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeTapo(w, TapoErrorInvalidRequest, nil)
+		return
+	}
+	switch req.Method {
+	case "handshake":
+		s.handshake(w, req.Params)
+	case "securePassthrough":
+		s.securePassthrough(w, r, req.Params)
+	default:
+		writeTapo(w, TapoErrorUnknownMethod, nil)
+	}
+}
+
+func (s *TapoServer) handshake(w http.ResponseWriter, params map[string]interface{}) {
+	keyPEM, _ := params["key"].(string)
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		writeTapo(w, TapoErrorInvalidRequest, nil)
+		return
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	publicKey, ok := parsed.(*rsa.PublicKey)
+	if err != nil || !ok {
+		writeTapo(w, TapoErrorInvalidRequest, nil)
+		return
+	}
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, sessionKey)
+	if err != nil {
+		writeTapo(w, TapoErrorInvalidRequest, nil)
+		return
+	}
+	aesBlock, _ := aes.NewCipher(sessionKey[:16])
+	id := randomHex(16)
+	s.mu.Lock()
+	s.sessions[id] = &tapoSession{cipher: aesBlock, iv: sessionKey[16:]}
+	s.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: "TP_SESSIONID", Value: id})
+	writeTapo(w, 0, map[string]interface{}{"key": base64.StdEncoding.EncodeToString(encrypted)})
+}
+
+func (s *TapoServer) securePassthrough(w http.ResponseWriter, r *http.Request, params map[string]interface{}) {
+	s.mu.Lock()
+	var session *tapoSession
+	if cookie, err := r.Cookie("TP_SESSIONID"); err == nil {
+		session = s.sessions[cookie.Value]
+	}
+	s.mu.Unlock()
+	if session == nil {
+		writeTapo(w, TapoErrorSessionExpired, nil)
+		return
+	}
+	request, _ := params["request"].(string)
+	encrypted, err := base64.StdEncoding.DecodeString(request)
+	if err != nil {
+		writeTapo(w, TapoErrorInvalidRequest, nil)
+		return
+	}
+	plain, err := session.decrypt(encrypted)
+	inner := &struct {
+		Method string                 `json:"method"`
+		Params map[string]interface{} `json:"params"`
+	}{}
+	if err != nil || json.Unmarshal(plain, inner) != nil {
+		writeTapo(w, TapoErrorInvalidRequest, nil)
+		return
+	}
+
+	s.mu.Lock()
+	token := session.token
+	s.mu.Unlock()
+	var result interface{}
+	code := 0
+	switch {
+	case inner.Method == "login_device":
+		result, code = s.login(session, inner.Params)
+	case token == "" || r.URL.Query().Get("token") != token:
+		code = TapoErrorLoginFailed
+	default:
+		result, code = s.Device.call(inner.Method, inner.Params)
+	}
+	response := map[string]interface{}{"error_code": code}
+	if result != nil {
+		response["result"] = result
+	}
+	data, _ := json.Marshal(response)
+	writeTapo(w, 0, map[string]interface{}{
+		"response": base64.StdEncoding.EncodeToString(session.encrypt(data)),
+	})
+}
+
+// login checks the credentials the way the firmware does: the username is
+// the SHA-1 of the account email, both are base64 encoded.
+func (s *TapoServer) login(session *tapoSession, params map[string]interface{}) (interface{}, int) {
+	digest := sha1.Sum([]byte(s.Username))
+	username := base64.StdEncoding.EncodeToString([]byte(hex.EncodeToString(digest[:])))
+	password := base64.StdEncoding.EncodeToString([]byte(s.Password))
+	if params["username"] != username || params["password"] != password {
+		return nil, TapoErrorLoginFailed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session.token = randomHex(16)
+	return map[string]interface{}{"token": session.token}, 0
+}
+
+// serveDiscovery answers the probes of kasa.DiscoverTapoAddr with the
+// address of the /app endpoint.
+func (s *TapoServer) serveDiscovery() {
+	defer s.wg.Done()
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := s.packets.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 || buf[0] != 2 || binary.BigEndian.Uint16(buf[2:]) != 1 {
+			continue
+		}
+		addr := s.packets.LocalAddr().(*net.UDPAddr)
+		s.Device.mu.Lock()
+		result := map[string]interface{}{
+			"device_id":    s.Device.id,
+			"device_type":  s.Device.deviceType,
+			"device_model": s.Device.model,
+			"ip":           addr.IP.String(),
+			"mac":          macWithDashes(s.Device.mac),
+			"mgt_encrypt_schm": map[string]interface{}{
+				"is_support_https": false,
+				"encrypt_type":     "AES",
+				"http_port":        addr.Port,
+			},
+		}
+		s.Device.mu.Unlock()
+		payload, _ := json.Marshal(map[string]interface{}{"error_code": 0, "result": result})
+		header := make([]byte, 16)
+		header[0] = 2
+		binary.BigEndian.PutUint16(header[2:], 2)
+		binary.BigEndian.PutUint16(header[4:], uint16(len(payload)))
+		s.packets.WriteTo(append(header, payload...), from)
+	}
+}
+
+func (s *tapoSession) encrypt(data []byte) []byte {
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	padded := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	out := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(s.cipher, s.iv).CryptBlocks(out, padded)
+	return out
+}
+
+func (s *tapoSession) decrypt(data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("request is not block aligned")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(s.cipher, s.iv).CryptBlocks(out, data)
+	padding := int(out[len(out)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("request has invalid padding")
+	}
+	return out[:len(out)-padding], nil
+}
+
+func writeTapo(w http.ResponseWriter, code int, result interface{}) {
+	response := map[string]interface{}{"error_code": code}
+	if result != nil {
+		response["result"] = result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func macWithDashes(mac string) string {
+	return strings.ReplaceAll(macWithColons(mac), ":", "-")
+}
@@ -0,0 +1,237 @@
+package kasa
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const LocalPort = 9999
+const DefaultBroadcast = "255.255.255.255"
+
+// The smart home protocol "encrypts" payloads with an autokey XOR cipher
+// seeded with this value.
+const initializationVector = 171
+
+// maxFrame bounds the length a reply may announce, the largest sysinfo is
+// a few KiB and the header comes from whoever answers on the port.
+const maxFrame = 64 << 10
+
+// LocalClient talks to a device on the LAN using the Kasa smart home
+// protocol (TCP port 9999, length prefixed, XOR autokey cipher).
+type LocalClient struct {
+	Host    string
+	Timeout time.Duration
+}
+
+type DiscoveredDevice struct {
+	Host    string
+	SysInfo *SysInfo
+}
+
+func NewLocalClient(host string) *LocalClient {
+	return &LocalClient{Host: host, Timeout: 5 * time.Second}
+}
+
+func (c *LocalClient) Address() string {
+	return withDefaultPort(c.Host, LocalPort)
+}
+
+func (c *LocalClient) Request(command interface{}) (map[string]interface{}, error) {
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", c.Address(), c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	encrypted := encryptPayload(payload)
+	frame := make([]byte, 4, 4+len(encrypted))
+	binary.BigEndian.PutUint32(frame, uint32(len(encrypted)))
+	if _, err = conn.Write(append(frame, encrypted...)); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > maxFrame {
+		return nil, fmt.Errorf("device announced a %d byte reply, more than %d", length, maxFrame)
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	err = json.Unmarshal(decryptPayload(body), &data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *LocalClient) Do(batch *Batch) (*BatchResult, error) {
+	return sendBatch(c.Request, batch)
+}
+
+func (c *LocalClient) SystemInfo() (*SysInfo, error) {
+	data, err := c.Request(map[string]interface{}{
+		"system": map[string]interface{}{
+			"get_sysinfo": map[string]interface{}{},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	response := &sysInfoResponse{}
+	transcode(data, &response)
+	if response.System == nil || response.System.SysInfo == nil {
+		return nil, errors.New("device returned no sysinfo")
+	}
+	return response.System.SysInfo, nil
+}
+
+func (c *LocalClient) CloudInfo() (*CloudInfo, error) {
+	module, err := c.cloudModule()
+	if err != nil {
+		return nil, err
+	}
+	return getCloudInfo(c.Request, module)
+}
+
+func (c *LocalClient) BindCloud(username string, password string) error {
+	module, err := c.cloudModule()
+	if err != nil {
+		return err
+	}
+	return bindCloud(c.Request, module, username, password)
+}
+
+func (c *LocalClient) UnbindCloud() error {
+	module, err := c.cloudModule()
+	if err != nil {
+		return err
+	}
+	return unbindCloud(c.Request, module)
+}
+
+func (c *LocalClient) SetCloudServer(server string) error {
+	module, err := c.cloudModule()
+	if err != nil {
+		return err
+	}
+	return setCloudServer(c.Request, module, server)
+}
+
+func (c *LocalClient) cloudModule() (string, error) {
+	sysInfo, err := c.SystemInfo()
+	if err != nil {
+		return "", err
+	}
+	return cloudModuleFor(sysInfo.DeviceType()), nil
+}
+
+// Discover broadcasts a sysinfo query on the local network and collects
+// every device that answers before the timeout.
+func Discover(timeout time.Duration) ([]*DiscoveredDevice, error) {
+	return DiscoverAddr(DefaultBroadcast, timeout)
+}
+
+func DiscoverAddr(addr string, timeout time.Duration) ([]*DiscoveredDevice, error) {
+	target, err := net.ResolveUDPAddr("udp4", withDefaultPort(addr, LocalPort))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query, _ := json.Marshal(map[string]interface{}{
+		"system": map[string]interface{}{
+			"get_sysinfo": map[string]interface{}{},
+		},
+	})
+	if _, err = conn.WriteToUDP(encryptPayload(query), target); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	found := map[string]*DiscoveredDevice{}
+	devices := []*DiscoveredDevice{}
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return devices, err
+		}
+		var data map[string]interface{}
+		if json.Unmarshal(decryptPayload(buf[:n]), &data) != nil {
+			continue
+		}
+		response := &sysInfoResponse{}
+		transcode(data, &response)
+		if response.System == nil || response.System.SysInfo == nil {
+			continue
+		}
+		host := from.String()
+		if from.Port == LocalPort {
+			host = from.IP.String()
+		}
+		if _, ok := found[host]; ok {
+			continue
+		}
+		dev := &DiscoveredDevice{Host: host, SysInfo: response.System.SysInfo}
+		found[host] = dev
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+func encryptPayload(data []byte) []byte {
+	key := byte(initializationVector)
+	out := make([]byte, len(data))
+	for i, b := range data {
+		key = key ^ b
+		out[i] = key
+	}
+	return out
+}
+
+func decryptPayload(data []byte) []byte {
+	key := byte(initializationVector)
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = key ^ b
+		key = b
+	}
+	return out
+}
+
+func withDefaultPort(host string, port int) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func normalizeMac(mac string) string {
+	return strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(mac))
+}
@@ -0,0 +1,63 @@
+package kasa
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Outcomes of a cloud request as reported to an Observer.
+const (
+	OutcomeOK           = "ok"
+	OutcomeCloudError   = "cloud_error"
+	OutcomeHTTPError    = "http_error"
+	OutcomeNetworkError = "network_error"
+)
+
+// Observer is an http.RoundTripper that passes cloud requests on and
+// reports the method ("login", "passthrough", ...), outcome and duration
+// of each one, e.g. for metrics.
+type Observer struct {
+	Next    http.RoundTripper
+	Observe func(method string, outcome string, elapsed time.Duration)
+}
+
+func NewObserver(next http.RoundTripper, observe func(method string, outcome string, elapsed time.Duration)) *Observer {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Observer{Next: next, Observe: observe}
+}
+
+func (o *Observer) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	method := requestMethod(reqBody)
+	start := time.Now()
+	res, err := o.Next.RoundTrip(req)
+	if err != nil {
+		o.Observe(method, OutcomeNetworkError, time.Since(start))
+		return nil, err
+	}
+	resBody, err := readBody(&res.Body)
+	elapsed := time.Since(start)
+	if err != nil {
+		o.Observe(method, OutcomeNetworkError, elapsed)
+		return nil, err
+	}
+	outcome := OutcomeOK
+	if res.StatusCode != http.StatusOK {
+		outcome = OutcomeHTTPError
+	} else {
+		answer := struct {
+			ErrorCode int `json:"error_code"`
+		}{}
+		if json.Unmarshal(resBody, &answer) != nil || answer.ErrorCode != 0 {
+			outcome = OutcomeCloudError
+		}
+	}
+	o.Observe(method, outcome, elapsed)
+	return res, nil
+}
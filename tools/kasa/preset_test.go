@@ -0,0 +1,63 @@
+package kasa_test
+
+import (
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+func TestSaveAndApplyPreset(t *testing.T) {
+	bulb := kasatest.NewBulb("bulb-1", "Lamp", "KL130")
+	_, link := login(t, bulb)
+	device := link.DeviceList()[0]
+
+	if err := kasa.SetHueSaturation(device, 120, 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.SetBrightness(25); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.SavePreferredState(3); err != nil {
+		t.Fatal(err)
+	}
+	saved := device.PreferredStates()[3]
+	if saved.Brightness != 25 || saved.Hue != 120 || saved.Saturation != 80 || saved.ColorTemp != 0 {
+		t.Fatalf("saved preset %+v", saved)
+	}
+	if saved.Summary() != "25% H120 S80%" {
+		t.Errorf("summary %q", saved.Summary())
+	}
+
+	if err := kasa.SetColorTemp(device, 4000); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.SetBrightness(90); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.SetPreferredState(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	color := kasa.ColorOf(device)
+	if !bulb.IsOn() || device.Brightness() != 25 || color.ColorTemp != 0 || color.Hue != 120 || color.Saturation != 80 {
+		t.Errorf("after applying the preset: brightness %d, color %+v", device.Brightness(), color)
+	}
+
+	// A white preset switches back from the hue.
+	if err := device.SetPreferredState(1); err != nil {
+		t.Fatal(err)
+	}
+	if color = kasa.ColorOf(device); device.Brightness() != 100 || color.ColorTemp != 4000 {
+		t.Errorf("after the white preset: brightness %d, color %+v", device.Brightness(), color)
+	}
+
+	if err := device.SetPreferredState(4); err == nil {
+		t.Error("applied a preset that does not exist")
+	}
+	if err := device.SavePreferredState(-1); err == nil {
+		t.Error("saved a preset that does not exist")
+	}
+}
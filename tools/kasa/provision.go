@@ -0,0 +1,166 @@
+package kasa
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// A factory-fresh (or reset) device opens its own access point and
+// answers the local protocol on this address.
+const DefaultSetupHost = "192.168.0.1"
+
+const (
+	KeyTypeNone = 0
+	KeyTypeWEP  = 1
+	KeyTypeWPA  = 2
+	KeyTypeWPA2 = 3
+)
+
+type AccessPoint struct {
+	SSID    string `json:"ssid"`
+	KeyType int    `json:"key_type"`
+}
+
+type scanInfo struct {
+	APList []*AccessPoint `json:"ap_list"`
+}
+
+type ProvisionRequest struct {
+	SetupHost     string
+	Broadcast     string
+	SSID          string
+	Password      string
+	KeyType       int
+	CloudUsername string
+	CloudPassword string
+	Timeout       time.Duration
+}
+
+// Provisioner drives a device that is still in AP mode.
+type Provisioner struct {
+	client *LocalClient
+}
+
+func NewProvisioner(host string) *Provisioner {
+	if host == "" {
+		host = DefaultSetupHost
+	}
+	return &Provisioner{client: NewLocalClient(host)}
+}
+
+func (p *Provisioner) SystemInfo() (*SysInfo, error) {
+	return p.client.SystemInfo()
+}
+
+func (p *Provisioner) ScanWifi() ([]*AccessPoint, error) {
+	data, err := p.client.Request(map[string]interface{}{
+		"netif": map[string]interface{}{
+			"get_scaninfo": map[string]interface{}{"refresh": 1},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, err := methodResult(data, "netif", "get_scaninfo")
+	if err != nil {
+		return nil, err
+	}
+	info := &scanInfo{}
+	transcode(res, &info)
+	return info.APList, nil
+}
+
+// JoinWifi hands the station credentials to the device. The device drops
+// its access point right after answering, so the connection is gone once
+// this returns.
+func (p *Provisioner) JoinWifi(ssid string, password string, keyType int) error {
+	data, err := p.client.Request(map[string]interface{}{
+		"netif": map[string]interface{}{
+			"set_stainfo": map[string]interface{}{
+				"ssid":     ssid,
+				"password": password,
+				"key_type": keyType,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = methodResult(data, "netif", "set_stainfo")
+	return err
+}
+
+func (p *Provisioner) BindCloud(username string, password string) error {
+	return p.client.BindCloud(username, password)
+}
+
+// WaitForDevice polls discovery until a device with the given MAC answers
+// or the timeout expires.
+func WaitForDevice(mac string, timeout time.Duration) (*DiscoveredDevice, error) {
+	return waitForDevice(DefaultBroadcast, mac, timeout)
+}
+
+func waitForDevice(broadcast string, mac string, timeout time.Duration) (*DiscoveredDevice, error) {
+	mac = normalizeMac(mac)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		devices, err := DiscoverAddr(broadcast, 2*time.Second)
+		if err != nil {
+			// The host is often still switching back from the device's
+			// access point, the network comes up in a moment.
+			log.Printf("Discovery failed, retrying: %s\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, dev := range devices {
+			if dev.SysInfo.MacAddress() == mac {
+				return dev, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("device %s did not show up on the network", mac)
+}
+
+// Provision runs the whole setup: remember the device MAC, send the Wi-Fi
+// credentials, wait for the device to join the network and optionally bind
+// it to the cloud account once it has internet access.
+func Provision(req *ProvisionRequest) (*DiscoveredDevice, error) {
+	if req.SSID == "" {
+		return nil, errors.New("no SSID given")
+	}
+	timeout := req.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Minute
+	}
+	p := NewProvisioner(req.SetupHost)
+	sysInfo, err := p.SystemInfo()
+	if err != nil {
+		return nil, err
+	}
+	keyType := req.KeyType
+	if keyType == KeyTypeNone && req.Password != "" {
+		keyType = KeyTypeWPA2
+	}
+	if err = p.JoinWifi(req.SSID, req.Password, keyType); err != nil {
+		return nil, err
+	}
+	broadcast := req.Broadcast
+	if broadcast == "" {
+		broadcast = DefaultBroadcast
+	}
+	dev, err := waitForDevice(broadcast, sysInfo.MacAddress(), timeout)
+	if err != nil {
+		return nil, err
+	}
+	if req.CloudUsername != "" {
+		client := NewLocalClient(dev.Host)
+		module := cloudModuleFor(dev.SysInfo.DeviceType())
+		err = bindCloud(client.Request, module, req.CloudUsername, req.CloudPassword)
+		if err != nil {
+			return dev, err
+		}
+	}
+	return dev, nil
+}
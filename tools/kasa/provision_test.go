@@ -0,0 +1,107 @@
+package kasa_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+func serveLocal(t *testing.T, device kasatest.Device) *kasatest.LocalServer {
+	t.Helper()
+	srv, err := kasatest.ServeLocal(device, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func TestProvision(t *testing.T) {
+	// The same simulated device answers in AP mode and, once it joined,
+	// the discovery on the network.
+	srv := serveLocal(t, kasatest.NewPlug("plug-1", "Fan", "HS100"))
+	dev, err := kasa.Provision(&kasa.ProvisionRequest{
+		SetupHost:     srv.Addr(),
+		Broadcast:     srv.Addr(),
+		SSID:          "kasatest",
+		Password:      "wifi-secret",
+		CloudUsername: "user@example.org",
+		CloudPassword: "secret",
+		Timeout:       10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.SysInfo.Alias != "Fan" {
+		t.Errorf("provisioned %+v, want the plug", dev.SysInfo)
+	}
+	info, err := kasa.NewLocalClient(dev.Host).CloudInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Username != "user@example.org" {
+		t.Errorf("device bound to %q", info.Username)
+	}
+}
+
+func TestProvisionUnknownNetwork(t *testing.T) {
+	srv := serveLocal(t, kasatest.NewPlug("plug-1", "Fan", "HS100"))
+	_, err := kasa.Provision(&kasa.ProvisionRequest{
+		SetupHost: srv.Addr(),
+		Broadcast: srv.Addr(),
+		SSID:      "elsewhere",
+		Timeout:   time.Second,
+	})
+	if err == nil {
+		t.Fatal("the device joined a network it cannot see")
+	}
+}
+
+func TestProvisionTimesOut(t *testing.T) {
+	srv := serveLocal(t, kasatest.NewPlug("plug-1", "Fan", "HS100"))
+	// Nothing answers the discovery on this port.
+	quiet, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer quiet.Close()
+	_, err = kasa.Provision(&kasa.ProvisionRequest{
+		SetupHost: srv.Addr(),
+		Broadcast: quiet.LocalAddr().String(),
+		SSID:      "kasatest",
+		Timeout:   time.Second,
+	})
+	if err == nil || !strings.Contains(err.Error(), "did not show up") {
+		t.Fatalf("waiting for a device that never joins: %v", err)
+	}
+}
+
+func TestLocalClientRejectsHugeFrame(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header := make([]byte, 4)
+		io.ReadFull(conn, header)
+		io.ReadFull(conn, make([]byte, binary.BigEndian.Uint32(header)))
+		binary.BigEndian.PutUint32(header, 0xFFFFFFFF)
+		conn.Write(header)
+	}()
+	_, err = kasa.NewLocalClient(listener.Addr().String()).SystemInfo()
+	if err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Fatalf("a 4 GiB reply: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package kasa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Raw sends a {"module": {"method": args}} request through the cloud
+// passthrough and returns the device response. The request is checked to
+// be a JSON object of modules, context cancels the round trip.
+func (d *TpLinkDevice) Raw(ctx context.Context, request json.RawMessage) (json.RawMessage, error) {
+	command, err := parseRawRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	for module, calls := range command {
+		if _, ok := calls.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("raw request: %s must be an object of methods", module)
+		}
+	}
+	data, err := d.passthroughContext(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(data)
+}
+
+func parseRawRequest(request json.RawMessage) (map[string]interface{}, error) {
+	command := map[string]interface{}{}
+	if err := json.Unmarshal(request, &command); err != nil {
+		return nil, fmt.Errorf("raw request is not a JSON object: %w", err)
+	}
+	if len(command) == 0 {
+		return nil, errors.New("raw request is empty")
+	}
+	return command, nil
+}
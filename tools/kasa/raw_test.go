@@ -0,0 +1,67 @@
+package kasa_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+func TestRawPassesRepliesThrough(t *testing.T) {
+	plug := kasatest.NewPlug("plug-1", "Fan", "HS110")
+	_, link := login(t, plug)
+	device := link.DeviceList()[0]
+
+	// The unknown module is answered with an error the reply must keep.
+	request := `{"system": {"get_sysinfo": {}}, "emeter": {"get_realtime": {}}, "smartlife.iot.dimmer": {"get_dimmer_parameters": {}}}`
+	reply, err := device.Raw(context.Background(), json.RawMessage(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := map[string]interface{}{}
+	json.Unmarshal([]byte(request), &command)
+	want, _ := json.Marshal(plug.Handle(command))
+	var got, wantValue interface{}
+	json.Unmarshal(reply, &got)
+	json.Unmarshal(want, &wantValue)
+	if !reflect.DeepEqual(got, wantValue) {
+		t.Errorf("raw reply %s, want the device answer %s", reply, want)
+	}
+
+	for _, bad := range []string{`[]`, `{}`, `{"system": "get_sysinfo"}`, `not json`} {
+		if _, err = device.Raw(context.Background(), json.RawMessage(bad)); err == nil {
+			t.Errorf("raw request %s was sent", bad)
+		}
+	}
+}
+
+func TestRawTapo(t *testing.T) {
+	tapo := kasatest.NewTapoPlug("tapo-1", "Heater", "P100")
+	srv := serveTapo(t, tapo)
+	device := kasa.NewTapoDevice(srv.Addr(), "user@example.org", "secret", nil)
+
+	reply, err := device.Raw(context.Background(), json.RawMessage(`{"method": "get_device_info"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := map[string]interface{}{}
+	if err = json.Unmarshal(reply, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info["device_id"] != "tapo-1" || info["mac"] != tapo.Mac() || info["rssi"] != -50.0 {
+		t.Errorf("raw reply %s", reply)
+	}
+
+	if _, err = device.Raw(context.Background(), json.RawMessage(`{"method": "set_device_info", "params": {"device_on": true}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if !tapo.IsOn() {
+		t.Error("the raw request did not turn the plug on")
+	}
+	if _, err = device.Raw(context.Background(), json.RawMessage(`{"params": {}}`)); err == nil {
+		t.Error("sent a Tapo request without a method")
+	}
+}
@@ -0,0 +1,350 @@
+package kasa
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exchange is one recorded cloud request and its response, with personal
+// data replaced by placeholders.
+type Exchange struct {
+	Method   string          `json:"method"`
+	Status   int             `json:"status"`
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response"`
+}
+
+// Recorder is an http.RoundTripper that passes cloud requests on and saves
+// every exchange as a numbered JSON file in Dir. Tokens, emails, device ids,
+// MACs and the like are redacted before anything is written, the same value
+// always gets the same placeholder so ids still line up between the device
+// list and passthrough calls.
+//
+// Dir is a new directory per recorder, so that every session is a trace of
+// its own that a Replayer can serve.
+type Recorder struct {
+	Dir  string
+	Next http.RoundTripper
+
+	mu       sync.Mutex
+	seq      int
+	redactor *redactor
+}
+
+func NewRecorder(next http.RoundTripper, dir string) (*Recorder, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	session, err := os.MkdirTemp(dir, time.Now().Format("20060102-150405-"))
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{Dir: session, Next: next, redactor: newRedactor()}, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resBody, err := readBody(&res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	exchange := &Exchange{
+		Method:   requestMethod(reqBody),
+		Status:   res.StatusCode,
+		Request:  r.redactor.redactJSON(reqBody),
+		Response: r.redactor.redactJSON(resBody),
+	}
+	r.seq++
+	name := fmt.Sprintf("%03d-%s.json", r.seq, exchange.Method)
+	data, _ := json.MarshalIndent(exchange, "", "  ")
+	if err := os.WriteFile(filepath.Join(r.Dir, name), data, 0o600); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Replayer is an http.RoundTripper that answers cloud requests from the
+// files a Recorder wrote, without touching the network. A request gets the
+// first unused exchange with the same body, else the first unused one of
+// the same method. Once they are used up the last one is served again.
+//
+// Requests are redacted like the Recorder did before they are compared.
+// The placeholders the served responses carry, e.g. the token, are kept
+// as they are when the client sends them back.
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges []*Exchange
+	used      []bool
+	redactor  *redactor
+}
+
+func NewReplayer(dir string) (*Replayer, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	r := &Replayer{redactor: newRedactor()}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		exchange := &Exchange{}
+		if err := json.Unmarshal(data, exchange); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		r.exchanges = append(r.exchanges, exchange)
+	}
+	if len(r.exchanges) == 0 {
+		return nil, fmt.Errorf("no recorded exchanges in %s", dir)
+	}
+	r.used = make([]bool, len(r.exchanges))
+	return r, nil
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	exchange := r.match(requestMethod(body), body)
+	if exchange == nil {
+		return nil, fmt.Errorf("no recorded exchange for %s", requestMethod(body))
+	}
+	status := exchange.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(exchange.Response)),
+		ContentLength: int64(len(exchange.Response)),
+		Request:       req,
+	}, nil
+}
+
+func (r *Replayer) match(method string, body []byte) *Exchange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	exchange := r.find(method, canonicalJSON(r.redactor.redactJSON(body)))
+	if exchange != nil {
+		r.redactor.adoptJSON(exchange.Response)
+	}
+	return exchange
+}
+
+func (r *Replayer) find(method string, want string) *Exchange {
+	sameMethod, last := -1, -1
+	for i, exchange := range r.exchanges {
+		if exchange.Method != method {
+			continue
+		}
+		last = i
+		if r.used[i] {
+			continue
+		}
+		if canonicalJSON(exchange.Request) == want {
+			r.used[i] = true
+			return exchange
+		}
+		if sameMethod < 0 {
+			sameMethod = i
+		}
+	}
+	if sameMethod >= 0 {
+		r.used[sameMethod] = true
+		return r.exchanges[sameMethod]
+	}
+	if last >= 0 {
+		return r.exchanges[last]
+	}
+	return nil
+}
+
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil {
+		return nil, nil
+	}
+	data, err := io.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		return nil, err
+	}
+	*body = io.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+func requestMethod(body []byte) string {
+	req := struct {
+		Method string `json:"method"`
+	}{}
+	json.Unmarshal(body, &req)
+	if req.Method == "" {
+		return "unknown"
+	}
+	return req.Method
+}
+
+func canonicalJSON(data []byte) string {
+	var v interface{}
+	if json.Unmarshal(data, &v) != nil {
+		return string(data)
+	}
+	out, _ := json.Marshal(v)
+	return string(out)
+}
+
+// redactedKeys name the fields that identify the account, its devices or
+// its home, mapped to the placeholder prefix they get.
+var redactedKeys = map[string]string{
+	"token":         "token",
+	"refreshToken":  "refresh-token",
+	"cloudUserName": "user@example.com",
+	"cloudPassword": "password",
+	"email":         "user@example.com",
+	"username":      "user@example.com",
+	"password":      "password",
+	"nickname":      "nickname",
+	"accountId":     "account",
+	"deviceId":      "device",
+	"id":            "device",
+	"child_ids":     "device",
+	"oemId":         "oem",
+	"hwId":          "hw",
+	"fwId":          "fw",
+	"terminalUUID":  "terminal",
+	"alias":         "alias",
+	"ssid":          "ssid",
+	"deviceMac":     "mac",
+	"mac":           "mac",
+	"mic_mac":       "mac",
+	"ethernet_mac":  "mac",
+	"latitude":      "",
+	"longitude":     "",
+	"latitude_i":    "",
+	"longitude_i":   "",
+}
+
+// redactor hands out stable placeholders for redacted values.
+type redactor struct {
+	seen     map[string]string
+	counts   map[string]int
+	adopting bool
+}
+
+func newRedactor() *redactor {
+	return &redactor{seen: map[string]string{}, counts: map[string]int{}}
+}
+
+func (r *redactor) redactJSON(data []byte) json.RawMessage {
+	var v interface{}
+	if json.Unmarshal(data, &v) != nil {
+		return json.RawMessage(`null`)
+	}
+	out, _ := json.Marshal(r.redact("", v))
+	return out
+}
+
+// adoptJSON registers the placeholders of an already redacted body as
+// their own placeholder, numbered as the Recorder numbered them.
+func (r *redactor) adoptJSON(data []byte) {
+	r.adopting = true
+	r.redactJSON(data)
+	r.adopting = false
+}
+
+func (r *redactor) redact(key string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		// sorted, so placeholders are numbered the same on every run
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := map[string]interface{}{}
+		for _, k := range keys {
+			out[k] = r.redact(k, v[k])
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, val := range v {
+			out[i] = r.redact(key, val)
+		}
+		return out
+	case string:
+		// passthrough wraps the device protocol in JSON strings
+		if key == "requestData" || key == "responseData" {
+			var inner interface{}
+			if json.Unmarshal([]byte(v), &inner) == nil {
+				out, _ := json.Marshal(r.redact("", inner))
+				return string(out)
+			}
+		}
+		if prefix, ok := redactedKeys[key]; ok && v != "" {
+			return r.placeholder(prefix, v)
+		}
+		return v
+	case float64:
+		if prefix, ok := redactedKeys[key]; ok && prefix == "" {
+			return 0
+		}
+		return v
+	}
+	return v
+}
+
+func (r *redactor) placeholder(prefix string, value string) string {
+	original := value
+	if prefix == "mac" {
+		value = normalizeMac(value)
+	}
+	if p, ok := r.seen[prefix+"\x00"+value]; ok {
+		return p
+	}
+	r.counts[prefix]++
+	n := r.counts[prefix]
+	var p string
+	switch {
+	case r.adopting:
+		p = original
+	case prefix == "mac":
+		p = fmt.Sprintf("02:00:00:00:%02X:%02X", n>>8&0xFF, n&0xFF)
+	case strings.Contains(prefix, "@"):
+		parts := strings.SplitN(prefix, "@", 2)
+		p = fmt.Sprintf("%s%d@%s", parts[0], n, parts[1])
+	default:
+		p = fmt.Sprintf("%s-%d", prefix, n)
+	}
+	r.seen[prefix+"\x00"+value] = p
+	return p
+}
@@ -0,0 +1,78 @@
+package kasa_test
+
+import (
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	cloud := kasatest.NewCloud("user@example.org", "secret", kasatest.NewBulb("bulb-1", "Desk Lamp", "KL130"))
+	srv := cloud.Start()
+	defer srv.Close()
+	dir := t.TempDir()
+
+	recorder, err := kasa.NewRecorder(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := kasa.TpLinkLoginWithOptions("user@example.org", "secret", &kasa.LoginOptions{
+		BaseURL:   srv.URL,
+		TermId:    "term",
+		Transport: recorder,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := link.DeviceList()
+	if len(devices) != 1 {
+		t.Fatalf("recorded %d devices, want 1", len(devices))
+	}
+	if err = devices[0].TurnOff(); err != nil {
+		t.Fatal(err)
+	}
+	if err = devices[0].SetBrightness(40); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := kasa.NewReplayer(recorder.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err = kasa.TpLinkLoginWithOptions("user@example.org", "secret", &kasa.LoginOptions{
+		BaseURL:   "http://replay.invalid",
+		TermId:    "term",
+		Transport: replayer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices = link.DeviceList()
+	if len(devices) != 1 {
+		t.Fatalf("replayed %d devices, want 1", len(devices))
+	}
+	// Out of the recorded order, only matching the bodies finds the
+	// brightness change.
+	if err = devices[0].SetBrightness(40); err != nil {
+		t.Fatal(err)
+	}
+	if !devices[0].IsConnected() || devices[0].Brightness() != 40 {
+		t.Errorf("replayed state on=%v brightness=%d, want on at 40", devices[0].IsConnected(), devices[0].Brightness())
+	}
+}
+
+func TestRecorderKeepsSessionsApart(t *testing.T) {
+	dir := t.TempDir()
+	first, err := kasa.NewRecorder(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := kasa.NewRecorder(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Dir == second.Dir {
+		t.Errorf("both recorders write to %s", first.Dir)
+	}
+}
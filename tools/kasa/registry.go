@@ -0,0 +1,47 @@
+package kasa
+
+import (
+	"strings"
+	"sync"
+)
+
+// Registry holds the devices of the logged in session so that the tray
+// and the local control servers work on the same Device values.
+type Registry struct {
+	mu      sync.RWMutex
+	devices []Device
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Set replaces the devices, e.g. after a new login.
+func (r *Registry) Set(devices []Device) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.devices = append([]Device{}, devices...)
+}
+
+func (r *Registry) Devices() []Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Device{}, r.devices...)
+}
+
+// Find looks a device up by id, or by alias ignoring case.
+func (r *Registry) Find(name string) Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, device := range r.devices {
+		if device.Id() == name {
+			return device
+		}
+	}
+	for _, device := range r.devices {
+		if strings.EqualFold(device.Alias(), name) {
+			return device
+		}
+	}
+	return nil
+}
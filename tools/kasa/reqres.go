@@ -1,18 +1,41 @@
 package kasa
 
+import (
+	"errors"
+	"fmt"
+)
+
 type Response struct {
 	ErrorCode int         `json:"error_code"`
 	Result    interface{} `json:"result"`
 	Message   string      `json:"msg"`
 }
 
+// Cloud error codes the client reacts to.
+const (
+	ErrorCodeTokenExpired = -20651
+	ErrorCodeMFARequired  = -20677
+	// ErrorCodeDeviceOffline answers a passthrough to a device that lost
+	// its connection to the cloud.
+	ErrorCodeDeviceOffline = -20571
+)
+
 type LoginResponse struct {
-	AccountId string `json:"accountId"`
-	RegTime   string `json:"regTime"`
-	Email     string `json:"email"`
-	Token     string `json:"token"`
+	AccountId    string `json:"accountId"`
+	RegTime      string `json:"regTime"`
+	Email        string `json:"email"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	AppServerUrl string `json:"appServerUrl"`
+}
+
+type AccountStatus struct {
+	AppServerUrl string `json:"appServerUrl"`
+	Status       int    `json:"status"`
 }
 
+// LoginError is a failed login, Err is the CloudError of the cloud or the
+// request failing.
 type LoginError struct {
 	ErrorCode int
 	Err       error
@@ -21,3 +44,55 @@ type LoginError struct {
 func (e *LoginError) Error() string {
 	return e.Err.Error()
 }
+
+func (e *LoginError) Unwrap() error {
+	return e.Err
+}
+
+// CloudError is a cloud request answered with a non-zero error_code.
+type CloudError struct {
+	ErrorCode int
+	Message   string
+}
+
+func (e *CloudError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s (%d)", e.Message, e.ErrorCode)
+	}
+	return fmt.Sprintf("cloud request failed with error code %d", e.ErrorCode)
+}
+
+// loginError marks a cloud error of a login request as a LoginError.
+func loginError(err error) error {
+	var cloudErr *CloudError
+	if errors.As(err, &cloudErr) {
+		return &LoginError{cloudErr.ErrorCode, err}
+	}
+	return err
+}
+
+// IsDeviceOffline reports whether err is the cloud saying the device is
+// not connected.
+func IsDeviceOffline(err error) bool {
+	var cloudErr *CloudError
+	return errors.As(err, &cloudErr) && cloudErr.ErrorCode == ErrorCodeDeviceOffline
+}
+
+func isTokenExpired(err error) bool {
+	var cloudErr *CloudError
+	return errors.As(err, &cloudErr) && cloudErr.ErrorCode == ErrorCodeTokenExpired
+}
+
+type ModuleError struct {
+	Module    string
+	Method    string
+	ErrorCode int
+	Message   string
+}
+
+func (e *ModuleError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s.%s: %s (%d)", e.Module, e.Method, e.Message, e.ErrorCode)
+	}
+	return fmt.Sprintf("%s.%s failed with error code %d", e.Module, e.Method, e.ErrorCode)
+}
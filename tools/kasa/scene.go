@@ -0,0 +1,44 @@
+package kasa
+
+import "fmt"
+
+// SceneAction is one step of a scene. On false turns the device off,
+// otherwise Brightness or Preset (numbered from 1 as in the menu) are
+// applied, and a bare On true just turns it on.
+type SceneAction struct {
+	Device     string `json:"device"`
+	On         *bool  `json:"on,omitempty"`
+	Brightness *int   `json:"brightness,omitempty"`
+	Preset     *int   `json:"preset,omitempty"`
+}
+
+type Scene []*SceneAction
+
+// ApplyScene runs every action of the scene against the devices of the
+// registry. The failures are returned by the device named in the action.
+func ApplyScene(registry *Registry, scene Scene) map[string]error {
+	errs := map[string]error{}
+	for _, action := range scene {
+		device := registry.Find(action.Device)
+		if device == nil {
+			errs[action.Device] = fmt.Errorf("no device %q", action.Device)
+			continue
+		}
+		if err := action.apply(device); err != nil {
+			errs[action.Device] = err
+		}
+	}
+	return errs
+}
+
+func (a *SceneAction) apply(device Device) error {
+	switch {
+	case a.On != nil && !*a.On:
+		return device.TurnOff()
+	case a.Brightness != nil:
+		return device.SetBrightness(*a.Brightness)
+	case a.Preset != nil:
+		return device.SetPreferredState(*a.Preset - 1)
+	}
+	return device.TurnOn()
+}
@@ -0,0 +1,47 @@
+package kasa
+
+// DeviceState is a snapshot of a device as the front ends report it. A
+// device that did not answer its last sync is offline and reports nothing
+// else.
+type DeviceState struct {
+	Id         string `json:"id"`
+	Alias      string `json:"alias"`
+	Model      string `json:"model"`
+	Type       string `json:"type"`
+	Online     bool   `json:"online"`
+	On         bool   `json:"on"`
+	Brightness *int   `json:"brightness,omitempty"`
+	Mode       string `json:"mode,omitempty"`
+	Shared     bool   `json:"shared,omitempty"`
+}
+
+func StateOf(device Device) *DeviceState {
+	state := &DeviceState{
+		Id:     device.Id(),
+		Alias:  device.Alias(),
+		Model:  device.Model(),
+		Type:   device.Type(),
+		Online: device.SyncError() == nil,
+		Shared: IsShared(device),
+	}
+	if state.Online {
+		state.On = device.IsConnected()
+		state.Mode = device.Mode()
+		if device.Capabilities().Dimmable {
+			brightness := device.Brightness()
+			state.Brightness = &brightness
+		}
+	}
+	return state
+}
+
+// Equal compares the parts of the state that change at runtime.
+func (s *DeviceState) Equal(other *DeviceState) bool {
+	if other == nil {
+		return false
+	}
+	sameBrightness := s.Brightness == nil && other.Brightness == nil ||
+		s.Brightness != nil && other.Brightness != nil && *s.Brightness == *other.Brightness
+	return s.Alias == other.Alias && s.Online == other.Online && s.On == other.On &&
+		sameBrightness && s.Mode == other.Mode
+}
@@ -0,0 +1,59 @@
+package kasa_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+func TestStateFollowsSync(t *testing.T) {
+	bulb := kasatest.NewBulb("bulb-1", "Lamp", "KL130")
+	bulb.SetOn(true)
+	bulb.SetBrightness(60)
+	cloud, link := login(t, bulb)
+	device := link.DeviceList()[0]
+	state := kasa.StateOf(device)
+	if !state.Online || state.Brightness == nil || *state.Brightness != 60 {
+		t.Fatalf("state %+v, want online at 60%%", state)
+	}
+
+	cloud.SetOffline("bulb-1", true)
+	if err := device.Sync(); !kasa.IsDeviceOffline(err) {
+		t.Fatalf("sync of an offline device: %v", err)
+	}
+	if state = kasa.StateOf(device); state.Online || state.Brightness != nil {
+		t.Errorf("state %+v after a failed sync, want offline", state)
+	}
+
+	cloud.SetOffline("bulb-1", false)
+	if err := device.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if state = kasa.StateOf(device); !state.Online {
+		t.Errorf("state %+v after the device came back, want online", state)
+	}
+}
+
+// TestConcurrentSync is meant for go test -race, the tray polls while the
+// front ends read the state.
+func TestConcurrentSync(t *testing.T) {
+	_, link := login(t, kasatest.NewBulb("bulb-1", "Lamp", "KL130"))
+	device := link.DeviceList()[0]
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			device.SetBrightness(10 + i)
+			device.Sync()
+		}(i)
+		go func() {
+			defer wg.Done()
+			kasa.StateOf(device)
+			device.HumanName()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,141 @@
+package kasa
+
+import (
+	"time"
+)
+
+const (
+	scheduleModuleIOT  = "schedule"
+	scheduleModuleBulb = "smartlife.iot.common.schedule"
+)
+
+// DayStat is the runtime of a device on a single day, Time is in minutes.
+type DayStat struct {
+	Year  int `json:"year"`
+	Month int `json:"month"`
+	Day   int `json:"day"`
+	Time  int `json:"time"`
+}
+
+// MonthStat is the runtime of a device over a month, Time is in minutes.
+type MonthStat struct {
+	Year  int `json:"year"`
+	Month int `json:"month"`
+	Time  int `json:"time"`
+}
+
+type dayStatList struct {
+	DayList []*DayStat `json:"day_list"`
+}
+
+type monthStatList struct {
+	MonthList []*MonthStat `json:"month_list"`
+}
+
+type RuntimeReport struct {
+	Device Device
+	Total  time.Duration
+	Days   []*DayStat
+	Err    error
+}
+
+func (s *DayStat) Duration() time.Duration {
+	return time.Duration(s.Time) * time.Minute
+}
+
+func (s *MonthStat) Duration() time.Duration {
+	return time.Duration(s.Time) * time.Minute
+}
+
+func scheduleModuleFor(deviceType string) string {
+	if isBulbType(deviceType) {
+		return scheduleModuleBulb
+	}
+	return scheduleModuleIOT
+}
+
+func getDayStats(send requestFunc, module string, year int, month int) ([]*DayStat, error) {
+	data, err := send(map[string]interface{}{
+		module: map[string]interface{}{
+			"get_daystat": map[string]interface{}{
+				"year":  year,
+				"month": month,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, err := methodResult(data, module, "get_daystat")
+	if err != nil {
+		return nil, err
+	}
+	stats := &dayStatList{}
+	transcode(res, &stats)
+	return stats.DayList, nil
+}
+
+func getMonthStats(send requestFunc, module string, year int) ([]*MonthStat, error) {
+	data, err := send(map[string]interface{}{
+		module: map[string]interface{}{
+			"get_monthstat": map[string]interface{}{
+				"year": year,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, err := methodResult(data, module, "get_monthstat")
+	if err != nil {
+		return nil, err
+	}
+	stats := &monthStatList{}
+	transcode(res, &stats)
+	return stats.MonthList, nil
+}
+
+// RuntimeOn returns how long the device was on during the given day.
+func RuntimeOn(device Device, day time.Time) (time.Duration, error) {
+	stats, err := device.DayStats(day.Year(), int(day.Month()))
+	if err != nil {
+		return 0, err
+	}
+	for _, stat := range stats {
+		if stat.Day == day.Day() {
+			return stat.Duration(), nil
+		}
+	}
+	return 0, nil
+}
+
+// AggregateRuntime sums the daily runtime of every device between from and
+// to (both days included). A device that fails to answer gets its error in
+// the report instead of failing the whole aggregation.
+func AggregateRuntime(devices []Device, from time.Time, to time.Time) []*RuntimeReport {
+	first := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	last := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	reports := []*RuntimeReport{}
+	for _, device := range devices {
+		report := &RuntimeReport{Device: device, Days: []*DayStat{}}
+		month := time.Date(first.Year(), first.Month(), 1, 0, 0, 0, 0, time.UTC)
+		for !month.After(last) {
+			stats, err := device.DayStats(month.Year(), int(month.Month()))
+			if err != nil {
+				report.Err = err
+				break
+			}
+			for _, stat := range stats {
+				day := time.Date(stat.Year, time.Month(stat.Month), stat.Day, 0, 0, 0, 0, time.UTC)
+				if day.Before(first) || day.After(last) {
+					continue
+				}
+				report.Days = append(report.Days, stat)
+				report.Total += stat.Duration()
+			}
+			month = month.AddDate(0, 1, 0)
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
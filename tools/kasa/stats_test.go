@@ -0,0 +1,84 @@
+package kasa_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestDayAndMonthStats(t *testing.T) {
+	// Bulbs keep their statistics in another module than plugs.
+	bulb := kasatest.NewBulb("bulb-1", "Lamp", "KL130")
+	plug := kasatest.NewPlug("plug-1", "Fan", "HS100")
+	for _, device := range []interface {
+		SetRuntime(day time.Time, minutes int)
+	}{bulb, plug} {
+		device.SetRuntime(day(2024, time.March, 3), 90)
+		device.SetRuntime(day(2024, time.March, 20), 30)
+		device.SetRuntime(day(2024, time.April, 1), 15)
+	}
+	_, link := login(t, bulb, plug)
+	for _, device := range link.DeviceList() {
+		days, err := device.DayStats(2024, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(days) != 2 || days[0].Day != 3 || days[0].Duration() != 90*time.Minute {
+			t.Errorf("%s: March days %+v", device.Alias(), days)
+		}
+		months, err := device.MonthStats(2024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(months) != 2 || months[0].Month != 3 || months[0].Time != 120 || months[1].Time != 15 {
+			t.Errorf("%s: months of 2024 %+v", device.Alias(), months)
+		}
+		runtime, err := kasa.RuntimeOn(device, day(2024, time.March, 20))
+		if err != nil || runtime != 30*time.Minute {
+			t.Errorf("%s: on for %s on March 20: %v", device.Alias(), runtime, err)
+		}
+		if runtime, _ = kasa.RuntimeOn(device, day(2024, time.March, 21)); runtime != 0 {
+			t.Errorf("%s: on for %s on a day without statistics", device.Alias(), runtime)
+		}
+	}
+}
+
+func TestAggregateRuntimeAcrossMonths(t *testing.T) {
+	plug := kasatest.NewPlug("plug-1", "Fan", "HS100")
+	plug.SetRuntime(day(2023, time.December, 30), 600)
+	plug.SetRuntime(day(2023, time.December, 31), 60)
+	plug.SetRuntime(day(2024, time.January, 1), 120)
+	plug.SetRuntime(day(2024, time.February, 1), 30)
+	plug.SetRuntime(day(2024, time.February, 2), 600)
+	bulb := kasatest.NewBulb("bulb-1", "Lamp", "KL130")
+	cloud, link := login(t, plug, bulb)
+	cloud.SetOffline("bulb-1", true)
+
+	devices := link.DeviceList()
+	reports := kasa.AggregateRuntime(devices, day(2023, time.December, 31), day(2024, time.February, 1).Add(12*time.Hour))
+	if len(reports) != 2 {
+		t.Fatalf("got %d reports, want one per device", len(reports))
+	}
+	for _, report := range reports {
+		switch report.Device.Id() {
+		case "plug-1":
+			if report.Err != nil {
+				t.Fatal(report.Err)
+			}
+			// December 31, January 1 and February 1, not the days around.
+			if len(report.Days) != 3 || report.Total != 210*time.Minute {
+				t.Errorf("plug runtime %s over %d days, want 3h30m over 3", report.Total, len(report.Days))
+			}
+		case "bulb-1":
+			if report.Err == nil {
+				t.Error("the offline bulb has no error in its report")
+			}
+		}
+	}
+}
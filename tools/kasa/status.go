@@ -1,5 +1,12 @@
 package kasa
 
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
 // For Device SysInfo
 type ctrlProtocol struct {
 	Name    string `json:"name"`
@@ -22,6 +29,21 @@ type PreferredState struct {
 type sysInfoLightState struct {
 	defaultOnState
 	OnOff int `json:"on_off"`
+	// DftOnState is the state the bulb turns on with, only sent while it
+	// is off.
+	DftOnState *defaultOnState `json:"dft_on_state"`
+}
+
+// Summary describes a preset as brightness and color, e.g. "80% 4000K".
+func (s *PreferredState) Summary() string {
+	summary := fmt.Sprintf("%d%%", s.Brightness)
+	if s.ColorTemp > 0 {
+		return fmt.Sprintf("%s %dK", summary, s.ColorTemp)
+	}
+	if s.Hue > 0 || s.Saturation > 0 {
+		return fmt.Sprintf("%s H%d S%d%%", summary, s.Hue, s.Saturation)
+	}
+	return summary
 }
 
 type SysInfo struct {
@@ -32,6 +54,7 @@ type SysInfo struct {
 	DeviceState         string             `json:"dev_state"`
 	DeviceId            string             `json:"deviceId"`
 	DiscoVersion        string             `json:"disco_ver"`
+	Feature             string             `json:"feature"`
 	ErrorCode           int                `json:"err_code"`
 	HeapSize            int                `json:"heapsize"`
 	HwId                string             `json:"hwId"`
@@ -41,13 +64,29 @@ type SysInfo struct {
 	IsFactory           bool               `json:"is_factory"`
 	IsVariableColorTemp int                `json:"is_variable_color_temp"`
 	LightState          *sysInfoLightState `json:"light_state"`
+	Mac                 string             `json:"mac"`
 	MicMac              string             `json:"mic_mac"`
 	MicType             string             `json:"mic_type"`
 	Model               string             `json:"model"`
 	OemId               string             `json:"oemId"`
 	PreferredState      []*PreferredState  `json:"preferred_state"`
+	RelayState          int                `json:"relay_state"`
+	Brightness          int                `json:"brightness"`
 	RSSI                int                `json:"rssi"`
 	SwVer               string             `json:"sw_ver"`
+	Type                string             `json:"type"`
+	// Cloud holds the cnCloud binding state when it was requested along
+	// with the sysinfo.
+	Cloud *CloudInfo `json:"-"`
+	// Raw holds every field the device sent, including the ones this
+	// struct does not know about. It is JSON encoded again after decoding
+	// the response, so key order and number formatting are not the
+	// device's.
+	Raw json.RawMessage `json:"-"`
+
+	// fields is Raw decoded once, sysinfos are read far more often than
+	// they are received.
+	fields map[string]interface{}
 }
 
 type sysInfoWrapper struct {
@@ -57,3 +96,79 @@ type sysInfoWrapper struct {
 type sysInfoResponse struct {
 	System *sysInfoWrapper `json:"system"`
 }
+
+// DeviceType returns the IOT.* type. Bulbs report it as mic_type while
+// plugs and switches use type.
+func (s *SysInfo) DeviceType() string {
+	if s.MicType != "" {
+		return s.MicType
+	}
+	return s.Type
+}
+
+// MacAddress returns the device MAC without separators. Bulbs report it as
+// mic_mac while plugs and switches use mac.
+func (s *SysInfo) MacAddress() string {
+	if s.MicMac != "" {
+		return normalizeMac(s.MicMac)
+	}
+	return normalizeMac(s.Mac)
+}
+
+func (s *SysInfo) UnmarshalJSON(data []byte) error {
+	type plain SysInfo
+	if err := json.Unmarshal(data, (*plain)(s)); err != nil {
+		return err
+	}
+	s.Raw = append(json.RawMessage{}, data...)
+	s.fields = decodeFields(s.Raw)
+	return nil
+}
+
+// Fields returns the raw sysinfo as a generic map. The map is shared by
+// every caller and must not be modified.
+func (s *SysInfo) Fields() map[string]interface{} {
+	if s.fields == nil {
+		return decodeFields(s.Raw)
+	}
+	return s.fields
+}
+
+func decodeFields(raw json.RawMessage) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if len(raw) > 0 {
+		json.Unmarshal(raw, &fields)
+	}
+	return fields
+}
+
+// Get returns a raw sysinfo field, e.g. "relay_state" or "latitude_i".
+func (s *SysInfo) Get(key string) (interface{}, bool) {
+	value, ok := s.Fields()[key]
+	return value, ok
+}
+
+// UnknownFields returns every field the device sent that SysInfo does not
+// decode.
+func (s *SysInfo) UnknownFields() map[string]interface{} {
+	known := sysInfoFieldNames()
+	unknown := map[string]interface{}{}
+	for key, value := range s.Fields() {
+		if !known[key] {
+			unknown[key] = value
+		}
+	}
+	return unknown
+}
+
+func sysInfoFieldNames() map[string]bool {
+	names := map[string]bool{}
+	t := reflect.TypeOf(SysInfo{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,54 @@
+package kasa_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+func TestSysInfoKeepsUnknownFields(t *testing.T) {
+	data := []byte(`{
+		"alias": "Fan",
+		"model": "HS100(US)",
+		"relay_state": 1,
+		"mac": "50:C7:BF:00:00:01",
+		"latitude_i": 525200,
+		"next_action": {"type": -1},
+		"ntc_state": 0
+	}`)
+	info := &kasa.SysInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Alias != "Fan" || info.RelayState != 1 || info.MacAddress() != "50C7BF000001" {
+		t.Errorf("decoded %+v", info)
+	}
+
+	var raw, want interface{}
+	json.Unmarshal(info.Raw, &raw)
+	json.Unmarshal(data, &want)
+	if !reflect.DeepEqual(raw, want) {
+		t.Errorf("raw sysinfo %s, want every field that was sent", info.Raw)
+	}
+	if value, ok := info.Get("latitude_i"); !ok || value != 525200.0 {
+		t.Errorf("latitude_i is %v", value)
+	}
+	if value, ok := info.Get("relay_state"); !ok || value != 1.0 {
+		t.Errorf("relay_state is %v, known fields are in the raw sysinfo too", value)
+	}
+	if _, ok := info.Get("led_off"); ok {
+		t.Error("got a field that was not sent")
+	}
+
+	unknown := info.UnknownFields()
+	wantUnknown := map[string]interface{}{
+		"latitude_i":  525200.0,
+		"next_action": map[string]interface{}{"type": -1.0},
+		"ntc_state":   0.0,
+	}
+	if !reflect.DeepEqual(unknown, wantUnknown) {
+		t.Errorf("unknown fields %v, want %v", unknown, wantUnknown)
+	}
+}
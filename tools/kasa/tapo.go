@@ -0,0 +1,802 @@
+package kasa
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tapo devices speak the SMART protocol: JSON {method, params} requests
+// sent to http://<host>/app, wrapped in an AES session negotiated with an
+// RSA handshake (securePassthrough).
+type TapoDevice struct {
+	client *tapoClient
+
+	// mu guards the state of the last sync. info is replaced, never
+	// changed in place.
+	mu       sync.RWMutex
+	info     *TPLinkDeviceInfo
+	sysInfo  *SysInfo
+	caps     *Capabilities
+	deviceOn bool
+	bright   int
+	syncErr  error
+}
+
+type tapoClient struct {
+	endpoint string
+	username string
+	password string
+	http     *http.Client
+	mu       sync.Mutex
+	session  *tapoSession
+}
+
+type tapoSession struct {
+	cipher cipher.Block
+	iv     []byte
+	cookie string
+	token  string
+}
+
+type tapoResponse struct {
+	ErrorCode int             `json:"error_code"`
+	Result    json.RawMessage `json:"result"`
+	Message   string          `json:"msg"`
+}
+
+type tapoDeviceInfo struct {
+	DeviceId   string `json:"device_id"`
+	FwVer      string `json:"fw_ver"`
+	HwVer      string `json:"hw_ver"`
+	Type       string `json:"type"`
+	Model      string `json:"model"`
+	Mac        string `json:"mac"`
+	Nickname   string `json:"nickname"`
+	DeviceOn   bool   `json:"device_on"`
+	Brightness int    `json:"brightness"`
+	ColorTemp  int    `json:"color_temp"`
+	Hue        int    `json:"hue"`
+	Saturation int    `json:"saturation"`
+	RSSI       int    `json:"rssi"`
+}
+
+type TapoError struct {
+	Method    string
+	ErrorCode int
+}
+
+func (e *TapoError) Error() string {
+	return fmt.Sprintf("tapo %s failed with error code %d", e.Method, e.ErrorCode)
+}
+
+// ErrTapoPasswordRequired is the error of Tapo devices created without the
+// account password, e.g. after a login with a refresh token only. The
+// devices log in on their own and do not take the cloud token.
+var ErrTapoPasswordRequired = errors.New("the account password is required for Tapo devices")
+
+var tapoColorModels = []string{"L530", "L535", "L630", "L900", "L920"}
+var tapoColorTempModels = []string{"L530", "L535", "L630"}
+var tapoEmeterModels = []string{"P110", "P115", "P125"}
+
+// IsTapoType reports whether a cloud deviceType belongs to the SMART
+// (Tapo) family rather than the IOT (Kasa) one.
+func IsTapoType(deviceType string) bool {
+	return strings.HasPrefix(strings.ToUpper(deviceType), "SMART.")
+}
+
+func isTapoBulbType(deviceType string) bool {
+	return strings.Contains(strings.ToUpper(deviceType), "BULB")
+}
+
+// NewTapoDevice connects to a Tapo device on the LAN. host is the device
+// address (or a full base URL for a stand-in server), username and
+// password are the TP-Link account credentials. info may be nil when the
+// device does not come from the cloud device list.
+func NewTapoDevice(host string, username string, password string, info *TPLinkDeviceInfo) Device {
+	endpoint := host
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "http://" + endpoint
+	}
+	if !strings.HasSuffix(endpoint, "/app") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/app"
+	}
+	if info == nil {
+		info = &TPLinkDeviceInfo{}
+	}
+	dev := &TapoDevice{
+		info: info,
+		client: &tapoClient{
+			endpoint: endpoint,
+			username: username,
+			password: password,
+			http:     &http.Client{Timeout: 10 * time.Second},
+		},
+		caps: tapoCapabilities(info.DeviceType, info.DeviceModel),
+	}
+	dev.Sync()
+	return dev
+}
+
+func (d *TapoDevice) deviceInfo() *TPLinkDeviceInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.info
+}
+
+func (d *TapoDevice) Id() string {
+	return d.deviceInfo().DeviceId
+}
+
+func (d *TapoDevice) FirmwareVersion() string {
+	return d.deviceInfo().FwVer
+}
+
+func (d *TapoDevice) Role() Role {
+	return d.deviceInfo().Role
+}
+
+func (d *TapoDevice) Mac() string {
+	return d.deviceInfo().DeviceMac
+}
+
+func (d *TapoDevice) Model() string {
+	return d.deviceInfo().DeviceModel
+}
+
+func (d *TapoDevice) Name() string {
+	return d.deviceInfo().DeviceName
+}
+
+func (d *TapoDevice) Type() string {
+	return d.deviceInfo().DeviceType
+}
+
+func (d *TapoDevice) Status() int {
+	if d.IsConnected() {
+		return 1
+	}
+	return 0
+}
+
+func (d *TapoDevice) Alias() string {
+	return d.deviceInfo().Alias
+}
+
+func (d *TapoDevice) AppServerUrl() string {
+	return d.deviceInfo().AppServerUrl
+}
+
+func (d *TapoDevice) HumanName() string {
+	status := "OFF"
+	if d.IsConnected() {
+		status = "ON"
+	}
+	if !d.Capabilities().Dimmable {
+		return fmt.Sprintf("%s [%s]", d.Alias(), status)
+	}
+	return fmt.Sprintf("%s [%s %d%%]", d.Alias(), status, d.Brightness())
+}
+
+func (d *TapoDevice) Brightness() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.bright
+}
+
+func (d *TapoDevice) IsConnected() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.deviceOn
+}
+
+func (d *TapoDevice) IsDisconnected() bool {
+	return !d.IsConnected()
+}
+
+func (d *TapoDevice) TurnOn() error {
+	return d.setDeviceInfo(map[string]interface{}{"device_on": true})
+}
+
+func (d *TapoDevice) TurnOff() error {
+	return d.setDeviceInfo(map[string]interface{}{"device_on": false})
+}
+
+func (d *TapoDevice) SetBrightness(brightness int) error {
+	if err := requireCapability(d, CapabilityDimmable); err != nil {
+		return err
+	}
+	if brightness < 0 || brightness > 100 {
+		return fmt.Errorf("brightness %d out of range 0-100", brightness)
+	}
+	return d.setDeviceInfo(map[string]interface{}{
+		"device_on":  true,
+		"brightness": brightness,
+	})
+}
+
+func (d *TapoDevice) SystemInfo() (*SysInfo, error) {
+	result, err := d.client.request("get_device_info", nil)
+	if err != nil {
+		return nil, err
+	}
+	return tapoSysInfo(result)
+}
+
+func (d *TapoDevice) LastSysInfo() *SysInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.sysInfo
+}
+
+// Capabilities returns the capabilities computed at the last sync.
+func (d *TapoDevice) Capabilities() *Capabilities {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.caps
+}
+
+func tapoCapabilities(deviceType string, model string) *Capabilities {
+	model = strings.ToUpper(model)
+	caps := &Capabilities{OnOff: true}
+	if isTapoBulbType(deviceType) {
+		caps.Dimmable = true
+		caps.Color = modelHasPrefix(model, tapoColorModels)
+		if modelHasPrefix(model, tapoColorTempModels) {
+			caps.ColorTemp = &ColorTempRange{2500, 6500}
+		}
+	} else {
+		caps.Countdown = true
+	}
+	caps.Emeter = modelHasPrefix(model, tapoEmeterModels)
+	return caps
+}
+
+func (d *TapoDevice) PreferredStates() []*PreferredState {
+	return []*PreferredState{}
+}
+
+func (d *TapoDevice) SetPreferredState(idx int) error {
+	return fmt.Errorf("invalid preferred state index %d", idx)
+}
+
+func (d *TapoDevice) SavePreferredState(idx int) error {
+	return fmt.Errorf("invalid preferred state index %d", idx)
+}
+
+func (d *TapoDevice) DefaultBehavior() (*DefaultBehavior, error) {
+	return nil, &CapabilityError{d.Alias(), CapabilityPowerOnBehavior}
+}
+
+func (d *TapoDevice) SetDefaultBehavior(behavior *DefaultBehavior) error {
+	return &CapabilityError{d.Alias(), CapabilityPowerOnBehavior}
+}
+
+func (d *TapoDevice) Mode() string {
+	return ""
+}
+
+func (d *TapoDevice) SetMode(mode string) error {
+	return &CapabilityError{d.Alias(), CapabilityCircadian}
+}
+
+func (d *TapoDevice) CloudInfo() (*CloudInfo, error) {
+	return nil, &CapabilityError{d.Alias(), "cloud binding"}
+}
+
+func (d *TapoDevice) BindCloud(username string, password string) error {
+	return &CapabilityError{d.Alias(), "cloud binding"}
+}
+
+func (d *TapoDevice) UnbindCloud() error {
+	return &CapabilityError{d.Alias(), "cloud binding"}
+}
+
+func (d *TapoDevice) SetCloudServer(server string) error {
+	return &CapabilityError{d.Alias(), "cloud binding"}
+}
+
+func (d *TapoDevice) DayStats(year int, month int) ([]*DayStat, error) {
+	return nil, &CapabilityError{d.Alias(), CapabilitySchedule}
+}
+
+func (d *TapoDevice) MonthStats(year int) ([]*MonthStat, error) {
+	return nil, &CapabilityError{d.Alias(), CapabilitySchedule}
+}
+
+// Do is not available on the SMART protocol, its batches are lists of
+// methods rather than IOT module calls.
+func (d *TapoDevice) Do(batch *Batch) (*BatchResult, error) {
+	return nil, &CapabilityError{d.Alias(), "IOT module requests"}
+}
+
+// passthroughRequest sends a raw {"method": ..., "params": ...} request
+// over the secure session.
+func (d *TapoDevice) passthroughRequest(command interface{}) (map[string]interface{}, error) {
+	request := struct {
+		Method string                 `json:"method"`
+		Params map[string]interface{} `json:"params"`
+	}{}
+	transcode(command, &request)
+	if request.Method == "" {
+		return nil, errors.New("tapo request without method")
+	}
+	result, err := d.client.request(request.Method, request.Params)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{}
+	if len(result) > 0 {
+		if err = json.Unmarshal(result, &data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Raw sends a {"method": ..., "params": ...} request over the secure
+// session.
+func (d *TapoDevice) Raw(ctx context.Context, request json.RawMessage) (json.RawMessage, error) {
+	command, err := parseRawRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	method, _ := command["method"].(string)
+	if method == "" {
+		return nil, errors.New("raw request: tapo requests need a method")
+	}
+	params, _ := command["params"].(map[string]interface{})
+	result, err := d.client.requestContext(ctx, method, params)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return json.RawMessage(`{}`), nil
+	}
+	return result, nil
+}
+
+func (d *TapoDevice) setDeviceInfo(params map[string]interface{}) error {
+	if err := requireCapability(d, CapabilityOnOff); err != nil {
+		return err
+	}
+	if _, err := d.client.request("set_device_info", params); err != nil {
+		return err
+	}
+	return d.Sync()
+}
+
+// Sync reads the device state again. A failed sync keeps the last state
+// and is reported by SyncError until the device answers.
+func (d *TapoDevice) Sync() error {
+	sysInfo, err := d.SystemInfo()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		d.syncErr = err
+		return err
+	}
+	info := *d.info
+	if info.DeviceId == "" {
+		info.DeviceId = sysInfo.DeviceId
+		info.DeviceName = sysInfo.Model
+	}
+	info.Alias = sysInfo.Alias
+	info.DeviceMac = sysInfo.MacAddress()
+	info.DeviceModel = sysInfo.Model
+	info.DeviceType = sysInfo.Type
+	info.FwVer = sysInfo.SwVer
+	info.Status = sysInfo.RelayState
+	d.info = &info
+	d.sysInfo = sysInfo
+	d.deviceOn = sysInfo.RelayState == 1
+	d.bright = sysInfo.Brightness
+	d.caps = tapoCapabilities(sysInfo.Type, sysInfo.Model)
+	d.syncErr = nil
+	return nil
+}
+
+func (d *TapoDevice) SyncError() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.syncErr
+}
+
+// tapoSysInfo maps get_device_info onto the IOT sysinfo so both families
+// can be shown the same way.
+func tapoSysInfo(result json.RawMessage) (*SysInfo, error) {
+	info := &tapoDeviceInfo{}
+	if err := json.Unmarshal(result, info); err != nil {
+		return nil, err
+	}
+	alias := info.Nickname
+	if decoded, err := base64.StdEncoding.DecodeString(info.Nickname); err == nil {
+		alias = string(decoded)
+	}
+	sysInfo := &SysInfo{
+		Alias:      alias,
+		DeviceId:   info.DeviceId,
+		HwVer:      info.HwVer,
+		Mac:        info.Mac,
+		Model:      info.Model,
+		RSSI:       info.RSSI,
+		SwVer:      info.FwVer,
+		Type:       info.Type,
+		Brightness: info.Brightness,
+		Raw:        append(json.RawMessage{}, result...),
+	}
+	sysInfo.fields = decodeFields(sysInfo.Raw)
+	if info.DeviceOn {
+		sysInfo.RelayState = 1
+	}
+	if isTapoBulbType(info.Type) {
+		sysInfo.IsDimmable = 1
+		sysInfo.LightState = &sysInfoLightState{
+			defaultOnState: defaultOnState{
+				Brightness: info.Brightness,
+				ColorTemp:  info.ColorTemp,
+				Hue:        info.Hue,
+				Saturation: info.Saturation,
+			},
+			OnOff: sysInfo.RelayState,
+		}
+	}
+	return sysInfo, nil
+}
+
+func (c *tapoClient) request(method string, params map[string]interface{}) (json.RawMessage, error) {
+	return c.requestContext(context.Background(), method, params)
+}
+
+func (c *tapoClient) requestContext(ctx context.Context, method string, params map[string]interface{}) (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == nil {
+		if err := c.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	result, err := c.securePassthrough(ctx, method, params)
+	var tapoErr *TapoError
+	if errors.As(err, &tapoErr) && tapoErr.ErrorCode == tapoErrorSessionExpired {
+		// The device dropped our session, negotiate a new one and retry once.
+		c.session = nil
+		if err = c.connect(ctx); err != nil {
+			return nil, err
+		}
+		result, err = c.securePassthrough(ctx, method, params)
+	}
+	return result, err
+}
+
+const tapoErrorSessionExpired = 9999
+
+func (c *tapoClient) connect(ctx context.Context) error {
+	if c.password == "" {
+		return ErrTapoPasswordRequired
+	}
+	if err := c.handshake(ctx); err != nil {
+		return err
+	}
+	digest := sha1.Sum([]byte(c.username))
+	result, err := c.securePassthrough(ctx, "login_device", map[string]interface{}{
+		"username": base64.StdEncoding.EncodeToString([]byte(hex.EncodeToString(digest[:]))),
+		"password": base64.StdEncoding.EncodeToString([]byte(c.password)),
+	})
+	if err != nil {
+		c.session = nil
+		return err
+	}
+	login := struct {
+		Token string `json:"token"`
+	}{}
+	if err = json.Unmarshal(result, &login); err != nil {
+		c.session = nil
+		return err
+	}
+	c.session.token = login.Token
+	return nil
+}
+
+func (c *tapoClient) handshake(ctx context.Context) error {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	body, _ := json.Marshal(map[string]interface{}{
+		"method": "handshake",
+		"params": map[string]interface{}{
+			"key":             string(publicKey),
+			"requestTimeMils": time.Now().UnixNano() / int64(time.Millisecond),
+		},
+	})
+	request, err := http.NewRequestWithContext(ctx, "POST", c.endpoint, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	res := &tapoResponse{}
+	if err = json.NewDecoder(response.Body).Decode(res); err != nil {
+		return err
+	}
+	if res.ErrorCode != 0 {
+		return &TapoError{"handshake", res.ErrorCode}
+	}
+	handshake := struct {
+		Key string `json:"key"`
+	}{}
+	if err = json.Unmarshal(res.Result, &handshake); err != nil {
+		return err
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(handshake.Key)
+	if err != nil {
+		return err
+	}
+	sessionKey, err := rsa.DecryptPKCS1v15(rand.Reader, key, encrypted)
+	if err != nil {
+		return err
+	}
+	if len(sessionKey) != 32 {
+		return errors.New("tapo handshake returned an invalid session key")
+	}
+	block, err := aes.NewCipher(sessionKey[:16])
+	if err != nil {
+		return err
+	}
+	cookie := ""
+	for _, c := range response.Cookies() {
+		if c.Name == "TP_SESSIONID" {
+			cookie = c.Name + "=" + c.Value
+		}
+	}
+	c.session = &tapoSession{cipher: block, iv: sessionKey[16:], cookie: cookie}
+	return nil
+}
+
+func (c *tapoClient) securePassthrough(ctx context.Context, method string, params map[string]interface{}) (json.RawMessage, error) {
+	inner := map[string]interface{}{
+		"method":          method,
+		"requestTimeMils": time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if params != nil {
+		inner["params"] = params
+	}
+	plain, err := json.Marshal(inner)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"method": "securePassthrough",
+		"params": map[string]interface{}{
+			"request": base64.StdEncoding.EncodeToString(c.session.encrypt(plain)),
+		},
+	})
+	url := c.endpoint
+	if c.session.token != "" {
+		url += "?token=" + c.session.token
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if c.session.cookie != "" {
+		request.Header.Set("Cookie", c.session.cookie)
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	raw, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	outer := &tapoResponse{}
+	if err = json.Unmarshal(raw, outer); err != nil {
+		return nil, err
+	}
+	if outer.ErrorCode != 0 {
+		return nil, &TapoError{method, outer.ErrorCode}
+	}
+	wrapped := struct {
+		Response string `json:"response"`
+	}{}
+	if err = json.Unmarshal(outer.Result, &wrapped); err != nil {
+		return nil, err
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(wrapped.Response)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := c.session.decrypt(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	res := &tapoResponse{}
+	if err = json.Unmarshal(decrypted, res); err != nil {
+		return nil, err
+	}
+	if res.ErrorCode != 0 {
+		return nil, &TapoError{method, res.ErrorCode}
+	}
+	return res.Result, nil
+}
+
+func (s *tapoSession) encrypt(data []byte) []byte {
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	padded := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	out := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(s.cipher, s.iv).CryptBlocks(out, padded)
+	return out
+}
+
+func (s *tapoSession) decrypt(data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("tapo response is not block aligned")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(s.cipher, s.iv).CryptBlocks(out, data)
+	padding := int(out[len(out)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(out) {
+		return nil, errors.New("tapo response has invalid padding")
+	}
+	return out[:len(out)-padding], nil
+}
+
+// TapoDiscoveryPort is where Tapo devices answer discovery broadcasts.
+const TapoDiscoveryPort = 20002
+
+// DiscoveredTapo is a Tapo device that answered discovery. Host is the
+// address NewTapoDevice takes, with the port when it is not 80.
+type DiscoveredTapo struct {
+	Host     string
+	DeviceId string
+	Mac      string
+	Model    string
+	Type     string
+}
+
+type tapoDiscoveryResponse struct {
+	ErrorCode int `json:"error_code"`
+	Result    struct {
+		DeviceId    string `json:"device_id"`
+		DeviceType  string `json:"device_type"`
+		DeviceModel string `json:"device_model"`
+		IP          string `json:"ip"`
+		Mac         string `json:"mac"`
+		Encryption  struct {
+			HTTPPort int `json:"http_port"`
+		} `json:"mgt_encrypt_schm"`
+	} `json:"result"`
+}
+
+// tapoDiscoveryHeaderSize is the size of the header in front of the JSON
+// of discovery packets: version, type, opcode, size, flags, padding,
+// serial and CRC32.
+const tapoDiscoveryHeaderSize = 16
+
+// DiscoverTapo broadcasts a Tapo discovery probe on the local network and
+// collects every device that answers before the timeout.
+func DiscoverTapo(timeout time.Duration) ([]*DiscoveredTapo, error) {
+	return DiscoverTapoAddr(DefaultBroadcast, timeout)
+}
+
+func DiscoverTapoAddr(addr string, timeout time.Duration) ([]*DiscoveredTapo, error) {
+	target, err := net.ResolveUDPAddr("udp4", withDefaultPort(addr, TapoDiscoveryPort))
+	if err != nil {
+		return nil, err
+	}
+	query, err := tapoDiscoveryQuery()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err = conn.WriteToUDP(query, target); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	found := map[string]bool{}
+	devices := []*DiscoveredTapo{}
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return devices, err
+		}
+		if n <= tapoDiscoveryHeaderSize {
+			continue
+		}
+		response := &tapoDiscoveryResponse{}
+		if json.Unmarshal(buf[tapoDiscoveryHeaderSize:n], response) != nil || response.ErrorCode != 0 {
+			continue
+		}
+		result := response.Result
+		host := result.IP
+		if host == "" {
+			host = from.IP.String()
+		}
+		if port := result.Encryption.HTTPPort; port != 0 && port != 80 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		if found[host] {
+			continue
+		}
+		found[host] = true
+		devices = append(devices, &DiscoveredTapo{
+			Host:     host,
+			DeviceId: result.DeviceId,
+			Mac:      result.Mac,
+			Model:    result.DeviceModel,
+			Type:     result.DeviceType,
+		})
+	}
+	return devices, nil
+}
+
+// tapoDiscoveryQuery builds the probe. The devices only answer probes that
+// carry an RSA key, even though the answer is not encrypted with it.
+func tapoDiscoveryQuery() ([]byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"params": map[string]interface{}{
+			"rsa_key": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		},
+	})
+	query := make([]byte, tapoDiscoveryHeaderSize, tapoDiscoveryHeaderSize+len(payload))
+	query[0] = 2
+	binary.BigEndian.PutUint16(query[2:], 1)
+	binary.BigEndian.PutUint16(query[4:], uint16(len(payload)))
+	query[6] = 17
+	rand.Read(query[8:12])
+	binary.BigEndian.PutUint32(query[12:], 0x5A6B7C8D)
+	query = append(query, payload...)
+	binary.BigEndian.PutUint32(query[12:], crc32.ChecksumIEEE(query))
+	return query, nil
+}
@@ -0,0 +1,109 @@
+package kasa_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+func serveTapo(t *testing.T, device *kasatest.Tapo) *kasatest.TapoServer {
+	t.Helper()
+	srv, err := kasatest.ServeTapo(device, "127.0.0.1:0", "user@example.org", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func TestTapoDevice(t *testing.T) {
+	bulb := kasatest.NewTapoBulb("tapo-1", "Hall", "L530")
+	srv := serveTapo(t, bulb)
+	device := kasa.NewTapoDevice(srv.Addr(), "user@example.org", "secret", nil)
+	if err := device.SyncError(); err != nil {
+		t.Fatal(err)
+	}
+	if device.Id() != "tapo-1" || device.Alias() != "Hall" || !device.Capabilities().Color {
+		t.Errorf("device %s %q, capabilities %+v", device.Id(), device.Alias(), device.Capabilities())
+	}
+	// The L530 has a color temperature but no circadian mode.
+	if caps := device.Capabilities(); caps.ColorTemp == nil || caps.Circadian {
+		t.Errorf("capabilities %+v, want a color temperature without circadian mode", caps)
+	}
+
+	if err := device.SetBrightness(35); err != nil {
+		t.Fatal(err)
+	}
+	if !bulb.IsOn() || bulb.Brightness() != 35 || device.Brightness() != 35 {
+		t.Errorf("bulb on %v at %d%%, want on at 35%%", bulb.IsOn(), bulb.Brightness())
+	}
+
+	if err := device.SetBrightness(150); err == nil || bulb.Brightness() != 35 {
+		t.Errorf("brightness 150 gave %v, the bulb is at %d%%", err, bulb.Brightness())
+	}
+
+	srv.ExpireSessions()
+	if err := device.TurnOff(); err != nil {
+		t.Fatalf("request after the session expired: %v", err)
+	}
+	if bulb.IsOn() || device.IsConnected() {
+		t.Error("the bulb is still on")
+	}
+}
+
+func TestTapoWrongPassword(t *testing.T) {
+	srv := serveTapo(t, kasatest.NewTapoPlug("tapo-1", "Heater", "P100"))
+	device := kasa.NewTapoDevice(srv.Addr(), "user@example.org", "wrong", nil)
+	if device.SyncError() == nil {
+		t.Error("the device accepted a wrong password")
+	}
+	if kasa.StateOf(device).Online {
+		t.Error("a device that refused the login is online")
+	}
+}
+
+func TestDeviceListDiscoversTapo(t *testing.T) {
+	tapo := kasatest.NewTapoPlug("tapo-1", "Heater", "P110")
+	srv := serveTapo(t, tapo)
+	cloud := kasatest.NewCloud("user@example.org", "secret", kasatest.NewPlug("plug-1", "Fan", "HS100"), tapo)
+	cloudSrv := cloud.Start()
+	defer cloudSrv.Close()
+	link, err := kasa.TpLinkLoginWithOptions("user@example.org", "secret", &kasa.LoginOptions{
+		BaseURL:       cloudSrv.URL,
+		DiscoveryAddr: srv.Addr(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := link.DeviceList()
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, want the Kasa and the Tapo plug", len(devices))
+	}
+	device, _ := link.FindDevice("Heater")
+	if device == nil {
+		t.Fatal("the Tapo plug is missing")
+	}
+	if err = device.TurnOn(); err != nil {
+		t.Fatal(err)
+	}
+	if !tapo.IsOn() {
+		t.Error("the Tapo plug did not turn on")
+	}
+	if !device.Capabilities().Emeter {
+		t.Error("the P110 has no energy meter")
+	}
+}
+
+func TestDiscoverTapo(t *testing.T) {
+	tapo := kasatest.NewTapoBulb("tapo-1", "Hall", "L510")
+	srv := serveTapo(t, tapo)
+	found, err := kasa.DiscoverTapoAddr(srv.Addr(), 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Host != srv.Addr() || found[0].DeviceId != "tapo-1" || found[0].Mac != tapo.Mac() {
+		t.Fatalf("discovered %+v", found)
+	}
+}
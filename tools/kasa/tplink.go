@@ -1,22 +1,57 @@
 package kasa
 
 import (
+	"errors"
 	"log"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// DefaultCloudURL serves the accounts that have no regional host.
+const DefaultCloudURL = "https://wap.tplinkcloud.com"
+
 type TPLink interface {
 	TermId() string
+	BaseURL() string
 	Token() string
 	DeviceList() []Device
 	FindDevice(alias string) (Device, error)
+	SetLocalHosts(hosts map[string]string)
+	RefreshToken() string
+	Refresh() error
+	AccountInfo() (*AccountInfo, error)
+	ShareUsers(deviceId string) ([]*ShareUser, error)
+	ShareDevice(deviceId string, email string) error
+	UnshareDevice(deviceId string, email string) error
+	DeviceUsage(deviceId string) (*DeviceUsage, error)
+	HTTPClient() *http.Client
+	// renewToken refreshes the session token after expired was refused,
+	// unless another request already did.
+	renewToken(expired string) error
 }
 
 type tpLink struct {
-	termId  string
-	token   string
-	devices []Device
+	termId     string
+	devices    []Device
+	username   string
+	password   string
+	localHosts map[string]string
+	baseURL    string
+	client     *http.Client
+	// discoveryAddr is where Tapo devices without a local host are looked
+	// for, discovered holds what answered, nil until the first look.
+	discoveryAddr string
+	discovered    map[string]string
+
+	// mu guards the tokens, the devices of the session share them.
+	mu           sync.RWMutex
+	token        string
+	refreshToken string
+	// renewing serializes renewToken.
+	renewing sync.Mutex
 }
 
 func (t *tpLink) TermId() string {
@@ -24,12 +59,86 @@ func (t *tpLink) TermId() string {
 }
 
 func (t *tpLink) Token() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	return t.token
 }
 
+func (t *tpLink) BaseURL() string {
+	if t.baseURL == "" {
+		return DefaultCloudURL
+	}
+	return t.baseURL
+}
+
+// HTTPClient is the client every cloud request of the session, including
+// device passthrough, goes through.
+func (t *tpLink) HTTPClient() *http.Client {
+	if t.client == nil {
+		return http.DefaultClient
+	}
+	return t.client
+}
+
+func (t *tpLink) RefreshToken() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.refreshToken
+}
+
+// Refresh renews the session token with the refresh token, without the
+// account password.
+func (t *tpLink) Refresh() error {
+	refreshToken := t.RefreshToken()
+	if refreshToken == "" {
+		return errors.New("no refresh token")
+	}
+	res, err := baseRequest(&tpLink{termId: t.termId, baseURL: t.baseURL, client: t.client}, map[string]interface{}{
+		"method": "refreshToken",
+		"params": map[string]interface{}{
+			"appType":      "Kasa_Android",
+			"terminalUUID": t.termId,
+			"refreshToken": refreshToken,
+		},
+	})
+	if err != nil {
+		return loginError(err)
+	}
+	var loginResp LoginResponse
+	transcode(res, &loginResp)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.token = loginResp.Token
+	if loginResp.RefreshToken != "" {
+		t.refreshToken = loginResp.RefreshToken
+	}
+	return nil
+}
+
+func (t *tpLink) renewToken(expired string) error {
+	t.renewing.Lock()
+	defer t.renewing.Unlock()
+	if t.Token() != expired {
+		return nil
+	}
+	log.Println("Session token expired, refreshing it")
+	return t.Refresh()
+}
+
+// request sends a cloud request of the session, renewing the token once
+// if it expired.
+func (t *tpLink) request(requestBody map[string]interface{}) (interface{}, error) {
+	token := t.Token()
+	res, err := baseRequest(t, requestBody)
+	if isTokenExpired(err) && t.renewToken(token) == nil {
+		res, err = baseRequest(t, requestBody)
+	}
+	return res, err
+}
+
 func (t *tpLink) DeviceList() []Device {
 	command := map[string]interface{}{"method": "getDeviceList"}
-	res, err := baseRequest(t, command)
+	res, err := t.request(command)
 	if err != nil {
 		log.Println(err)
 		return nil
@@ -39,6 +148,21 @@ func (t *tpLink) DeviceList() []Device {
 			for _, v := range v.([]interface{}) {
 				var device TPLinkDeviceInfo
 				transcode(v, &device)
+				if IsTapoType(device.DeviceType) {
+					host, ok := t.localHost(device.DeviceMac)
+					if !ok && t.discovered == nil {
+						t.discoverTapo()
+						host, ok = t.localHost(device.DeviceMac)
+					}
+					if !ok {
+						log.Printf("No local address for Tapo device %s (%s), skipping\n", device.Alias, device.DeviceMac)
+						continue
+					}
+					// Without the password the device stays offline with
+					// ErrTapoPasswordRequired as its sync error.
+					t.devices = append(t.devices, NewTapoDevice(host, t.username, t.password, &device))
+					continue
+				}
 				dev := NewTpLinkDevice(t, &device)
 				t.devices = append(t.devices, dev)
 			}
@@ -47,6 +171,43 @@ func (t *tpLink) DeviceList() []Device {
 	return t.devices
 }
 
+// SetLocalHosts tells the link where to reach Tapo devices, which are only
+// controllable over the LAN. hosts maps a device MAC to its address, the
+// devices missing from it are looked for with DiscoverTapo.
+func (t *tpLink) SetLocalHosts(hosts map[string]string) {
+	t.localHosts = map[string]string{}
+	for mac, host := range hosts {
+		t.localHosts[normalizeMac(mac)] = host
+	}
+}
+
+func (t *tpLink) localHost(mac string) (string, bool) {
+	if host, ok := t.localHosts[normalizeMac(mac)]; ok {
+		return host, true
+	}
+	host, ok := t.discovered[normalizeMac(mac)]
+	return host, ok
+}
+
+// tapoDiscoveryTimeout is how long DeviceList waits for Tapo devices to
+// answer discovery.
+const tapoDiscoveryTimeout = 3 * time.Second
+
+func (t *tpLink) discoverTapo() {
+	t.discovered = map[string]string{}
+	addr := t.discoveryAddr
+	if addr == "" {
+		addr = DefaultBroadcast
+	}
+	devices, err := DiscoverTapoAddr(addr, tapoDiscoveryTimeout)
+	if err != nil {
+		log.Printf("Tapo discovery failed: %s\n", err)
+	}
+	for _, device := range devices {
+		t.discovered[normalizeMac(device.Mac)] = device.Host
+	}
+}
+
 func (t *tpLink) FindDevice(alias string) (Device, error) {
 	for _, device := range t.devices {
 		if device.Alias() == alias {
@@ -56,33 +217,120 @@ func (t *tpLink) FindDevice(alias string) (Device, error) {
 	return nil, nil
 }
 
+// LoginOptions tunes the cloud login. A refresh token lets the login skip
+// the password, MFACode is asked for the verification code when the account
+// has two-step verification enabled.
+type LoginOptions struct {
+	// TermId reuses a terminal UUID, refresh tokens are bound to it.
+	TermId       string
+	RefreshToken string
+	MFACode      func() (string, error)
+	// BaseURL replaces DefaultCloudURL, either with a regional host or
+	// with a local mock cloud.
+	BaseURL string
+	// Transport carries the cloud requests, e.g. a Recorder or Replayer.
+	// Nil uses http.DefaultTransport.
+	Transport http.RoundTripper
+	// DiscoveryAddr replaces DefaultBroadcast when looking for Tapo
+	// devices that have no local host.
+	DiscoveryAddr string
+}
+
 func TpLinkLogin(username string, password string) (TPLink, error) {
-	termId := uuid.New()
+	return TpLinkLoginWithOptions(username, password, nil)
+}
+
+func TpLinkLoginWithOptions(username string, password string, opts *LoginOptions) (TPLink, error) {
+	if opts == nil {
+		opts = &LoginOptions{}
+	}
+	termId := opts.TermId
+	if termId == "" {
+		termId = uuid.New().String()
+	}
 	link := &tpLink{
-		termId:  termId.String(),
-		token:   "",
-		devices: nil,
+		termId:        termId,
+		devices:       nil,
+		username:      username,
+		password:      password,
+		refreshToken:  opts.RefreshToken,
+		baseURL:       opts.BaseURL,
+		client:        &http.Client{Transport: opts.Transport},
+		discoveryAddr: opts.DiscoveryAddr,
+	}
+	if link.refreshToken != "" {
+		err := link.Refresh()
+		if err == nil {
+			return link, nil
+		}
+		if password == "" {
+			return nil, err
+		}
+		log.Printf("Refreshing the session failed, logging in with password: %s\n", err)
+	}
+
+	link.resolveRegion(username)
+	params := map[string]interface{}{
+		"appType":            "Kasa_Android",
+		"cloudUserName":      username,
+		"cloudPassword":      password,
+		"terminalUUID":       termId,
+		"refreshTokenNeeded": true,
 	}
 	reqBody := map[string]interface{}{
 		"method": "login",
-		"url":    "https://wap.tplinkcloud.com",
-		"params": map[string]string{
-			"appType":       "Kasa_Android",
-			"cloudUserName": username,
-			"cloudPassword": password,
-			"terminalUUID":  termId.String(),
-		},
+		"url":    link.BaseURL(),
+		"params": params,
 	}
 
 	res, err := baseRequest(link, reqBody)
-	if err != nil {
-		return nil, err
+	var cloudErr *CloudError
+	if errors.As(err, &cloudErr) && cloudErr.ErrorCode == ErrorCodeMFARequired {
+		if opts.MFACode == nil {
+			return nil, loginError(err)
+		}
+		code, err := opts.MFACode()
+		if err != nil {
+			return nil, err
+		}
+		params["code"] = code
+		reqBody["method"] = "checkMFACodeAndLogin"
+		res, err = baseRequest(link, reqBody)
+		if err != nil {
+			return nil, loginError(err)
+		}
+	} else if err != nil {
+		return nil, loginError(err)
 	}
 	var loginResp LoginResponse
 	transcode(res, &loginResp)
-	return &tpLink{
-		termId:  termId.String(),
-		token:   loginResp.Token,
-		devices: nil,
-	}, nil
+	link.mu.Lock()
+	link.token = loginResp.Token
+	link.refreshToken = loginResp.RefreshToken
+	link.mu.Unlock()
+	if loginResp.AppServerUrl != "" {
+		link.baseURL = loginResp.AppServerUrl
+	}
+	return link, nil
+}
+
+// resolveRegion asks the cloud which host serves the account and switches
+// to it. Clouds that do not know the method keep the current host.
+func (t *tpLink) resolveRegion(username string) {
+	res, err := baseRequest(t, map[string]interface{}{
+		"method": "getAccountStatusAndUrl",
+		"params": map[string]interface{}{
+			"appType":       "Kasa_Android",
+			"cloudUserName": username,
+		},
+	})
+	if err != nil {
+		return
+	}
+	var status AccountStatus
+	transcode(res, &status)
+	if status.AppServerUrl != "" && status.AppServerUrl != t.BaseURL() {
+		log.Printf("Account is served from %s\n", status.AppServerUrl)
+		t.baseURL = status.AppServerUrl
+	}
 }
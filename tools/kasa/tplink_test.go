@@ -0,0 +1,127 @@
+package kasa_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+func TestExpiredTokenIsRenewed(t *testing.T) {
+	plug := kasatest.NewPlug("plug-1", "Fan", "HS100")
+	cloud, link := login(t, plug)
+	devices := link.DeviceList()
+	if len(devices) != 1 {
+		t.Fatalf("got %d devices, want 1", len(devices))
+	}
+	token := link.Token()
+
+	cloud.ExpireTokens()
+	if err := devices[0].TurnOn(); err != nil {
+		t.Fatalf("passthrough after expiry: %v", err)
+	}
+	if !plug.IsOn() {
+		t.Error("plug is still off")
+	}
+	if link.Token() == token {
+		t.Error("the session kept the expired token")
+	}
+
+	cloud.ExpireTokens()
+	if _, err := link.AccountInfo(); err != nil {
+		t.Fatalf("account request after expiry: %v", err)
+	}
+}
+
+func TestRefreshTokenLogin(t *testing.T) {
+	tapo := kasatest.NewTapoPlug("tapo-1", "Heater", "P100")
+	srv := serveTapo(t, tapo)
+	_, link := login(t, kasatest.NewPlug("plug-1", "Fan", "HS100"), tapo)
+
+	refreshed, err := kasa.TpLinkLoginWithOptions("user@example.org", "", &kasa.LoginOptions{
+		TermId:       link.TermId(),
+		RefreshToken: link.RefreshToken(),
+		BaseURL:      link.BaseURL(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed.SetLocalHosts(map[string]string{tapo.Mac(): srv.Addr()})
+	refreshed.DeviceList()
+	if device, _ := refreshed.FindDevice("Fan"); device == nil || device.TurnOn() != nil {
+		t.Error("the Kasa plug cannot be used after a refresh token login")
+	}
+	// The Tapo plug needs the password the refresh token login did not get.
+	device, _ := refreshed.FindDevice("Heater")
+	if device == nil {
+		t.Fatal("the Tapo plug is missing")
+	}
+	if err = device.TurnOn(); !errors.Is(err, kasa.ErrTapoPasswordRequired) || !errors.Is(device.SyncError(), kasa.ErrTapoPasswordRequired) {
+		t.Errorf("turning the Tapo plug on without the password: %v", err)
+	}
+
+	// The password is used when the refresh token is refused.
+	withPassword, err := kasa.TpLinkLoginWithOptions("user@example.org", "secret", &kasa.LoginOptions{
+		RefreshToken: "revoked",
+		BaseURL:      link.BaseURL(),
+	})
+	if err != nil || withPassword == nil {
+		t.Fatalf("login with a revoked refresh token and the password: %v", err)
+	}
+	noPassword, err := kasa.TpLinkLoginWithOptions("user@example.org", "", &kasa.LoginOptions{
+		RefreshToken: "revoked",
+		BaseURL:      link.BaseURL(),
+	})
+	if err == nil || noPassword != nil {
+		t.Errorf("login with a revoked refresh token only: %v, %v", noPassword, err)
+	}
+}
+
+func TestLoginFollowsRegion(t *testing.T) {
+	plug := kasatest.NewPlug("plug-1", "Fan", "HS100")
+	regional := kasatest.NewCloud("user@example.org", "secret", plug)
+	regionalSrv := regional.Start()
+	defer regionalSrv.Close()
+	var mu sync.Mutex
+	regionalMethods := []string{}
+	regional.OnRequest = func(method string, params map[string]interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		regionalMethods = append(regionalMethods, method)
+	}
+	global := kasatest.NewCloud("user@example.org", "secret")
+	global.AppServerURL = regionalSrv.URL
+	globalSrv := global.Start()
+	defer globalSrv.Close()
+	globalMethods := []string{}
+	global.OnRequest = func(method string, params map[string]interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		globalMethods = append(globalMethods, method)
+	}
+
+	link, err := kasa.TpLinkLoginWithOptions("user@example.org", "secret", &kasa.LoginOptions{BaseURL: globalSrv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.BaseURL() != regionalSrv.URL {
+		t.Errorf("session on %s, want the regional host %s", link.BaseURL(), regionalSrv.URL)
+	}
+	devices := link.DeviceList()
+	if len(devices) != 1 {
+		t.Fatalf("got %d devices from the regional host, want 1", len(devices))
+	}
+	if err = devices[0].TurnOn(); err != nil || !plug.IsOn() {
+		t.Errorf("turning the plug on through the regional host: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(globalMethods) != 1 || globalMethods[0] != "getAccountStatusAndUrl" {
+		t.Errorf("the global host got %v, want only the region lookup", globalMethods)
+	}
+	if len(regionalMethods) < 3 || regionalMethods[0] != "login" || regionalMethods[1] != "getDeviceList" {
+		t.Errorf("the regional host got %v, want the login, the device list and the passthrough", regionalMethods)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 func transcode(in, out interface{}) {
@@ -14,8 +15,34 @@ func transcode(in, out interface{}) {
 	json.NewDecoder(buf).Decode(out)
 }
 
+// methodResult digs the result of module.method out of a device response
+// and turns a non-zero err_code into a ModuleError.
+func methodResult(data map[string]interface{}, module string, method string) (map[string]interface{}, error) {
+	mod, ok := data[module].(map[string]interface{})
+	if !ok {
+		if code, ok := data["err_code"].(float64); ok && code != 0 {
+			msg, _ := data["err_msg"].(string)
+			return nil, &ModuleError{module, method, int(code), msg}
+		}
+		return nil, &ModuleError{module, method, -1, "module not supported"}
+	}
+	res, ok := mod[method].(map[string]interface{})
+	if !ok {
+		if code, ok := mod["err_code"].(float64); ok && code != 0 {
+			msg, _ := mod["err_msg"].(string)
+			return nil, &ModuleError{module, method, int(code), msg}
+		}
+		return nil, &ModuleError{module, method, -2, "method not supported"}
+	}
+	if code, ok := res["err_code"].(float64); ok && code != 0 {
+		msg, _ := res["err_msg"].(string)
+		return nil, &ModuleError{module, method, int(code), msg}
+	}
+	return res, nil
+}
+
 func baseRequest(link TPLink, requestBody map[string]interface{}) (interface{}, error) {
-	client := &http.Client{}
+	client := link.HTTPClient()
 	params := &url.Values{
 		"appName": {"Kasa_Android"},
 		"termId":  {link.TermId()},
@@ -31,7 +58,7 @@ func baseRequest(link TPLink, requestBody map[string]interface{}) (interface{},
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("POST", "https://wap.tplinkcloud.com/", bytes.NewBuffer(reqBody))
+	req, err := http.NewRequest("POST", strings.TrimSuffix(link.BaseURL(), "/")+"/", bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, err
 	}
@@ -53,7 +80,7 @@ func baseRequest(link TPLink, requestBody map[string]interface{}) (interface{},
 		return nil, err
 	}
 	if res.ErrorCode != 0 {
-		return nil, &LoginError{}
+		return nil, &CloudError{res.ErrorCode, res.Message}
 	}
 	return res.Result, nil
 }
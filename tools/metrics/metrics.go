@@ -0,0 +1,254 @@
+// Package metrics exports the devices and the cloud traffic of the tray
+// in the Prometheus text format.
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+// DefaultAddr is where /metrics is served unless configured otherwise.
+const DefaultAddr = "127.0.0.1:9273"
+
+// Upper bounds of the cloud latency histogram, in seconds.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	method  string
+	outcome string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Collector gathers what /metrics reports. The device gauges come from
+// what was last published to the hub, so a scrape never waits for a
+// device.
+type Collector struct {
+	Registry *kasa.Registry
+	Hub      *kasa.Hub
+
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	latencies map[string]*histogram
+	server    *http.Server
+}
+
+func NewCollector(hub *kasa.Hub) *Collector {
+	return &Collector{
+		Registry:  hub.Registry,
+		Hub:       hub,
+		requests:  map[requestKey]uint64{},
+		latencies: map[string]*histogram{},
+	}
+}
+
+// Transport wraps the cloud transport to count and time the requests.
+func (c *Collector) Transport(next http.RoundTripper) http.RoundTripper {
+	return kasa.NewObserver(next, c.observe)
+}
+
+func (c *Collector) observe(method string, outcome string, elapsed time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests[requestKey{method, outcome}]++
+	h := c.latencies[method]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		c.latencies[method] = h
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// ListenAndServe serves /metrics on addr. The metrics are read only, but
+// carry the device aliases, so prefer a loopback address.
+func (c *Collector) ListenAndServe(addr string) error {
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c)
+	c.server = &http.Server{Addr: addr, Handler: mux}
+	log.Printf("Metrics on http://%s/metrics\n", addr)
+	err := c.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (c *Collector) Close() error {
+	if c.server == nil {
+		return nil
+	}
+	return c.server.Close()
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
+
+// WriteTo writes every metric in the Prometheus text format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := &writer{}
+	c.writeDevices(out)
+	c.writeRequests(out)
+	n, err := io.WriteString(w, out.String())
+	return int64(n), err
+}
+
+type deviceMetric struct {
+	name  string
+	help  string
+	value func(device kasa.Device, state *kasa.DeviceState) (float64, bool)
+}
+
+var deviceMetrics = []*deviceMetric{
+	{"kasa_device_online", "Whether the device answered its last poll.", func(d kasa.Device, s *kasa.DeviceState) (float64, bool) {
+		return boolValue(s.Online), true
+	}},
+	{"kasa_device_on", "Whether the device is switched on.", func(d kasa.Device, s *kasa.DeviceState) (float64, bool) {
+		return boolValue(s.On), s.Online
+	}},
+	{"kasa_device_brightness_percent", "Brightness of dimmable devices.", func(d kasa.Device, s *kasa.DeviceState) (float64, bool) {
+		if s.Brightness == nil {
+			return 0, false
+		}
+		return float64(*s.Brightness), s.Online
+	}},
+	{"kasa_device_rssi_dbm", "Wi-Fi signal strength reported by the device.", func(d kasa.Device, s *kasa.DeviceState) (float64, bool) {
+		info := d.LastSysInfo()
+		if info == nil || info.RSSI == 0 {
+			return 0, false
+		}
+		return float64(info.RSSI), s.Online
+	}},
+	{"kasa_device_heap_bytes", "Free heap reported by the device.", func(d kasa.Device, s *kasa.DeviceState) (float64, bool) {
+		info := d.LastSysInfo()
+		if info == nil || info.HeapSize == 0 {
+			return 0, false
+		}
+		return float64(info.HeapSize), s.Online
+	}},
+}
+
+func (c *Collector) writeDevices(out *writer) {
+	devices := c.Registry.Devices()
+	states := map[string]*kasa.DeviceState{}
+	for _, device := range devices {
+		states[device.Id()] = c.Hub.State(device)
+	}
+	for _, metric := range deviceMetrics {
+		out.header(metric.name, "gauge", metric.help)
+		for _, device := range devices {
+			if value, ok := metric.value(device, states[device.Id()]); ok {
+				out.sample(metric.name, deviceLabels(device), value)
+			}
+		}
+	}
+	out.header("kasa_device_power_watts", "gauge", "Power draw from the last energy meter reading.")
+	for _, device := range devices {
+		if reading := c.Hub.Energy(device); reading != nil {
+			out.sample("kasa_device_power_watts", deviceLabels(device), reading.Power)
+		}
+	}
+	out.header("kasa_device_energy_kwh", "gauge", "Energy counted by the meter, since its reset on Kasa devices and this month on Tapo devices.")
+	for _, device := range devices {
+		if reading := c.Hub.Energy(device); reading != nil {
+			out.sample("kasa_device_energy_kwh", deviceLabels(device), reading.Total)
+		}
+	}
+}
+
+func (c *Collector) writeRequests(out *writer) {
+	keys := make([]requestKey, 0, len(c.requests))
+	for key := range c.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].outcome < keys[j].outcome
+	})
+	out.header("kasa_cloud_requests_total", "counter", "Cloud requests by method and outcome.")
+	for _, key := range keys {
+		out.sample("kasa_cloud_requests_total", [][2]string{{"method", key.method}, {"outcome", key.outcome}}, float64(c.requests[key]))
+	}
+
+	methods := make([]string, 0, len(c.latencies))
+	for method := range c.latencies {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	name := "kasa_cloud_request_duration_seconds"
+	out.header(name, "histogram", "Cloud request latency by method.")
+	for _, method := range methods {
+		h := c.latencies[method]
+		for i, bound := range latencyBuckets {
+			le := fmt.Sprint(bound)
+			out.sample(name+"_bucket", [][2]string{{"method", method}, {"le", le}}, float64(h.counts[i]))
+		}
+		out.sample(name+"_bucket", [][2]string{{"method", method}, {"le", "+Inf"}}, float64(h.count))
+		out.sample(name+"_sum", [][2]string{{"method", method}}, h.sum)
+		out.sample(name+"_count", [][2]string{{"method", method}}, float64(h.count))
+	}
+}
+
+func deviceLabels(device kasa.Device) [][2]string {
+	return [][2]string{
+		{"id", device.Id()},
+		{"alias", device.Alias()},
+		{"model", device.Model()},
+		{"firmware", device.FirmwareVersion()},
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// labelEscaper escapes a label value, only backslash, quote and newline
+// are special in the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type writer struct {
+	strings.Builder
+}
+
+func (w *writer) header(name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (w *writer) sample(name string, labels [][2]string, value float64) {
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label[0], labelEscaper.Replace(label[1])))
+	}
+	fmt.Fprintf(w, "%s{%s} %g\n", name, strings.Join(pairs, ","), value)
+}
@@ -0,0 +1,110 @@
+package metrics_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+	"github.com/tusharsrivastava/kasa-systray/tools/metrics"
+)
+
+// scrape returns the samples of /metrics by name and labels, e.g.
+// `kasa_device_on{id="plug-1",...}`.
+func scrape(t *testing.T, url string) map[string]string {
+	t.Helper()
+	res, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := map[string]string{}
+	for _, line := range strings.Split(string(body), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		samples[line[:i]] = line[i+1:]
+	}
+	return samples
+}
+
+// sample returns the value of the metric of a device, "" if there is none.
+func sample(samples map[string]string, name string, id string) string {
+	prefix := name + `{id="` + id + `",`
+	for key, value := range samples {
+		if strings.HasPrefix(key, prefix) {
+			return value
+		}
+	}
+	return ""
+}
+
+func TestMetrics(t *testing.T) {
+	bulb := kasatest.NewBulb("bulb-1", "Lamp", "KL130")
+	plug := kasatest.NewPlug("plug-1", "Fan", "HS110")
+	cloud := kasatest.NewCloud("user@example.org", "secret", bulb, plug)
+	cloudSrv := cloud.Start()
+	defer cloudSrv.Close()
+
+	registry := kasa.NewRegistry()
+	hub := kasa.NewHub(registry)
+	collector := metrics.NewCollector(hub)
+	link, err := kasa.TpLinkLoginWithOptions("user@example.org", "secret", &kasa.LoginOptions{
+		BaseURL:   cloudSrv.URL,
+		Transport: collector.Transport(nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.Set(link.DeviceList())
+	srv := httptest.NewServer(collector)
+	defer srv.Close()
+
+	samples := scrape(t, srv.URL)
+	if sample(samples, "kasa_device_online", "plug-1") != "1" || sample(samples, "kasa_device_on", "plug-1") != "0" {
+		t.Errorf("plug before the change: %v", samples)
+	}
+	if sample(samples, "kasa_device_brightness_percent", "bulb-1") == "" || sample(samples, "kasa_device_brightness_percent", "plug-1") != "" {
+		t.Errorf("brightness: %v", samples)
+	}
+	if sample(samples, "kasa_device_power_watts", "plug-1") != "" {
+		t.Error("power reported before a reading")
+	}
+	if samples[`kasa_cloud_request_duration_seconds_count{method="login"}`] != "1" {
+		t.Errorf("cloud requests: %v", samples)
+	}
+
+	device := registry.Find("plug-1")
+	hub.Publish(device)
+	plug.SetOn(true)
+	device.Sync()
+	// The gauges follow the hub, not the device.
+	if value := sample(scrape(t, srv.URL), "kasa_device_on", "plug-1"); value != "0" {
+		t.Errorf("plug on %s before the change was published", value)
+	}
+	hub.Publish(device)
+	hub.PublishEnergy(device, &kasa.EnergyReading{Power: 7.5, Total: 2.25})
+	samples = scrape(t, srv.URL)
+	if sample(samples, "kasa_device_on", "plug-1") != "1" {
+		t.Errorf("plug after the change: %v", samples)
+	}
+	if sample(samples, "kasa_device_power_watts", "plug-1") != "7.5" || sample(samples, "kasa_device_energy_kwh", "plug-1") != "2.25" {
+		t.Errorf("energy after the reading: %v", samples)
+	}
+
+	cloud.SetOffline("plug-1", true)
+	device.Sync()
+	hub.Publish(device)
+	samples = scrape(t, srv.URL)
+	if sample(samples, "kasa_device_online", "plug-1") != "0" || sample(samples, "kasa_device_on", "plug-1") != "" {
+		t.Errorf("offline plug: %v", samples)
+	}
+}
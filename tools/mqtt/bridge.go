@@ -0,0 +1,396 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+const (
+	DefaultPrefix          = "kasa"
+	DefaultDiscoveryPrefix = "homeassistant"
+	payloadOnline          = "online"
+	payloadOffline         = "offline"
+)
+
+// Bridge publishes the devices of a hub to MQTT and switches them on
+// the commands it receives, with Home Assistant discovery:
+//
+//	<prefix>/status               bridge availability, online/offline
+//	<prefix>/<id>/availability    device availability, online/offline
+//	<prefix>/<id>/state           {"state": "ON", "brightness": 80, ...}
+//	<prefix>/<id>/energy          {"power_w": 4.2, "total_kwh": 1.3}
+//	<prefix>/<id>/set             commands, JSON like state or ON/OFF
+//
+// Everything but the commands is retained.
+type Bridge struct {
+	Registry *kasa.Registry
+	// Hub feeds the state and energy topics and gets the changes the
+	// commands make.
+	Hub             *kasa.Hub
+	Prefix          string
+	DiscoveryPrefix string
+
+	opts   *Options
+	client *Client
+
+	mu sync.Mutex
+	// discovered holds the discovery topics published for the registry
+	// devices, to remove the configs of the devices that go away.
+	discovered map[string]bool
+}
+
+// lightState is the payload of the state and command topics, in the JSON
+// schema of the Home Assistant MQTT light. Brightness is 0-100, the
+// discovery config sets brightness_scale.
+type lightState struct {
+	State      string      `json:"state"`
+	Brightness *int        `json:"brightness,omitempty"`
+	ColorMode  string      `json:"color_mode,omitempty"`
+	ColorTemp  *int        `json:"color_temp,omitempty"`
+	Color      *colorState `json:"color,omitempty"`
+}
+
+type colorState struct {
+	H float64 `json:"h"`
+	S float64 `json:"s"`
+}
+
+type availability struct {
+	Topic string `json:"topic"`
+}
+
+type discoveryDevice struct {
+	Identifiers  []string   `json:"identifiers"`
+	Connections  [][]string `json:"connections,omitempty"`
+	Name         string     `json:"name"`
+	Manufacturer string     `json:"manufacturer"`
+	Model        string     `json:"model"`
+	SwVersion    string     `json:"sw_version,omitempty"`
+}
+
+// discoveryConfig covers the light, switch and sensor components, empty
+// fields are left out.
+type discoveryConfig struct {
+	Name                string           `json:"name"`
+	UniqueId            string           `json:"unique_id"`
+	Schema              string           `json:"schema,omitempty"`
+	StateTopic          string           `json:"state_topic"`
+	CommandTopic        string           `json:"command_topic,omitempty"`
+	Availability        []*availability  `json:"availability"`
+	AvailabilityMode    string           `json:"availability_mode"`
+	Brightness          bool             `json:"brightness,omitempty"`
+	BrightnessScale     int              `json:"brightness_scale,omitempty"`
+	SupportedColorModes []string         `json:"supported_color_modes,omitempty"`
+	MinMireds           int              `json:"min_mireds,omitempty"`
+	MaxMireds           int              `json:"max_mireds,omitempty"`
+	PayloadOn           string           `json:"payload_on,omitempty"`
+	PayloadOff          string           `json:"payload_off,omitempty"`
+	StateOn             string           `json:"state_on,omitempty"`
+	StateOff            string           `json:"state_off,omitempty"`
+	ValueTemplate       string           `json:"value_template,omitempty"`
+	DeviceClass         string           `json:"device_class,omitempty"`
+	StateClass          string           `json:"state_class,omitempty"`
+	UnitOfMeasurement   string           `json:"unit_of_measurement,omitempty"`
+	Device              *discoveryDevice `json:"device"`
+}
+
+func NewBridge(hub *kasa.Hub, opts *Options) *Bridge {
+	return &Bridge{
+		Registry:        hub.Registry,
+		Hub:             hub,
+		Prefix:          DefaultPrefix,
+		DiscoveryPrefix: DefaultDiscoveryPrefix,
+		opts:            opts,
+	}
+}
+
+// Run connects to the broker and serves the bridge until ctx ends.
+func (b *Bridge) Run(ctx context.Context) error {
+	if b.opts.ClientID == "" {
+		// Brokers drop the older of two connections with the same id, so
+		// the tray and the headless bridge must not share one.
+		suffix := make([]byte, 4)
+		rand.Read(suffix)
+		b.opts.ClientID = fmt.Sprintf("kasa-systray-%s-%x", b.Prefix, suffix)
+	}
+	b.opts.Will = &Message{Topic: b.statusTopic(), Payload: []byte(payloadOffline), Retain: true}
+	b.opts.OnConnect = b.connected
+	client := NewClient(b.opts)
+	client.Subscribe(b.Prefix+"/+/set", b.command)
+	b.mu.Lock()
+	b.client = client
+	b.mu.Unlock()
+	_, changes := b.Hub.Subscribe(16)
+	defer b.Hub.Unsubscribe(changes)
+	go b.watch(ctx, changes)
+	return client.Run(ctx)
+}
+
+// watch publishes the changes of the hub until ctx ends. What happens
+// while the broker is away is published again by connected.
+func (b *Bridge) watch(ctx context.Context, changes chan *kasa.Change) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-changes:
+			if !kasa.CanControl(change.Device) {
+				continue
+			}
+			if change.Type == kasa.ChangeEnergy {
+				b.publishEnergy(change.Device, change.Energy)
+			} else {
+				b.publishState(change.Device, change.State)
+			}
+		}
+	}
+}
+
+// connected announces the bridge and republishes everything, the broker
+// may have lost its retained messages.
+func (b *Bridge) connected(client *Client) {
+	b.publish(b.statusTopic(), payloadOnline)
+	b.Refresh()
+}
+
+// Refresh publishes the discovery configs, state and energy of the
+// registry devices and removes the configs of the devices that are gone,
+// e.g. after a new login replaced them.
+func (b *Bridge) Refresh() {
+	topics := map[string]bool{}
+	for _, device := range b.Registry.Devices() {
+		if !kasa.CanControl(device) {
+			continue
+		}
+		for _, topic := range b.discover(device) {
+			topics[topic] = true
+		}
+		b.publishState(device, b.Hub.State(device))
+		if reading := b.Hub.Energy(device); reading != nil {
+			b.publishEnergy(device, reading)
+		}
+	}
+	b.mu.Lock()
+	gone := []string{}
+	for topic := range b.discovered {
+		if !topics[topic] {
+			gone = append(gone, topic)
+		}
+	}
+	b.discovered = topics
+	b.mu.Unlock()
+	for _, topic := range gone {
+		// An empty retained config removes the entity.
+		b.publish(topic, "")
+	}
+}
+
+// publishState publishes the availability and state of device.
+func (b *Bridge) publishState(device kasa.Device, state *kasa.DeviceState) {
+	availability := payloadOffline
+	if state.Online {
+		availability = payloadOnline
+	}
+	b.publish(b.deviceTopic(state.Id, "availability"), availability)
+	if !state.Online {
+		return
+	}
+	payload := &lightState{State: "OFF", Brightness: state.Brightness}
+	if state.On {
+		payload.State = "ON"
+	}
+	caps := device.Capabilities()
+	if color := kasa.ColorOf(device); color != nil && (caps.Color || caps.ColorTemp != nil) {
+		if color.ColorTemp > 0 && caps.ColorTemp != nil {
+			mireds := 1000000 / color.ColorTemp
+			payload.ColorMode = "color_temp"
+			payload.ColorTemp = &mireds
+		} else if caps.Color {
+			payload.ColorMode = "hs"
+			payload.Color = &colorState{float64(color.Hue), float64(color.Saturation)}
+		}
+	}
+	b.publishJSON(b.deviceTopic(state.Id, "state"), payload)
+}
+
+// publishEnergy publishes an energy meter reading of device.
+func (b *Bridge) publishEnergy(device kasa.Device, reading *kasa.EnergyReading) {
+	b.publishJSON(b.deviceTopic(device.Id(), "energy"), reading)
+}
+
+// discover publishes the Home Assistant discovery configs of device: a
+// light for dimmable devices, a switch otherwise, and power and energy
+// sensors for devices with an energy meter. It returns their topics.
+func (b *Bridge) discover(device kasa.Device) []string {
+	caps := device.Capabilities()
+	id := strings.ToLower(device.Id())
+	haDevice := &discoveryDevice{
+		Identifiers:  []string{"kasa_" + id},
+		Name:         device.Alias(),
+		Manufacturer: "TP-Link",
+		Model:        device.Model(),
+		SwVersion:    device.FirmwareVersion(),
+	}
+	if mac := device.Mac(); mac != "" {
+		haDevice.Connections = [][]string{{"mac", mac}}
+	}
+	availability := []*availability{
+		{Topic: b.statusTopic()},
+		{Topic: b.deviceTopic(device.Id(), "availability")},
+	}
+	config := &discoveryConfig{
+		Name:             device.Alias(),
+		UniqueId:         "kasa_" + id,
+		StateTopic:       b.deviceTopic(device.Id(), "state"),
+		CommandTopic:     b.deviceTopic(device.Id(), "set"),
+		Availability:     availability,
+		AvailabilityMode: "all",
+		Device:           haDevice,
+	}
+	component := "switch"
+	if caps.Dimmable {
+		component = "light"
+		config.Schema = "json"
+		config.Brightness = true
+		config.BrightnessScale = 100
+		config.SupportedColorModes = colorModes(caps)
+		if caps.ColorTemp != nil {
+			config.MinMireds = 1000000 / caps.ColorTemp.Max
+			config.MaxMireds = 1000000 / caps.ColorTemp.Min
+		}
+	} else {
+		config.PayloadOn = "ON"
+		config.PayloadOff = "OFF"
+		config.StateOn = "ON"
+		config.StateOff = "OFF"
+		config.ValueTemplate = "{{ value_json.state }}"
+	}
+	topics := []string{b.discoveryTopic(component, id)}
+	b.publishJSON(topics[0], config)
+
+	if !caps.Emeter {
+		return topics
+	}
+	for _, sensor := range []struct{ key, name, class, stateClass, unit string }{
+		{"power_w", "Power", "power", "measurement", "W"},
+		{"total_kwh", "Energy", "energy", "total_increasing", "kWh"},
+	} {
+		topic := b.discoveryTopic("sensor", id+"_"+sensor.key)
+		topics = append(topics, topic)
+		b.publishJSON(topic, &discoveryConfig{
+			Name:              fmt.Sprintf("%s %s", device.Alias(), sensor.name),
+			UniqueId:          fmt.Sprintf("kasa_%s_%s", id, sensor.key),
+			StateTopic:        b.deviceTopic(device.Id(), "energy"),
+			Availability:      availability,
+			AvailabilityMode:  "all",
+			ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", sensor.key),
+			DeviceClass:       sensor.class,
+			StateClass:        sensor.stateClass,
+			UnitOfMeasurement: sensor.unit,
+			Device:            haDevice,
+		})
+	}
+	return topics
+}
+
+func colorModes(caps *kasa.Capabilities) []string {
+	modes := []string{}
+	if caps.Color {
+		modes = append(modes, "hs")
+	}
+	if caps.ColorTemp != nil {
+		modes = append(modes, "color_temp")
+	}
+	if len(modes) == 0 {
+		modes = append(modes, "brightness")
+	}
+	return modes
+}
+
+// command handles a message on <prefix>/<id>/set. It runs the device
+// calls on its own goroutine to keep the connection serviced meanwhile.
+func (b *Bridge) command(msg *Message) {
+	parts := strings.Split(msg.Topic, "/")
+	device := b.Registry.Find(parts[len(parts)-2])
+	if device == nil {
+		log.Printf("MQTT command for unknown device %s\n", msg.Topic)
+		return
+	}
+	cmd := &lightState{}
+	payload := strings.TrimSpace(string(msg.Payload))
+	if err := json.Unmarshal([]byte(payload), cmd); err != nil {
+		cmd.State = payload
+	}
+	go func() {
+		if err := b.apply(device, cmd); err != nil {
+			log.Printf("MQTT command for %s failed: %s\n", device.Alias(), err)
+		}
+		b.Hub.Publish(device)
+	}()
+}
+
+func (b *Bridge) apply(device kasa.Device, cmd *lightState) error {
+	switch strings.ToUpper(cmd.State) {
+	case "OFF":
+		return device.TurnOff()
+	case "ON", "":
+	default:
+		return fmt.Errorf("unknown state %q", cmd.State)
+	}
+	// The color goes with the brightness in a single transition.
+	var color *kasa.LightColor
+	if cmd.Color != nil {
+		color = &kasa.LightColor{Hue: int(cmd.Color.H), Saturation: int(cmd.Color.S)}
+	} else if cmd.ColorTemp != nil && *cmd.ColorTemp > 0 {
+		color = &kasa.LightColor{ColorTemp: 1000000 / *cmd.ColorTemp}
+	}
+	switch {
+	case color != nil:
+		return kasa.SetLightColor(device, color, cmd.Brightness)
+	case cmd.Brightness != nil:
+		return device.SetBrightness(*cmd.Brightness)
+	}
+	return device.TurnOn()
+}
+
+func (b *Bridge) statusTopic() string {
+	return b.Prefix + "/status"
+}
+
+func (b *Bridge) deviceTopic(id string, name string) string {
+	return fmt.Sprintf("%s/%s/%s", b.Prefix, id, name)
+}
+
+func (b *Bridge) discoveryTopic(component string, objectId string) string {
+	return fmt.Sprintf("%s/%s/%s/config", b.DiscoveryPrefix, component, objectId)
+}
+
+func (b *Bridge) publishJSON(topic string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b.publish(topic, string(data))
+}
+
+// publish sends a retained message.
+func (b *Bridge) publish(topic string, payload string) {
+	b.mu.Lock()
+	client := b.client
+	b.mu.Unlock()
+	if client == nil {
+		return
+	}
+	err := client.Publish(&Message{Topic: topic, Payload: []byte(payload), Retain: true})
+	if err != nil && err != ErrNotConnected {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,173 @@
+package mqtt_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+	"github.com/tusharsrivastava/kasa-systray/tools/mqtt"
+	"github.com/tusharsrivastava/kasa-systray/tools/mqtt/mqtttest"
+)
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// retainedJSON waits for a retained message on topic and decodes it.
+func retainedJSON(t *testing.T, broker *mqtttest.Broker, topic string, cond func(v map[string]interface{}) bool) map[string]interface{} {
+	t.Helper()
+	var v map[string]interface{}
+	waitFor(t, topic, func() bool {
+		msg := broker.Retained(topic)
+		v = map[string]interface{}{}
+		return msg != nil && json.Unmarshal(msg.Payload, &v) == nil && cond(v)
+	})
+	return v
+}
+
+func anyConfig(v map[string]interface{}) bool {
+	return true
+}
+
+func TestBridge(t *testing.T) {
+	bulb := kasatest.NewBulb("bulb-1", "Lamp", "KL130")
+	plug := kasatest.NewPlug("plug-1", "Fan", "HS110")
+	cloud := kasatest.NewCloud("user@example.org", "secret", bulb, plug)
+	var mu sync.Mutex
+	transitions := 0
+	cloud.OnRequest = func(method string, params map[string]interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		if data, _ := params["requestData"].(string); strings.Contains(data, "transition_light_state") {
+			transitions++
+		}
+	}
+	cloudSrv := cloud.Start()
+	defer cloudSrv.Close()
+	link, err := kasa.TpLinkLoginWithOptions("user@example.org", "secret", &kasa.LoginOptions{BaseURL: cloudSrv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := kasa.NewRegistry()
+	registry.Set(link.DeviceList())
+	hub := kasa.NewHub(registry)
+
+	broker, err := mqtttest.NewBroker("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	status := make(chan string, 16)
+	broker.OnPublish = func(msg *mqtt.Message) {
+		if msg.Topic == "kasa/status" {
+			status <- string(msg.Payload)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bridge := mqtt.NewBridge(hub, &mqtt.Options{Broker: broker.Addr()})
+	done := make(chan error, 1)
+	go func() { done <- bridge.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	expectStatus := func(want string) {
+		t.Helper()
+		select {
+		case got := <-status:
+			if got != want {
+				t.Fatalf("bridge status %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the bridge status %q", want)
+		}
+	}
+	expectStatus("online")
+
+	light := retainedJSON(t, broker, "homeassistant/light/bulb-1/config", anyConfig)
+	if light["brightness"] != true || light["command_topic"] != "kasa/bulb-1/set" {
+		t.Errorf("light config %v", light)
+	}
+	retainedJSON(t, broker, "homeassistant/switch/plug-1/config", anyConfig)
+	power := retainedJSON(t, broker, "homeassistant/sensor/plug-1_power_w/config", anyConfig)
+	if power["state_topic"] != "kasa/plug-1/energy" {
+		t.Errorf("power sensor config %v", power)
+	}
+	retainedJSON(t, broker, "kasa/plug-1/state", func(v map[string]interface{}) bool {
+		return v["state"] == "OFF"
+	})
+
+	broker.Publish(&mqtt.Message{Topic: "kasa/plug-1/set", Payload: []byte("ON")})
+	retainedJSON(t, broker, "kasa/plug-1/state", func(v map[string]interface{}) bool {
+		return v["state"] == "ON"
+	})
+	if !plug.IsOn() {
+		t.Error("the ON command did not switch the plug")
+	}
+	broker.Publish(&mqtt.Message{Topic: "kasa/bulb-1/set", Payload: []byte(`{"state": "ON", "brightness": 40}`)})
+	retainedJSON(t, broker, "kasa/bulb-1/state", func(v map[string]interface{}) bool {
+		return v["state"] == "ON" && v["brightness"] == 40.0
+	})
+	mu.Lock()
+	transitions = 0
+	mu.Unlock()
+	broker.Publish(&mqtt.Message{Topic: "kasa/bulb-1/set", Payload: []byte(`{"state": "ON", "color_temp": 250, "brightness": 60}`)})
+	retainedJSON(t, broker, "kasa/bulb-1/state", func(v map[string]interface{}) bool {
+		return v["brightness"] == 60.0 && v["color_temp"] == 250.0
+	})
+	mu.Lock()
+	if transitions != 1 {
+		t.Errorf("color and brightness took %d transitions, want 1", transitions)
+	}
+	mu.Unlock()
+
+	// Changes made through another front end reach the broker via the hub.
+	device := registry.Find("plug-1")
+	plug.SetOn(false)
+	device.Sync()
+	hub.Publish(device)
+	retainedJSON(t, broker, "kasa/plug-1/state", func(v map[string]interface{}) bool {
+		return v["state"] == "OFF"
+	})
+	hub.PublishEnergy(device, &kasa.EnergyReading{Power: 7.5, Total: 2})
+	retainedJSON(t, broker, "kasa/plug-1/energy", func(v map[string]interface{}) bool {
+		return v["power_w"] == 7.5
+	})
+
+	// A new login without the plug removes its entities.
+	registry.Set([]kasa.Device{registry.Find("bulb-1")})
+	bridge.Refresh()
+	waitFor(t, "the plug configs to be removed", func() bool {
+		return broker.Retained("homeassistant/switch/plug-1/config") == nil && broker.Retained("homeassistant/sensor/plug-1_total_kwh/config") == nil
+	})
+	registry.Set([]kasa.Device{registry.Find("bulb-1"), device})
+	bridge.Refresh()
+	retainedJSON(t, broker, "homeassistant/switch/plug-1/config", anyConfig)
+
+	cloud.SetOffline("bulb-1", true)
+	registry.Find("bulb-1").Sync()
+	hub.Publish(registry.Find("bulb-1"))
+	waitFor(t, "the bulb to be unavailable", func() bool {
+		msg := broker.Retained("kasa/bulb-1/availability")
+		return msg != nil && string(msg.Payload) == "offline"
+	})
+
+	broker.Disconnect()
+	expectStatus("offline")
+	expectStatus("online")
+}
@@ -0,0 +1,283 @@
+// Package mqtt bridges the devices to an MQTT broker for Home Assistant.
+// It carries its own MQTT 3.1.1 client, limited to what the bridge needs:
+// QoS 0, retained messages and a last will.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultKeepAlive = 30 * time.Second
+	dialTimeout      = 10 * time.Second
+	minBackoff       = time.Second
+	maxBackoff       = time.Minute
+)
+
+var ErrNotConnected = errors.New("mqtt: not connected")
+
+// Options configure a Client. Broker is host:port, optionally as a
+// tcp:// or mqtt:// URL.
+type Options struct {
+	Broker    string
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	// Will is published by the broker when the connection is lost.
+	Will *Message
+	// OnConnect is called after every (re)connection, once the
+	// subscriptions are sent.
+	OnConnect func(client *Client)
+}
+
+type subscription struct {
+	filter  string
+	handler func(msg *Message)
+}
+
+// Client keeps a connection to the broker, reconnecting with backoff until
+// its context ends.
+type Client struct {
+	opts *Options
+
+	mu            sync.Mutex
+	conn          net.Conn
+	subscriptions []*subscription
+	packetID      uint16
+}
+
+func NewClient(opts *Options) *Client {
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = DefaultKeepAlive
+	}
+	return &Client{opts: opts}
+}
+
+// Subscribe registers handler for the topics matching filter. The
+// subscription is renewed on every reconnection.
+func (c *Client) Subscribe(filter string, handler func(msg *Message)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscriptions = append(c.subscriptions, &subscription{filter, handler})
+	if c.conn == nil {
+		return nil
+	}
+	return c.write(SubscribePacket(c.nextID(), []string{filter}))
+}
+
+func (c *Client) Publish(msg *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	return c.write(PublishPacket(msg))
+}
+
+// Run connects and serves the connection until ctx ends, reconnecting
+// whenever it is lost. It returns the context error, or the broker refusal
+// of the first connection.
+func (c *Client) Run(ctx context.Context) error {
+	backoff := minBackoff
+	first := true
+	for {
+		connected, err := c.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var refused *RefusedError
+		if first && errors.As(err, &refused) {
+			return err
+		}
+		if connected {
+			backoff = minBackoff
+		}
+		first = false
+		log.Printf("MQTT connection to %s lost: %s, retrying in %s\n", c.opts.Broker, err, backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// RefusedError is a CONNACK with an error return code, e.g. 5 for bad
+// credentials.
+type RefusedError struct {
+	Code byte
+}
+
+func (e *RefusedError) Error() string {
+	return fmt.Sprintf("mqtt: connection refused with code %d", e.Code)
+}
+
+// session runs a single connection and reports whether it was
+// established before it broke.
+func (c *Client) session(ctx context.Context) (bool, error) {
+	conn, reader, err := c.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	c.mu.Lock()
+	c.conn = conn
+	filters := []string{}
+	for _, sub := range c.subscriptions {
+		filters = append(filters, sub.filter)
+	}
+	if len(filters) > 0 {
+		err = c.write(SubscribePacket(c.nextID(), filters))
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+	}()
+	if err != nil {
+		return true, err
+	}
+	log.Printf("Connected to MQTT broker %s\n", c.opts.Broker)
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect(c)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go c.keepAlive(ctx, conn, done)
+	for {
+		conn.SetReadDeadline(time.Now().Add(c.opts.KeepAlive * 3 / 2))
+		packet, err := ReadPacket(reader)
+		if err != nil {
+			return true, err
+		}
+		if packet.Type != TypePublish {
+			continue
+		}
+		msg, err := packet.Publish()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		c.dispatch(msg)
+	}
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, *bufio.Reader, error) {
+	addr := c.opts.Broker
+	if u, err := url.Parse(addr); err == nil && u.Host != "" {
+		addr = u.Host
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "1883")
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	connect := &Connect{
+		ClientID:  c.opts.ClientID,
+		Username:  c.opts.Username,
+		Password:  c.opts.Password,
+		KeepAlive: uint16(c.opts.KeepAlive / time.Second),
+		Will:      c.opts.Will,
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if _, err = connect.Packet().WriteTo(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	packet, err := ReadPacket(reader)
+	if err == nil && packet.Type != TypeConnack {
+		err = fmt.Errorf("mqtt: expected CONNACK, got packet type %d", packet.Type)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	code, err := packet.ConnackCode()
+	if err == nil && code != ConnackAccepted {
+		err = &RefusedError{code}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reader, nil
+}
+
+// keepAlive pings the broker and closes the connection when ctx ends, so
+// that the read loop returns. The broker drops the will on a clean
+// disconnect, so it is published here instead.
+func (c *Client) keepAlive(ctx context.Context, conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(c.opts.KeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			c.mu.Lock()
+			if c.opts.Will != nil {
+				c.write(PublishPacket(c.opts.Will))
+			}
+			c.write(&Packet{Type: TypeDisconnect})
+			c.mu.Unlock()
+			conn.Close()
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			c.write(&Packet{Type: TypePingreq})
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *Client) dispatch(msg *Message) {
+	c.mu.Lock()
+	handlers := []func(*Message){}
+	for _, sub := range c.subscriptions {
+		if Match(sub.filter, msg.Topic) {
+			handlers = append(handlers, sub.handler)
+		}
+	}
+	c.mu.Unlock()
+	for _, handler := range handlers {
+		handler(msg)
+	}
+}
+
+// write sends a packet, c.mu must be held.
+func (c *Client) write(packet *Packet) error {
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(dialTimeout))
+	_, err := packet.WriteTo(c.conn)
+	return err
+}
+
+func (c *Client) nextID() uint16 {
+	c.packetID++
+	if c.packetID == 0 {
+		c.packetID = 1
+	}
+	return c.packetID
+}
@@ -0,0 +1,188 @@
+// Package mqtttest runs an in-process MQTT broker, enough to try the
+// bridge without Mosquitto: QoS 0, retained messages and last wills.
+package mqtttest
+
+import (
+	"bufio"
+	"net"
+	"sync"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/mqtt"
+)
+
+// Broker accepts MQTT 3.1.1 clients on a local port.
+type Broker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	sessions map[*session]bool
+	retained map[string]*mqtt.Message
+	// OnPublish, if set, sees every message published to the broker.
+	OnPublish func(msg *mqtt.Message)
+}
+
+type session struct {
+	conn    net.Conn
+	filters []string
+	will    *mqtt.Message
+	mu      sync.Mutex
+}
+
+// NewBroker listens on addr, "127.0.0.1:0" picks a free port.
+func NewBroker(addr string) (*Broker, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{
+		listener: listener,
+		sessions: map[*session]bool{},
+		retained: map[string]*mqtt.Message{},
+	}
+	go b.accept()
+	return b, nil
+}
+
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *Broker) Close() error {
+	err := b.listener.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.sessions {
+		s.conn.Close()
+	}
+	return err
+}
+
+// Retained returns the retained message of topic, nil if there is none.
+func (b *Broker) Retained(topic string) *mqtt.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.retained[topic]
+}
+
+// Publish sends msg to the subscribers as if a client published it.
+func (b *Broker) Publish(msg *mqtt.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.route(msg)
+}
+
+// Disconnect drops every client without a DISCONNECT, so their wills are
+// published, as if the network went away.
+func (b *Broker) Disconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.sessions {
+		s.conn.Close()
+	}
+}
+
+func (b *Broker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(conn)
+	}
+}
+
+func (b *Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	packet, err := mqtt.ReadPacket(reader)
+	if err != nil || packet.Type != mqtt.TypeConnect {
+		return
+	}
+	connect, err := packet.Connect()
+	if err != nil {
+		return
+	}
+	s := &session{conn: conn, will: connect.Will}
+	s.write(mqtt.ConnackPacket(mqtt.ConnackAccepted))
+	b.mu.Lock()
+	b.sessions[s] = true
+	b.mu.Unlock()
+
+	for {
+		packet, err := mqtt.ReadPacket(reader)
+		if err != nil {
+			break
+		}
+		switch packet.Type {
+		case mqtt.TypePublish:
+			msg, err := packet.Publish()
+			if err == nil {
+				b.Publish(msg)
+			}
+		case mqtt.TypeSubscribe:
+			id, filters, err := packet.Subscribe()
+			if err != nil {
+				break
+			}
+			s.write(mqtt.SubackPacket(id, len(filters)))
+			b.subscribe(s, filters)
+		case mqtt.TypePingreq:
+			s.write(&mqtt.Packet{Type: mqtt.TypePingresp})
+		case mqtt.TypeDisconnect:
+			s.will = nil
+		}
+		if packet.Type == mqtt.TypeDisconnect {
+			break
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.sessions, s)
+	if s.will != nil {
+		b.route(s.will)
+	}
+}
+
+func (b *Broker) subscribe(s *session, filters []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s.filters = append(s.filters, filters...)
+	for _, filter := range filters {
+		for topic, msg := range b.retained {
+			if mqtt.Match(filter, topic) {
+				s.write(mqtt.PublishPacket(msg))
+			}
+		}
+	}
+}
+
+// route delivers msg and keeps it if it is retained, b.mu must be held.
+func (b *Broker) route(msg *mqtt.Message) {
+	if b.OnPublish != nil {
+		b.OnPublish(msg)
+	}
+	if msg.Retain {
+		if len(msg.Payload) == 0 {
+			delete(b.retained, msg.Topic)
+		} else {
+			b.retained[msg.Topic] = msg
+		}
+	}
+	// Subscribers get the message live, retained is only for new ones.
+	live := &mqtt.Message{Topic: msg.Topic, Payload: msg.Payload}
+	for s := range b.sessions {
+		for _, filter := range s.filters {
+			if mqtt.Match(filter, msg.Topic) {
+				s.write(mqtt.PublishPacket(live))
+				break
+			}
+		}
+	}
+}
+
+func (s *session) write(packet *mqtt.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	packet.WriteTo(s.conn)
+}
@@ -0,0 +1,298 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Control packet types of MQTT 3.1.1.
+const (
+	TypeConnect    = 1
+	TypeConnack    = 2
+	TypePublish    = 3
+	TypeSubscribe  = 8
+	TypeSuback     = 9
+	TypePingreq    = 12
+	TypePingresp   = 13
+	TypeDisconnect = 14
+)
+
+const (
+	flagRetain       = 0x01
+	flagSubscribe    = 0x02
+	connectCleanFlag = 0x02
+	connectWillFlag  = 0x04
+	connectWillRetn  = 0x20
+	connectPassFlag  = 0x40
+	connectUserFlag  = 0x80
+	protocolLevel    = 4
+	maxRemaining     = 268435455
+)
+
+// ConnackAccepted is the CONNACK return code of a successful connection.
+const ConnackAccepted = 0
+
+var errMalformed = errors.New("mqtt: malformed packet")
+
+// Message is an application message. Only QoS 0 is supported.
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// Connect is the content of a CONNECT packet.
+type Connect struct {
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive uint16
+	Will      *Message
+}
+
+// Packet is a control packet whose variable header and payload are still
+// encoded in Body.
+type Packet struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+func ReadPacket(r *bufio.Reader) (*Packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return nil, errMalformed
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &Packet{Type: header >> 4, Flags: header & 0x0f, Body: body}, nil
+}
+
+func (p *Packet) WriteTo(w io.Writer) (int64, error) {
+	if len(p.Body) > maxRemaining {
+		return 0, fmt.Errorf("mqtt: packet of %d bytes is too large", len(p.Body))
+	}
+	buf := []byte{p.Type<<4 | p.Flags}
+	length := len(p.Body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+	n, err := w.Write(append(buf, p.Body...))
+	return int64(n), err
+}
+
+func (c *Connect) Packet() *Packet {
+	flags := byte(connectCleanFlag)
+	body := appendString(nil, "MQTT")
+	body = append(body, protocolLevel, 0)
+	body = appendUint16(body, c.KeepAlive)
+	body = appendString(body, c.ClientID)
+	if c.Will != nil {
+		flags |= connectWillFlag
+		if c.Will.Retain {
+			flags |= connectWillRetn
+		}
+		body = appendString(body, c.Will.Topic)
+		body = appendBytes(body, c.Will.Payload)
+	}
+	if c.Username != "" {
+		flags |= connectUserFlag
+		body = appendString(body, c.Username)
+		if c.Password != "" {
+			flags |= connectPassFlag
+			body = appendString(body, c.Password)
+		}
+	}
+	body[7] = flags
+	return &Packet{Type: TypeConnect, Body: body}
+}
+
+// Connect decodes a CONNECT packet.
+func (p *Packet) Connect() (*Connect, error) {
+	d := &decoder{data: p.Body}
+	if name := d.string(); name != "MQTT" {
+		return nil, fmt.Errorf("mqtt: unsupported protocol %q", name)
+	}
+	if level := d.byte(); level != protocolLevel {
+		return nil, fmt.Errorf("mqtt: unsupported protocol level %d", level)
+	}
+	flags := d.byte()
+	c := &Connect{KeepAlive: d.uint16(), ClientID: d.string()}
+	if flags&connectWillFlag != 0 {
+		c.Will = &Message{Topic: d.string(), Payload: d.bytes(), Retain: flags&connectWillRetn != 0}
+	}
+	if flags&connectUserFlag != 0 {
+		c.Username = d.string()
+	}
+	if flags&connectPassFlag != 0 {
+		c.Password = d.string()
+	}
+	return c, d.err
+}
+
+func ConnackPacket(code byte) *Packet {
+	return &Packet{Type: TypeConnack, Body: []byte{0, code}}
+}
+
+// ConnackCode returns the return code of a CONNACK packet.
+func (p *Packet) ConnackCode() (byte, error) {
+	if len(p.Body) != 2 {
+		return 0, errMalformed
+	}
+	return p.Body[1], nil
+}
+
+func PublishPacket(msg *Message) *Packet {
+	p := &Packet{Type: TypePublish, Body: appendString(nil, msg.Topic)}
+	if msg.Retain {
+		p.Flags |= flagRetain
+	}
+	p.Body = append(p.Body, msg.Payload...)
+	return p
+}
+
+// Publish decodes a PUBLISH packet. Packets with a QoS above 0 are
+// rejected, the bridge never subscribes with one.
+func (p *Packet) Publish() (*Message, error) {
+	if p.Flags&0x06 != 0 {
+		return nil, errors.New("mqtt: only QoS 0 is supported")
+	}
+	d := &decoder{data: p.Body}
+	msg := &Message{Topic: d.string(), Retain: p.Flags&flagRetain != 0}
+	msg.Payload = d.rest()
+	return msg, d.err
+}
+
+func SubscribePacket(id uint16, filters []string) *Packet {
+	body := appendUint16(nil, id)
+	for _, filter := range filters {
+		body = append(appendString(body, filter), 0)
+	}
+	return &Packet{Type: TypeSubscribe, Flags: flagSubscribe, Body: body}
+}
+
+// Subscribe decodes a SUBSCRIBE packet into its id and topic filters.
+func (p *Packet) Subscribe() (uint16, []string, error) {
+	d := &decoder{data: p.Body}
+	id := d.uint16()
+	filters := []string{}
+	for d.err == nil && len(d.data) > 0 {
+		filters = append(filters, d.string())
+		d.byte()
+	}
+	if len(filters) == 0 && d.err == nil {
+		d.err = errMalformed
+	}
+	return id, filters, d.err
+}
+
+// SubackPacket grants QoS 0 to count subscriptions.
+func SubackPacket(id uint16, count int) *Packet {
+	body := appendUint16(nil, id)
+	body = append(body, make([]byte, count)...)
+	return &Packet{Type: TypeSuback, Body: body}
+}
+
+// Match reports whether topic matches filter, with the + and # wildcards.
+func Match(filter string, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+	for i, part := range filterParts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(topicParts) {
+			return false
+		}
+		if part != "+" && part != topicParts[i] {
+			return false
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendBytes(buf []byte, data []byte) []byte {
+	return append(appendUint16(buf, uint16(len(data))), data...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	return appendBytes(buf, []byte(s))
+}
+
+// decoder reads the fields of a packet body, remembering the first error
+// so that callers check once at the end.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || len(d.data) < n {
+		d.err = errMalformed
+		return nil
+	}
+	out := d.data[:n]
+	d.data = d.data[n:]
+	return out
+}
+
+func (d *decoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) bytes() []byte {
+	return append([]byte{}, d.take(int(d.uint16()))...)
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) rest() []byte {
+	out := append([]byte{}, d.data...)
+	d.data = nil
+	return out
+}
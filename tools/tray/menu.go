@@ -0,0 +1,91 @@
+package tray
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+)
+
+// menuState is what the menu of a device shows. It is worked out apart
+// from the systray items, which only exist once the tray runs.
+type menuState struct {
+	title      string
+	canTurnOn  bool
+	canTurnOff bool
+	circadian  bool
+}
+
+func menuStateOf(device kasa.Device) *menuState {
+	title := deviceTitle(device)
+	if device.SyncError() != nil {
+		title += " (offline)"
+	}
+	return &menuState{
+		title:      title,
+		canTurnOn:  !device.IsConnected(),
+		canTurnOff: !device.IsDisconnected(),
+		circadian:  device.Mode() == kasa.ModeCircadian,
+	}
+}
+
+// shownDevices returns the devices that get a menu, the ones that can be
+// controlled.
+func shownDevices(devices []kasa.Device) []kasa.Device {
+	shown := []kasa.Device{}
+	for _, device := range devices {
+		log.Println(device.HumanName())
+		if !kasa.CanControl(device) {
+			log.Printf("Hiding %s, it cannot be controlled\n", device.Alias())
+			continue
+		}
+		shown = append(shown, device)
+	}
+	return shown
+}
+
+func deviceTitle(device kasa.Device) string {
+	if kasa.IsShared(device) {
+		return device.HumanName() + " (shared)"
+	}
+	return device.HumanName()
+}
+
+func deviceInfoText(device kasa.Device) string {
+	lines := []string{
+		fmt.Sprintf("Name: %s", deviceTitle(device)),
+		fmt.Sprintf("Model: %s (%s)", device.Model(), device.Type()),
+		fmt.Sprintf("Firmware: %s", device.FirmwareVersion()),
+		fmt.Sprintf("MAC: %s", device.Mac()),
+		fmt.Sprintf("Supports: %s", strings.Join(device.Capabilities().Names(), ", ")),
+	}
+	if mode := device.Mode(); mode != "" {
+		lines = append(lines, fmt.Sprintf("Mode: %s", mode))
+	}
+	runtime, err := kasa.RuntimeOn(device, time.Now())
+	if err != nil {
+		log.Println(err)
+	} else {
+		lines = append(lines, fmt.Sprintf("On for %.1f h today", runtime.Hours()))
+	}
+	if sysInfo := device.LastSysInfo(); sysInfo != nil {
+		unknown := sysInfo.UnknownFields()
+		keys := make([]string, 0, len(unknown))
+		for key := range unknown {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) > 0 {
+			lines = append(lines, "", "Other fields:")
+		}
+		for _, key := range keys {
+			value, _ := json.Marshal(unknown[key])
+			lines = append(lines, fmt.Sprintf("%s: %s", key, value))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,67 @@
+package tray
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+// login starts a simulated cloud with the devices and returns them by
+// alias.
+func login(t *testing.T, devices ...kasatest.Device) (*kasatest.Cloud, map[string]kasa.Device) {
+	t.Helper()
+	cloud := kasatest.NewCloud("user@example.org", "secret", devices...)
+	srv := cloud.Start()
+	t.Cleanup(srv.Close)
+	link, err := kasa.TpLinkLoginWithOptions("user@example.org", "secret", &kasa.LoginOptions{BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byAlias := map[string]kasa.Device{}
+	for _, device := range link.DeviceList() {
+		byAlias[device.Alias()] = device
+	}
+	return cloud, byAlias
+}
+
+func TestMenuState(t *testing.T) {
+	shared := kasatest.NewBulb("bulb-1", "Lamp", "KL130")
+	shared.SetRole(kasa.RoleShared)
+	cloud, devices := login(t, kasatest.NewPlug("plug-1", "Fan", "HS100"), shared)
+
+	fan := devices["Fan"]
+	if state := menuStateOf(fan); !state.canTurnOn || state.canTurnOff || state.circadian || state.title != "Fan [OFF]" {
+		t.Errorf("plug that is off: %+v", state)
+	}
+	if err := fan.TurnOn(); err != nil {
+		t.Fatal(err)
+	}
+	if state := menuStateOf(fan); state.canTurnOn || !state.canTurnOff {
+		t.Errorf("plug that is on: %+v", state)
+	}
+	cloud.SetOffline("plug-1", true)
+	fan.Sync()
+	if state := menuStateOf(fan); !strings.HasSuffix(state.title, " (offline)") {
+		t.Errorf("offline plug titled %q", state.title)
+	}
+
+	lamp := devices["Lamp"]
+	if err := lamp.SetMode(kasa.ModeCircadian); err != nil {
+		t.Fatal(err)
+	}
+	if state := menuStateOf(lamp); !state.circadian || !strings.HasSuffix(state.title, " (shared)") {
+		t.Errorf("shared bulb in circadian mode: %+v", state)
+	}
+}
+
+func TestShownDevices(t *testing.T) {
+	foreign := kasatest.NewPlug("plug-2", "Heater", "HS100")
+	foreign.SetRole(2)
+	_, devices := login(t, kasatest.NewPlug("plug-1", "Fan", "HS100"), foreign)
+	shown := shownDevices([]kasa.Device{devices["Fan"], devices["Heater"]})
+	if len(shown) != 1 || shown[0].Alias() != "Fan" {
+		t.Errorf("shown %v, want only the plug the account can control", shown)
+	}
+}
@@ -0,0 +1,814 @@
+// Package tray is the systray front end.
+package tray
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/systray"
+	"github.com/ncruces/zenity"
+	"github.com/tusharsrivastava/kasa-systray/icon"
+	"github.com/tusharsrivastava/kasa-systray/tools"
+	"github.com/tusharsrivastava/kasa-systray/tools/api"
+	"github.com/tusharsrivastava/kasa-systray/tools/dbus"
+	"github.com/tusharsrivastava/kasa-systray/tools/grpc"
+	"github.com/tusharsrivastava/kasa-systray/tools/instance"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/metrics"
+	"github.com/tusharsrivastava/kasa-systray/tools/mqtt"
+)
+
+type Tray interface {
+	Run()
+	// Serve answers the actions forwarded by later launches, and runs
+	// pending, the action of this launch if any, once logged in.
+	Serve(server *instance.Server, pending *instance.Request)
+	ready()
+}
+
+type devSubMenu struct {
+	id    string
+	menu  *systray.MenuItem
+	index int
+}
+
+type deviceMenu struct {
+	device  kasa.Device
+	menu    *systray.MenuItem
+	submenu []*devSubMenu
+	presets []*systray.MenuItem
+}
+
+// pollInterval is how often the devices are synced while the local APIs,
+// the MQTT bridge, the metrics or the D-Bus service report their changes.
+const pollInterval = 30 * time.Second
+
+type tray struct {
+	title       string
+	tooltip     string
+	config      *tools.Configuration
+	devHolder   *systray.MenuItem
+	menuLock    sync.Mutex // guards devicesMenu
+	devicesMenu map[string]*deviceMenu
+	pollOnce    sync.Once
+	registry    *kasa.Registry
+	hub         *kasa.Hub
+	api         *api.Server
+	grpc        *grpc.Server
+	bridge      *mqtt.Bridge
+	metrics     *metrics.Collector
+	dbus        *dbus.Service
+	instance    *instance.Server
+	pending     *instance.Request
+}
+
+func (t *tray) Run() {
+	systray.Run(t.ready, t.exit)
+}
+
+func (t *tray) Serve(server *instance.Server, pending *instance.Request) {
+	t.instance = server
+	t.pending = pending
+	go server.Serve(t.forwarded)
+}
+
+func (t *tray) exit() {
+	if t.instance != nil {
+		t.instance.Close()
+	}
+}
+
+func (t *tray) ready() {
+	systray.SetIcon(icon.Data)
+	systray.SetTitle(t.title)
+	systray.SetTooltip(t.tooltip)
+	go t.loop()
+}
+
+func (t *tray) loop() {
+	login := systray.AddMenuItem("Login", "Login to TPLink")
+	t.devHolder = systray.AddMenuItem("Devices", "Devices")
+	t.devHolder.Disable()
+	autoConnect := systray.AddMenuItemCheckbox(t.getAutoConnectTitle(), "Auto Connect", t.config.AutoConnect)
+	setup := systray.AddMenuItem("Set up new device", "Connect a new device to Wi-Fi")
+	mReset := systray.AddMenuItem("Reset", "Reset")
+	mQuit := systray.AddMenuItem("Quit", "Quit")
+	loginEvt := t.loginEvent(login)
+
+	// Run the event handler goroutines
+	go t.quitHandler(mQuit.ClickedCh)
+	go t.resetHandler(mReset, mQuit.ClickedCh)
+	go t.loginHandler(login, loginEvt)
+	go t.autoConnectHandler(autoConnect, loginEvt)
+	go t.provisionHandler(setup)
+	go t.watchChanges()
+}
+
+func (t *tray) getAutoConnectTitle() string {
+	if t.config.AutoConnect {
+		return "Turn off Auto Connect"
+	}
+	return "Turn on Auto Connect"
+}
+
+func (t *tray) loginEvent(loginMenu *systray.MenuItem) chan bool {
+	ch := make(chan bool)
+	go func() {
+		if t.config.AutoConnect {
+			ch <- true
+		}
+		for {
+			<-loginMenu.ClickedCh
+			ch <- true
+		}
+	}()
+	return ch
+}
+
+func (t *tray) quitHandler(ch chan struct{}) {
+	<-ch
+	systray.Quit()
+}
+
+func (t *tray) resetHandler(mReset *systray.MenuItem, quitChan chan struct{}) {
+	for {
+		<-mReset.ClickedCh
+		err := tools.ResetAll(t.config)
+		if err != nil {
+			tools.DisplayErrorGUI(err)
+		} else {
+			quitChan <- struct{}{}
+		}
+	}
+}
+
+func (t *tray) loginHandler(login *systray.MenuItem, eventChan chan bool) {
+	for {
+		<-eventChan
+		t.startMetrics()
+		auth, isFresh, err := t.config.ReadAuth(true)
+		if err != nil {
+			tools.DisplayErrorGUI(err)
+			continue
+		}
+		session, err := t.config.ReadSession()
+		if err != nil {
+			log.Println(err)
+			session = &tools.Session{}
+		}
+		link, err := kasa.TpLinkLoginWithOptions(auth.Username, auth.Password, &kasa.LoginOptions{
+			TermId:       session.TermId,
+			RefreshToken: session.RefreshToken,
+			MFACode:      tools.MFACodeGUI,
+			BaseURL:      t.config.CloudURL,
+			Transport:    t.cloudTransport(),
+		})
+		if err != nil {
+			tools.DisplayErrorGUI(err)
+			continue
+		}
+		if isFresh {
+			t.config.WriteConfiguration()
+		}
+		if link.BaseURL() != kasa.DefaultCloudURL && link.BaseURL() != t.config.CloudURL {
+			// Remember the regional host the cloud redirected us to.
+			t.config.CloudURL = link.BaseURL()
+			t.config.WriteConfiguration()
+		}
+		if link.RefreshToken() != session.RefreshToken {
+			err = t.config.SetSession(&tools.Session{TermId: link.TermId(), RefreshToken: link.RefreshToken()})
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		login.Disable()
+		tools.Notify("Logged in", "You are now logged in", zenity.InfoIcon)
+		t.devHolder.Enable()
+		link.SetLocalHosts(t.config.TapoHosts)
+		devices := link.DeviceList()
+		msg := fmt.Sprintf("Found %d device(s)", len(devices))
+		tools.Notify("Kasa Notify", msg, zenity.InfoIcon)
+		// The front ends offer the devices of the menu, not the hidden ones.
+		t.registry.Set(t.createDevicesMenu(devices))
+		if t.dbus != nil {
+			t.dbus.Refresh()
+		}
+		if t.bridge != nil {
+			t.bridge.Refresh()
+		}
+		t.startAPI()
+		t.startGRPC()
+		t.startBridge()
+		t.startDBus()
+		if t.pending != nil {
+			go t.forwarded(t.pending)
+			t.pending = nil
+		}
+		if t.api != nil || t.grpc != nil || t.bridge != nil || t.metrics != nil || t.dbus != nil {
+			t.pollOnce.Do(func() {
+				go t.pollDevices()
+			})
+		}
+	}
+}
+
+// forwarded runs an action of the command line, telling the user when it
+// failed since a desktop shortcut shows no output.
+func (t *tray) forwarded(req *instance.Request) (string, error) {
+	message, err := t.runAction(req)
+	if err != nil {
+		tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+	}
+	return message, err
+}
+
+func (t *tray) runAction(req *instance.Request) (string, error) {
+	switch req.Action {
+	case instance.ActionOn, instance.ActionOff, instance.ActionToggle, instance.ActionScene:
+	default:
+		return "", fmt.Errorf("unknown action %q", req.Action)
+	}
+	if len(t.registry.Devices()) == 0 {
+		return "", errors.New("not logged in yet")
+	}
+	if req.Action == instance.ActionScene {
+		scene, ok := t.config.Scenes[strings.ToLower(req.Target)]
+		if !ok {
+			return "", fmt.Errorf("no scene %q", req.Target)
+		}
+		errs := kasa.ApplyScene(t.registry, scene)
+		for _, action := range scene {
+			if device := t.registry.Find(action.Device); device != nil {
+				t.deviceChanged(device)
+			}
+		}
+		if len(errs) > 0 {
+			failures := []string{}
+			for device, err := range errs {
+				failures = append(failures, fmt.Sprintf("%s: %s", device, err))
+			}
+			sort.Strings(failures)
+			return "", fmt.Errorf("scene %s failed for %s", req.Target, strings.Join(failures, ", "))
+		}
+		return fmt.Sprintf("Applied scene %s", req.Target), nil
+	}
+	device := t.registry.Find(req.Target)
+	if device == nil {
+		return "", fmt.Errorf("no device %q", req.Target)
+	}
+	var err error
+	switch {
+	case req.Action == instance.ActionOn:
+		err = device.TurnOn()
+	case req.Action == instance.ActionOff:
+		err = device.TurnOff()
+	case device.IsConnected():
+		err = device.TurnOff()
+	default:
+		err = device.TurnOn()
+	}
+	if err != nil {
+		return "", err
+	}
+	t.deviceChanged(device)
+	if device.IsConnected() {
+		return fmt.Sprintf("%s is now on", device.Alias()), nil
+	}
+	return fmt.Sprintf("%s is now off", device.Alias()), nil
+}
+
+// startAPI serves the local control API once logged in, if it is enabled.
+func (t *tray) startAPI() {
+	if !t.config.APIEnabled || t.api != nil {
+		return
+	}
+	if t.config.APIToken == "" {
+		t.config.APIToken = api.NewToken()
+		t.config.WriteConfiguration()
+	}
+	t.api = api.NewServer(t.hub, t.config.APIToken)
+	t.api.Scenes = func() map[string]kasa.Scene {
+		return t.config.Scenes
+	}
+	go func() {
+		if err := t.api.ListenAndServe(t.config.APIListen); err != nil {
+			tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+		}
+	}()
+}
+
+// startGRPC serves the gRPC API once logged in, if it is enabled. It takes
+// the token of the local API.
+func (t *tray) startGRPC() {
+	if !t.config.GRPCEnabled || t.grpc != nil {
+		return
+	}
+	if t.config.APIToken == "" {
+		t.config.APIToken = api.NewToken()
+		t.config.WriteConfiguration()
+	}
+	t.grpc = grpc.NewServer(t.hub, t.config.APIToken)
+	t.grpc.Scenes = func() map[string]kasa.Scene {
+		return t.config.Scenes
+	}
+	go func() {
+		if err := t.grpc.ListenAndServe(t.config.GRPCListen); err != nil {
+			tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+		}
+	}()
+}
+
+// startBridge connects the MQTT bridge once logged in, if a broker is
+// configured.
+func (t *tray) startBridge() {
+	if t.config.MQTTBroker == "" || t.bridge != nil {
+		return
+	}
+	password, err := t.config.ReadMQTTPassword()
+	if err != nil {
+		tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+		return
+	}
+	t.bridge = mqtt.NewBridge(t.hub, &mqtt.Options{
+		Broker:   t.config.MQTTBroker,
+		Username: t.config.MQTTUsername,
+		Password: password,
+	})
+	if t.config.MQTTPrefix != "" {
+		t.bridge.Prefix = t.config.MQTTPrefix
+	}
+	if t.config.MQTTDiscoveryPrefix != "" {
+		t.bridge.DiscoveryPrefix = t.config.MQTTDiscoveryPrefix
+	}
+	go func() {
+		if err := t.bridge.Run(context.Background()); err != nil {
+			tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+		}
+	}()
+}
+
+// pollDevices syncs the devices and reads their energy meters, so that
+// changes made elsewhere show up in the menu and the event stream.
+func (t *tray) pollDevices() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, dMenu := range t.deviceMenus() {
+			err := dMenu.device.Sync()
+			t.refreshDeviceMenu(dMenu)
+			if err == nil && dMenu.device.Capabilities().Emeter {
+				var reading *kasa.EnergyReading
+				ctx, cancel := context.WithTimeout(context.Background(), pollInterval)
+				reading, err = kasa.ReadEnergy(ctx, dMenu.device)
+				cancel()
+				t.hub.PublishEnergy(dMenu.device, reading)
+			}
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// watchChanges updates the menu of the devices changed through the local
+// APIs, the MQTT bridge or the D-Bus service.
+func (t *tray) watchChanges() {
+	_, changes := t.hub.Subscribe(16)
+	for change := range changes {
+		if change.Type != kasa.ChangeState {
+			continue
+		}
+		if dMenu := t.deviceMenuOf(change.Device.Id()); dMenu != nil {
+			t.updateDeviceMenu(dMenu)
+		}
+	}
+}
+
+// deviceMenus returns the menus of the devices, the login adds to them
+// while the other goroutines read them.
+func (t *tray) deviceMenus() []*deviceMenu {
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
+	menus := make([]*deviceMenu, 0, len(t.devicesMenu))
+	for _, dMenu := range t.devicesMenu {
+		menus = append(menus, dMenu)
+	}
+	return menus
+}
+
+// deviceMenuOf returns the menu of a device, nil if it has none.
+func (t *tray) deviceMenuOf(id string) *deviceMenu {
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
+	return t.devicesMenu[id]
+}
+
+// deviceChanged publishes the state of a device changed by an action of
+// the command line, watchChanges updates its menu.
+func (t *tray) deviceChanged(device kasa.Device) {
+	t.hub.Publish(device)
+}
+
+// startDBus exports the devices on the session bus once logged in, if it
+// is enabled.
+func (t *tray) startDBus() {
+	if !t.config.DBusEnabled || t.dbus != nil {
+		return
+	}
+	service := dbus.NewService(t.hub)
+	service.Scenes = func() map[string]kasa.Scene {
+		return t.config.Scenes
+	}
+	if err := service.Start(); err != nil {
+		tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+		return
+	}
+	t.dbus = service
+}
+
+// startMetrics serves the Prometheus metrics before the login, so that the
+// login requests are counted too, if they are enabled.
+func (t *tray) startMetrics() {
+	if !t.config.MetricsEnabled || t.metrics != nil {
+		return
+	}
+	t.metrics = metrics.NewCollector(t.hub)
+	go func() {
+		if err := t.metrics.ListenAndServe(t.config.MetricsListen); err != nil {
+			tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+		}
+	}()
+}
+
+// cloudTransport records the cloud traffic when a trace directory is
+// configured and counts it when metrics are enabled, nil keeps the default
+// transport.
+func (t *tray) cloudTransport() http.RoundTripper {
+	var transport http.RoundTripper
+	if t.config.TraceDir != "" {
+		recorder, err := kasa.NewRecorder(nil, t.config.TraceDir)
+		if err != nil {
+			log.Println(err)
+		} else {
+			log.Printf("Recording cloud traffic to %s\n", recorder.Dir)
+			transport = recorder
+		}
+	}
+	if t.metrics != nil {
+		transport = t.metrics.Transport(transport)
+	}
+	return transport
+}
+
+func (t *tray) autoConnectHandler(autoConnect *systray.MenuItem, loginEventChan chan bool) {
+	for {
+		<-autoConnect.ClickedCh
+		notifyMsg := "Auto Connect is now "
+		if autoConnect.Checked() {
+			autoConnect.Uncheck()
+			notifyMsg += "off"
+		} else {
+			autoConnect.Check()
+			notifyMsg += "on"
+		}
+		t.config.AutoConnect = autoConnect.Checked()
+		err := t.config.WriteConfiguration()
+		if err != nil {
+			tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+			log.Println(err)
+		}
+		autoConnect.SetTitle(t.getAutoConnectTitle())
+		tools.Notify("Kasa Notify", notifyMsg, zenity.InfoIcon)
+		if autoConnect.Checked() {
+			if len(t.deviceMenus()) == 0 {
+				loginEventChan <- true
+			}
+		}
+	}
+}
+
+func (t *tray) provisionHandler(setup *systray.MenuItem) {
+	for {
+		<-setup.ClickedCh
+		setup.Disable()
+		dev, err := t.provisionDevice()
+		setup.Enable()
+		if err == zenity.ErrCanceled {
+			continue
+		}
+		if err != nil {
+			tools.DisplayErrorGUI(err)
+			continue
+		}
+		msg := fmt.Sprintf("%s is now connected at %s", dev.SysInfo.Alias, dev.Host)
+		tools.Notify("Kasa Notify", msg, zenity.InfoIcon)
+	}
+}
+
+func (t *tray) provisionDevice() (*kasa.DiscoveredDevice, error) {
+	err := zenity.Question(
+		"Connect this computer to the Wi-Fi network of the new device (TP-LINK_Smart...) and continue.",
+		zenity.Title("Set up new device"),
+		zenity.OKLabel("Continue"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provisioner := kasa.NewProvisioner(kasa.DefaultSetupHost)
+	aps, err := provisioner.ScanWifi()
+	if err != nil {
+		return nil, err
+	}
+	keyTypes := map[string]int{}
+	ssids := []string{}
+	for _, ap := range aps {
+		if _, ok := keyTypes[ap.SSID]; ok || ap.SSID == "" {
+			continue
+		}
+		keyTypes[ap.SSID] = ap.KeyType
+		ssids = append(ssids, ap.SSID)
+	}
+	ssid, err := zenity.List("Select the network the device should join", ssids, zenity.Title("Set up new device"))
+	if err != nil {
+		return nil, err
+	}
+	password := ""
+	if keyTypes[ssid] != kasa.KeyTypeNone {
+		password, err = zenity.Entry(
+			fmt.Sprintf("Password for %s", ssid),
+			zenity.Title("Set up new device"),
+			zenity.HideText(),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req := &kasa.ProvisionRequest{
+		SetupHost: kasa.DefaultSetupHost,
+		SSID:      ssid,
+		Password:  password,
+		KeyType:   keyTypes[ssid],
+	}
+	err = zenity.Question("Bind the device to your Kasa account?", zenity.Title("Set up new device"))
+	if err == nil {
+		auth, _, err := t.config.ReadAuth(true)
+		if err != nil {
+			return nil, err
+		}
+		req.CloudUsername = auth.Username
+		req.CloudPassword = auth.Password
+	} else if err != zenity.ErrCanceled {
+		return nil, err
+	}
+	tools.Notify("Kasa Notify", "Reconnect this computer to your Wi-Fi, waiting for the device...", zenity.InfoIcon)
+	return kasa.Provision(req)
+}
+
+// createDevicesMenu adds a menu for every device that can be controlled
+// and returns those devices.
+func (t *tray) createDevicesMenu(devices []kasa.Device) []kasa.Device {
+	shown := shownDevices(devices)
+	created := []*deviceMenu{}
+	for _, device := range shown {
+		mainMenu := t.devHolder.AddSubMenuItem(deviceTitle(device), device.Name())
+		submenu := []*devSubMenu{}
+		caps := device.Capabilities()
+		if caps.OnOff {
+			turnOn := mainMenu.AddSubMenuItem("Turn On", "Turn On")
+			submenu = append(submenu, &devSubMenu{id: "on", menu: turnOn})
+			turnOff := mainMenu.AddSubMenuItem("Turn Off", "Turn Off")
+			submenu = append(submenu, &devSubMenu{id: "off", menu: turnOff})
+		}
+		// Build Preferred State submenu
+		presets := []*systray.MenuItem{}
+		if caps.Dimmable {
+			for _, state := range device.PreferredStates() {
+				title := t.presetTitle(device, state)
+				prefState := mainMenu.AddSubMenuItem(title, state.Summary())
+				apply := prefState.AddSubMenuItem("Apply", "Apply this preset")
+				submenu = append(submenu, &devSubMenu{id: fmt.Sprint(state.Index), menu: apply, index: state.Index})
+				save := prefState.AddSubMenuItem("Save current light here", "Overwrite this preset")
+				submenu = append(submenu, &devSubMenu{id: "save", menu: save, index: state.Index})
+				label := prefState.AddSubMenuItem("Rename...", "Label this preset")
+				submenu = append(submenu, &devSubMenu{id: "label", menu: label, index: state.Index})
+				presets = append(presets, prefState)
+			}
+		}
+		if caps.Circadian {
+			circadian := mainMenu.AddSubMenuItemCheckbox("Follow time of day", "Circadian mode", device.Mode() == kasa.ModeCircadian)
+			submenu = append(submenu, &devSubMenu{id: "circadian", menu: circadian})
+		}
+		info := mainMenu.AddSubMenuItem("Info", "Device information")
+		submenu = append(submenu, &devSubMenu{id: "info", menu: info})
+		raw := mainMenu.AddSubMenuItem("Send raw command...", "Send a request in the device protocol")
+		submenu = append(submenu, &devSubMenu{id: "raw", menu: raw})
+		devMenu := &deviceMenu{device: device, menu: mainMenu, submenu: submenu, presets: presets}
+		t.menuLock.Lock()
+		t.devicesMenu[device.Id()] = devMenu
+		t.menuLock.Unlock()
+		t.refreshDeviceMenu(devMenu)
+		created = append(created, devMenu)
+	}
+	// The menus of an earlier login already have their handler.
+	for _, dMenu := range created {
+		go t.deviceMenuHandler(dMenu)
+	}
+	return shown
+}
+
+func (t *tray) presetTitle(device kasa.Device, state *kasa.PreferredState) string {
+	label := t.config.PresetLabel(device.Id(), state.Index)
+	if label == "" {
+		label = fmt.Sprintf("Preset %d", state.Index+1)
+	}
+	return fmt.Sprintf("%s %s", label, state.Summary())
+}
+
+func (t *tray) deviceMenuHandler(dMenu *deviceMenu) {
+	localCh := getSubmenuClickEvent(dMenu.submenu)
+	for {
+		sm := <-localCh
+		switch sm.id {
+		case "info":
+			zenity.Info(deviceInfoText(dMenu.device), zenity.Title(dMenu.device.Alias()))
+			continue
+		case "raw":
+			if !t.sendRawCommand(dMenu.device) {
+				continue
+			}
+			if err := dMenu.device.Sync(); err != nil {
+				log.Println(err)
+			}
+		case "circadian":
+			mode := kasa.ModeCircadian
+			if sm.menu.Checked() {
+				mode = kasa.ModeNormal
+			}
+			err := dMenu.device.SetMode(mode)
+			if err != nil {
+				tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+				continue
+			}
+			msg := fmt.Sprintf("%s is now in %s mode", dMenu.device.Alias(), mode)
+			tools.Notify("Kasa Notify", msg, zenity.InfoIcon)
+		case "save":
+			log.Println("Saving preferred state")
+			err := dMenu.device.SavePreferredState(sm.index)
+			if err != nil {
+				tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+				continue
+			}
+			msg := fmt.Sprintf("Saved the current light of %s as preset %d", dMenu.device.Alias(), sm.index+1)
+			tools.Notify("Kasa Notify", msg, zenity.InfoIcon)
+		case "label":
+			label, err := zenity.Entry(
+				"Preset label",
+				zenity.Title(dMenu.device.Alias()),
+				zenity.EntryText(t.config.PresetLabel(dMenu.device.Id(), sm.index)),
+			)
+			if err != nil {
+				continue
+			}
+			err = t.config.SetPresetLabel(dMenu.device.Id(), sm.index, label)
+			if err != nil {
+				tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+				continue
+			}
+		case "on":
+			log.Println("Turning on")
+			err := dMenu.device.TurnOn()
+			if err != nil {
+				tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+				continue
+			}
+			msg := fmt.Sprintf("%s now turned On with %d%% brightness", dMenu.device.Alias(), dMenu.device.Brightness())
+			tools.Notify("Kasa Notify", msg, zenity.InfoIcon)
+			log.Println("Turned on")
+		case "off":
+			log.Println("Turning off")
+			err := dMenu.device.TurnOff()
+			if err != nil {
+				tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+				continue
+			}
+			msg := fmt.Sprintf("%s now turned Off", dMenu.device.Alias())
+			tools.Notify("Kasa Notify", msg, zenity.InfoIcon)
+			log.Println("Turned off")
+		default:
+			// Set preferred state
+			log.Println("Setting preferred state")
+			idx, err := strconv.ParseInt(sm.id, 10, 64)
+			if err != nil {
+				tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+				continue
+			}
+			err = dMenu.device.SetPreferredState(int(idx))
+			if err != nil {
+				tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+				continue
+			}
+			msg := fmt.Sprintf("%s now set to brightness %d%%", dMenu.device.Alias(), dMenu.device.Brightness())
+			tools.Notify("Kasa Notify", msg, zenity.InfoIcon)
+			log.Println("Set preferred state")
+		}
+		t.refreshDeviceMenu(dMenu)
+	}
+}
+
+// sendRawCommand asks for a request in the device protocol and shows the
+// answer pretty printed. It reports whether a request was sent.
+func (t *tray) sendRawCommand(device kasa.Device) bool {
+	example := `{"system": {"get_sysinfo": {}}}`
+	if kasa.IsTapoType(device.Type()) {
+		example = `{"method": "get_device_info"}`
+	}
+	request, err := zenity.Entry(
+		"Request, e.g. "+example,
+		zenity.Title("Send raw command to "+device.Alias()),
+	)
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	response, err := device.Raw(ctx, json.RawMessage(request))
+	if err != nil {
+		tools.Notify("Kasa Error", err.Error(), zenity.ErrorIcon)
+		return true
+	}
+	pretty := &bytes.Buffer{}
+	if json.Indent(pretty, response, "", "  ") != nil {
+		pretty.Write(response)
+	}
+	zenity.Info(pretty.String(), zenity.Title(device.Alias()))
+	return true
+}
+
+// refreshDeviceMenu updates the menu of a device and publishes its state
+// to the front ends.
+func (t *tray) refreshDeviceMenu(dMenu *deviceMenu) {
+	t.updateDeviceMenu(dMenu)
+	t.hub.Publish(dMenu.device)
+}
+
+func (t *tray) updateDeviceMenu(dMenu *deviceMenu) {
+	state := menuStateOf(dMenu.device)
+	for _, s := range dMenu.submenu {
+		if s.id == "on" && !state.canTurnOn {
+			s.menu.Disable()
+		} else if s.id == "off" && !state.canTurnOff {
+			s.menu.Disable()
+		} else if s.id == "circadian" {
+			if state.circadian {
+				s.menu.Check()
+			} else {
+				s.menu.Uncheck()
+			}
+			s.menu.Enable()
+		} else {
+			s.menu.Enable()
+		}
+	}
+	states := dMenu.device.PreferredStates()
+	for i, preset := range dMenu.presets {
+		if i < len(states) {
+			preset.SetTitle(t.presetTitle(dMenu.device, states[i]))
+		}
+	}
+	dMenu.menu.SetTitle(state.title)
+}
+
+func getSubmenuClickEvent(menu []*devSubMenu) chan *devSubMenu {
+	ch := make(chan *devSubMenu)
+	for _, sm := range menu {
+		go func(sm *devSubMenu) {
+			for {
+				<-sm.menu.ClickedCh
+				ch <- sm
+			}
+		}(sm)
+	}
+	return ch
+}
+
+func NewTray(title string, tooltip string, config *tools.Configuration) Tray {
+	registry := kasa.NewRegistry()
+	return &tray{
+		title:       title,
+		tooltip:     tooltip,
+		config:      config,
+		devicesMenu: map[string]*deviceMenu{},
+		registry:    registry,
+		hub:         kasa.NewHub(registry),
+	}
+}
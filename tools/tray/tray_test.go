@@ -0,0 +1,92 @@
+package tray
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tusharsrivastava/kasa-systray/tools"
+	"github.com/tusharsrivastava/kasa-systray/tools/instance"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa"
+	"github.com/tusharsrivastava/kasa-systray/tools/kasa/kasatest"
+)
+
+// newTestTray returns a tray that is logged in to devices, without the
+// systray menus.
+func newTestTray(devices map[string]kasa.Device, scenes map[string]kasa.Scene) *tray {
+	t := NewTray("Kasa", "Kasa", &tools.Configuration{Scenes: scenes}).(*tray)
+	list := []kasa.Device{}
+	for _, device := range devices {
+		list = append(list, device)
+	}
+	t.registry.Set(list)
+	return t
+}
+
+func TestRunAction(t *testing.T) {
+	plug := kasatest.NewPlug("plug-1", "Fan", "HS100")
+	bulb := kasatest.NewBulb("bulb-1", "Lamp", "KL130")
+	cloud, devices := login(t, plug, bulb)
+	on := true
+	tr := newTestTray(devices, map[string]kasa.Scene{
+		"evening": {{Device: "Fan", On: &on}, {Device: "Lamp", On: &on}},
+	})
+	_, changes := tr.hub.Subscribe(16)
+
+	for _, tc := range []struct {
+		req  instance.Request
+		want string
+		on   bool
+	}{
+		{instance.Request{Action: instance.ActionToggle, Target: "Fan"}, "Fan is now on", true},
+		{instance.Request{Action: instance.ActionToggle, Target: "Fan"}, "Fan is now off", false},
+		{instance.Request{Action: instance.ActionOff, Target: "Fan"}, "Fan is now off", false},
+		{instance.Request{Action: instance.ActionOn, Target: "Fan"}, "Fan is now on", true},
+	} {
+		message, err := tr.runAction(&tc.req)
+		if err != nil || message != tc.want || plug.IsOn() != tc.on {
+			t.Errorf("%s %s: %q, %v, plug on %v", tc.req.Action, tc.req.Target, message, err, plug.IsOn())
+		}
+	}
+	// The hub got the changes for the menu and the front ends, not the
+	// repeated off.
+	for _, want := range []bool{true, false, true} {
+		select {
+		case change := <-changes:
+			if change.Device.Id() != "plug-1" || change.State.On != want {
+				t.Errorf("change of %s on %v, want the plug on %v", change.Device.Id(), change.State.On, want)
+			}
+		default:
+			t.Fatalf("no change with the plug on %v", want)
+		}
+	}
+	if len(changes) != 0 {
+		t.Errorf("%d more changes", len(changes))
+	}
+
+	if _, err := tr.runAction(&instance.Request{Action: instance.ActionOn, Target: "Heater"}); err == nil {
+		t.Error("turned on a device that does not exist")
+	}
+	if _, err := tr.runAction(&instance.Request{Action: "dim", Target: "Lamp"}); err == nil {
+		t.Error("ran an unknown action")
+	}
+
+	cloud.SetOffline("bulb-1", true)
+	_, err := tr.runAction(&instance.Request{Action: instance.ActionScene, Target: "Evening"})
+	if err == nil || !strings.Contains(err.Error(), "Lamp: ") || strings.Contains(err.Error(), "Fan: ") {
+		t.Errorf("scene with an offline bulb: %v", err)
+	}
+	cloud.SetOffline("bulb-1", false)
+	if message, err := tr.runAction(&instance.Request{Action: instance.ActionScene, Target: "evening"}); err != nil || !bulb.IsOn() {
+		t.Errorf("scene: %q, %v", message, err)
+	}
+	if _, err := tr.runAction(&instance.Request{Action: instance.ActionScene, Target: "morning"}); err == nil {
+		t.Error("applied a scene that does not exist")
+	}
+}
+
+func TestRunActionBeforeLogin(t *testing.T) {
+	tr := newTestTray(nil, nil)
+	if _, err := tr.runAction(&instance.Request{Action: instance.ActionToggle, Target: "Fan"}); err == nil || err.Error() != "not logged in yet" {
+		t.Errorf("action before the login: %v", err)
+	}
+}